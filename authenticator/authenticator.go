@@ -9,11 +9,19 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // These maps work as translators to get the corresponding functions from the values in the configuration.
@@ -22,9 +30,69 @@ var encryptFuncs = map[string]func([]byte) string{"hex": hex.EncodeToString,
 	"base64.URL":    base64.URLEncoding.EncodeToString,
 	"base64.RawURL": base64.RawURLEncoding.EncodeToString}
 
+var (
+	// errReplayed is returned for a signature that was already used.
+	errReplayed = errors.New("Signature was already used.")
+	// ErrReplayCacheFull is returned when the replay cache has no room for another signature of the sender, or no room
+	// at all, the request is valid and can be sent again later.
+	ErrReplayCacheFull = errors.New("Replay cache is full, try again later.")
+	// ErrNoActiveKey is returned by Sign when none of the keys of the Signer is inside its NotBefore/NotAfter window.
+	ErrNoActiveKey = errors.New("No active signing key.")
+	// ErrInvalidCredentials is returned by the CredentialsAuthenticator for unknown clients and wrong credentials alike,
+	// so callers can't find out which client ids exist. The reason is logged.
+	ErrInvalidCredentials = errors.New("Invalid credentials.")
+)
+
 // Authenticator is the main interface of the package, it has only one method to implement.
+// Authenticate returns the Principal that made the request, or an error when the request can't be authenticated.
 type Authenticator interface {
-	Authenticate(message []byte, signature string) error
+	Authenticate(req *Request) (Principal, error)
+}
+
+// Request has what authenticators can check of an http request: the body, the values returned by the extractor,
+// the headers, the method, the path, the remote IP, the peer IP and the TLS state (nil for plain http).
+// RemoteIP is the client IP, which may come from headers like X-Forwarded-For. PeerIP is the address of the connection,
+// it can't be spoofed with headers, so it's the one to use to limit what a sender can do.
+type Request struct {
+	Body      []byte
+	Extracted map[string]string
+	Headers   http.Header
+	Method    string
+	Path      string
+	RemoteIP  string
+	PeerIP    string
+	TLS       *tls.ConnectionState
+}
+
+// NewRequest creates a Request from the http request, its body, the remote IP and the values returned by the extractor.
+func NewRequest(r *http.Request, body []byte, remoteIP string, extracted map[string]string) *Request {
+	peerIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peerIP = r.RemoteAddr
+	}
+	return &Request{
+		Body:      body,
+		Extracted: extracted,
+		Headers:   r.Header,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		RemoteIP:  remoteIP,
+		PeerIP:    peerIP,
+		TLS:       r.TLS,
+	}
+}
+
+// Principal is who made the request, as established by the authenticator.
+// ID identifies the sender and Claims has any other attributes the authenticator knows about it.
+// Authenticators that only check a shared secret return an empty Principal.
+type Principal struct {
+	ID     string                 `json:"id,omitempty"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// IsZero returns true when the Principal doesn't identify anybody.
+func (p Principal) IsZero() bool {
+	return p.ID == "" && len(p.Claims) == 0
 }
 
 // CreateAuthenticator is the function that initializes an authenticator of the appropriate kind based on the configuration received.
@@ -34,6 +102,10 @@ func CreateAuthenticator(class string, params map[string]string) (Authenticator,
 	switch class {
 	case "Signer":
 		auth, err = NewSigner(params)
+	case "CredentialsAuthenticator":
+		auth, err = NewCredentialsAuthenticator(params)
+	case "JWTAuthenticator":
+		auth, err = NewJWTAuthenticator(params)
 	default:
 		auth, err = NewEmptyAuthenticator()
 	}
@@ -51,27 +123,46 @@ func NewEmptyAuthenticator() (EmptyAuthenticator, error) {
 	return EmptyAuthenticator{}, nil
 }
 
-// Authenticate always returns nil.
-func (e EmptyAuthenticator) Authenticate(_ []byte, _ string) error {
-	return nil
+// Authenticate always returns an empty Principal and nil.
+func (e EmptyAuthenticator) Authenticate(_ *Request) (Principal, error) {
+	return Principal{}, nil
 }
 
+// Modes of the Signer: ModeBody signs the body and ModeTimestamp signs timestamp + "." + body.
+const (
+	ModeBody      = "body"
+	ModeTimestamp = "timestamp"
+)
+
+// defaultMaxSkew is how far the timestamp of a request can be from the time it's received in ModeTimestamp.
+const defaultMaxSkew = 5 * time.Minute
+
 /*
-Signer type stores key, hasher and encrypter to generate a signature based on the received message.
+Signer type stores keys, hasher and encrypter to generate a signature based on the received message.
+The keys come from the Key parameter and from "Key.<id>" parameters, each one active between its optional "Key.<id>.NotBefore"
+and "Key.<id>.NotAfter" dates, so keys can be rotated without a cut-over. The request is checked with the key of the extracted
+"key_id" or, when there's none, with all the active keys.
+In ModeTimestamp the extracted "timestamp" (unix seconds) is signed with the body, requests outside the clock skew window are
+rejected and, when the replay cache is enabled, so are the signatures that were already used. The cache keeps up to
+ReplayCacheSize signatures for each peer IP, so a busy sender can't fill it for the others, and up to ReplayCacheTotalSize
+in total (10 times ReplayCacheSize by default).
 */
 type Signer struct {
-	key       []byte
+	keys      []signingKey
 	hasher    func() hash.Hash
 	encrypter func([]byte) string
+	mode      string
+	maxSkew   time.Duration
+	replays   *replayCache
 }
 
 // NewSigner creates a Signer struct with the received parameters.
 func NewSigner(params map[string]string) (Signer, error) {
 	var s Signer
 	// Validate received parameters.
-	key, ok := params["Key"]
-	if !ok {
-		return s, errors.New("Key not received for authenticator.")
+	keys, err := parseKeys(params)
+	if err != nil {
+		return s, err
 	}
 	hasherP, ok := params["Hasher"]
 	if !ok {
@@ -92,17 +183,279 @@ func NewSigner(params map[string]string) (Signer, error) {
 		return s, errors.New("Hashing function not found in hashFuncs.")
 	}
 
+	s = Signer{keys: keys, hasher: hashF, encrypter: encryptF, mode: ModeBody}
+	err = s.parseMode(params)
+	if err != nil {
+		return Signer{}, err
+	}
+
 	//fmt.Printf("Key: %q, Hasher: %q, Encrypter: %q \n", key, hasherP, encrypterP)
-	return Signer{[]byte(key), hashF, encryptF}, nil
+	return s, nil
 }
 
-// Authenticate authenticates a message using the received signature and the parameters of the Signer.
-func (s Signer) Authenticate(message []byte, signature string) error {
-	newSignature := s.encrypter(getHMAC(message, s.key, s.hasher))
-	if signature == newSignature {
+// signingKey is one of the keys of a Signer, notBefore and notAfter are zero when the key doesn't have them.
+type signingKey struct {
+	id        string
+	key       []byte
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// active returns true when the key can be used at the time t.
+func (k signingKey) active(t time.Time) bool {
+	return (k.notBefore.IsZero() || !t.Before(k.notBefore)) && (k.notAfter.IsZero() || t.Before(k.notAfter))
+}
+
+// parseKeys returns the keys in the Key and Key.<id> parameters, the newest ones (by NotBefore) first.
+func parseKeys(params map[string]string) ([]signingKey, error) {
+	byID := make(map[string]*signingKey)
+	dates := make(map[string]string)
+	for name, value := range params {
+		if name == "Key" {
+			byID[""] = &signingKey{key: []byte(value)}
+			continue
+		}
+		if !strings.HasPrefix(name, "Key.") {
+			continue
+		}
+		if strings.HasSuffix(name, ".NotBefore") || strings.HasSuffix(name, ".NotAfter") {
+			dates[name] = value
+			continue
+		}
+		id := strings.TrimPrefix(name, "Key.")
+		if id == "" || value == "" {
+			return nil, fmt.Errorf("Invalid key %q.", name)
+		}
+		byID[id] = &signingKey{id: id, key: []byte(value)}
+	}
+	if len(byID) == 0 {
+		return nil, errors.New("Key not received for authenticator.")
+	}
+
+	for name, value := range dates {
+		id := strings.TrimPrefix(name, "Key.")
+		id = strings.TrimSuffix(strings.TrimSuffix(id, ".NotBefore"), ".NotAfter")
+		k, ok := byID[id]
+		if !ok || id == "" {
+			return nil, fmt.Errorf("%q doesn't belong to any key.", name)
+		}
+		t, err := parseKeyDate(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %q: %v", name, err)
+		}
+		if strings.HasSuffix(name, ".NotBefore") {
+			k.notBefore = t
+		} else {
+			k.notAfter = t
+		}
+	}
+
+	keys := make([]signingKey, 0, len(byID))
+	for _, k := range byID {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].notBefore.Equal(keys[j].notBefore) {
+			return keys[i].notBefore.After(keys[j].notBefore)
+		}
+		return keys[i].id < keys[j].id
+	})
+	return keys, nil
+}
+
+// parseKeyDate parses the dates of the keys, either RFC 3339 timestamps or days like 2006-01-02 (UTC).
+func parseKeyDate(v string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// parseMode sets the mode of the Signer from the Mode, MaxSkew, ReplayCacheSize and ReplayCacheTotalSize parameters.
+func (s *Signer) parseMode(params map[string]string) error {
+	switch params["Mode"] {
+	case "", ModeBody:
+		if params["MaxSkew"] != "" || params["ReplayCacheSize"] != "" || params["ReplayCacheTotalSize"] != "" {
+			return errors.New("MaxSkew, ReplayCacheSize and ReplayCacheTotalSize require Mode timestamp.")
+		}
 		return nil
+	case ModeTimestamp:
+		s.mode = ModeTimestamp
+	default:
+		return fmt.Errorf("Mode %q not supported.", params["Mode"])
+	}
+
+	s.maxSkew = defaultMaxSkew
+	if v := params["MaxSkew"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Invalid MaxSkew %q.", v)
+		}
+		s.maxSkew = d
+	}
+	if v := params["ReplayCacheSize"]; v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("Invalid ReplayCacheSize %q.", v)
+		}
+		total := 10 * size
+		if v := params["ReplayCacheTotalSize"]; v != "" {
+			total, err = strconv.Atoi(v)
+			if err != nil || total < size {
+				return fmt.Errorf("Invalid ReplayCacheTotalSize %q, it must be at least ReplayCacheSize.", v)
+			}
+		}
+		// A timestamp can be maxSkew ahead of the clock, so it's valid for up to twice maxSkew.
+		s.replays = newReplayCache(size, total, 2*s.maxSkew)
+	}
+	return nil
+}
+
+// Sign returns the signature of the message, the same one Authenticate expects.
+// It can be used to sign outgoing messages, for example to send them to another receiver.
+// The message is signed with the newest active key, it returns ErrNoActiveKey when all the keys expired or aren't valid yet.
+func (s Signer) Sign(message []byte) (string, error) {
+	now := time.Now()
+	for _, k := range s.keys {
+		if k.active(now) {
+			return s.sign(message, k), nil
+		}
+	}
+	return "", ErrNoActiveKey
+}
+
+// sign returns the signature of the message with the key k.
+func (s Signer) sign(message []byte, k signingKey) string {
+	return s.encrypter(getHMAC(message, k.key, s.hasher))
+}
+
+// SignTimestamp returns the signature of timestamp + "." + body, the one Authenticate expects in ModeTimestamp.
+func (s Signer) SignTimestamp(timestamp string, body []byte) (string, error) {
+	return s.Sign(append([]byte(timestamp+"."), body...))
+}
+
+// Authenticate authenticates the body of the request using the extracted "signature" and the parameters of the Signer.
+// In ModeTimestamp it also checks the extracted "timestamp" and, if the replay cache is enabled, that the signature is new.
+// The keys are shared by all the senders, so the Principal only has the "key_id" claim of the key that matched, if it has an id.
+func (s Signer) Authenticate(req *Request) (Principal, error) {
+	signature := req.Extracted["signature"]
+	message := req.Body
+	now := time.Now()
+	if s.mode == ModeTimestamp {
+		timestamp := req.Extracted["timestamp"]
+		err := s.checkTimestamp(timestamp, now)
+		if err != nil {
+			return Principal{}, err
+		}
+		message = append([]byte(timestamp+"."), req.Body...)
+	}
+
+	keyID := req.Extracted["key_id"]
+	var matched *signingKey
+	for i, k := range s.keys {
+		if (keyID != "" && k.id != keyID) || !k.active(now) {
+			continue
+		}
+		// hmac.Equal takes the same time wherever the signatures differ.
+		if hmac.Equal([]byte(signature), []byte(s.sign(message, k))) {
+			matched = &s.keys[i]
+			break
+		}
+	}
+	if matched == nil {
+		if keyID != "" {
+			return Principal{}, fmt.Errorf("Signature doesn't match the key %q, or the key isn't active.", keyID)
+		}
+		return Principal{}, errors.New("Signature doesn't match any active key.")
+	}
+	// Only valid signatures are added, so invalid requests can't fill the cache.
+	if s.replays != nil {
+		err := s.replays.add(signature, req.PeerIP, now)
+		if err != nil {
+			return Principal{}, err
+		}
+	}
+	if matched.id == "" {
+		return Principal{}, nil
+	}
+	return Principal{Claims: map[string]interface{}{"key_id": matched.id}}, nil
+}
+
+// checkTimestamp returns an error when the timestamp (unix seconds) is missing or further than maxSkew from now.
+func (s Signer) checkTimestamp(timestamp string, now time.Time) error {
+	if timestamp == "" {
+		return errors.New("Timestamp not received.")
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid timestamp %q.", timestamp)
+	}
+	skew := now.Sub(time.Unix(sec, 0))
+	if skew > s.maxSkew || skew < -s.maxSkew {
+		return fmt.Errorf("Timestamp %q is outside the allowed window of %v.", timestamp, s.maxSkew)
+	}
+	return nil
+}
+
+/*
+replayCache remembers the signatures used in the last ttl, up to size of them for each sender and total for all of them.
+All the entries have the same ttl, so the oldest one is always the first to expire. Entries are never dropped before they
+expire, as a dropped signature could be replayed: when a sender has size signatures in the cache, or the cache has total,
+new ones are rejected until some expire. Replays are detected whoever sends them.
+*/
+type replayCache struct {
+	mu      sync.Mutex
+	size    int
+	total   int
+	ttl     time.Duration
+	expires map[string]time.Time
+	order   []replayEntry
+	senders map[string]int
+}
+
+// replayEntry is a signature in the cache and the sender that used it.
+type replayEntry struct {
+	key    string
+	sender string
+}
+
+func newReplayCache(size, total int, ttl time.Duration) *replayCache {
+	return &replayCache{size: size, total: total, ttl: ttl, expires: make(map[string]time.Time), senders: make(map[string]int)}
+}
+
+// add adds the key of the sender to the cache. It returns errReplayed if the key is in the cache and ErrReplayCacheFull
+// if the sender or the cache have no room.
+func (c *replayCache) add(key, sender string, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.order) > 0 && !now.Before(c.expires[c.order[0].key]) {
+		c.removeOldest()
+	}
+	if _, ok := c.expires[key]; ok {
+		return errReplayed
+	}
+	if c.senders[sender] >= c.size {
+		log.Warn(fmt.Sprintf("Replay cache is full with %d signatures of %q, rejecting its new requests.", c.size, sender))
+		return ErrReplayCacheFull
+	}
+	if len(c.order) >= c.total {
+		log.Warn(fmt.Sprintf("Replay cache is full with %d signatures, rejecting the new requests.", c.total))
+		return ErrReplayCacheFull
+	}
+	c.expires[key] = now.Add(c.ttl)
+	c.order = append(c.order, replayEntry{key: key, sender: sender})
+	c.senders[sender]++
+	return nil
+}
+
+func (c *replayCache) removeOldest() {
+	e := c.order[0]
+	delete(c.expires, e.key)
+	c.order = c.order[1:]
+	if c.senders[e.sender]--; c.senders[e.sender] == 0 {
+		delete(c.senders, e.sender)
 	}
-	return fmt.Errorf("Signatures don't match. Received %q - Generated %q", signature, newSignature)
 }
 
 // Aux function to calculate the HMAC using the message, the hashing function and the key.
@@ -1,8 +1,15 @@
 package authenticator_test
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/efark/data-receiver/authenticator"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSigner_Authenticate(t *testing.T) {
@@ -15,7 +22,7 @@ func TestSigner_Authenticate(t *testing.T) {
 	m := []byte(`Example message`)
 	signature := `eZIp7BDQLn3PuZrDPWSlW3x6dgo`
 
-	err = s.Authenticate(m, signature)
+	_, err = s.Authenticate(&authenticator.Request{Body: m, Extracted: map[string]string{"signature": signature}})
 	if err != nil {
 		t.Error(err.Error())
 		t.FailNow()
@@ -33,9 +40,9 @@ func TestSigner_Invalid(t *testing.T) {
 	m := []byte(`Example message`)
 	signature := `Wrong signature`
 
-	err = s.Authenticate(m, signature)
+	_, err = s.Authenticate(&authenticator.Request{Body: m, Extracted: map[string]string{"signature": signature}})
 	if err == nil {
-		t.Error(err.Error())
+		t.Error("Expected error for a wrong signature.")
 		t.FailNow()
 	}
 
@@ -50,9 +57,354 @@ func TestEmptyAuthenticator_Authenticate(t *testing.T) {
 	m := []byte(`Example message`)
 	signature := `Wrong signature`
 
-	err = s.Authenticate(m, signature)
+	p, err := s.Authenticate(&authenticator.Request{Body: m, Extracted: map[string]string{"signature": signature}})
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	if !p.IsZero() {
+		t.Log(fmt.Sprintf("Expected empty principal, received: %v", p))
+		t.FailNow()
+	}
+}
+
+func TestSigner_Sign(t *testing.T) {
+	params := map[string]string{"Key": `magickey`, "Hasher": "sha1", "Encrypter": "base64.RawURL"}
+	s, err := authenticator.NewSigner(params)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	signature, err := s.Sign([]byte(`Example message`))
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	if signature != `eZIp7BDQLn3PuZrDPWSlW3x6dgo` {
+		t.Error("Signature doesn't match: " + signature)
+		t.FailNow()
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "https://localhost/data/test_service?x=1", nil)
+	r.Header.Set("X-Client-Id", "client-1")
+	r.TLS = &tls.ConnectionState{ServerName: "localhost"}
+
+	req := authenticator.NewRequest(r, []byte(`Example message`), "10.0.0.1", map[string]string{"signature": "abc"})
+	// The peer IP is the one of the connection, httptest uses 192.0.2.1.
+	if req.Method != "POST" || req.Path != "/data/test_service" || req.RemoteIP != "10.0.0.1" || req.PeerIP != "192.0.2.1" {
+		t.Log(fmt.Sprintf("Unexpected request: %v %v %v %v", req.Method, req.Path, req.RemoteIP, req.PeerIP))
+		t.FailNow()
+	}
+	if req.Headers.Get("X-Client-Id") != "client-1" || req.Extracted["signature"] != "abc" || string(req.Body) != "Example message" {
+		t.Log(fmt.Sprintf("Unexpected request: %v %v %q", req.Headers, req.Extracted, req.Body))
+		t.FailNow()
+	}
+	if req.TLS == nil || req.TLS.ServerName != "localhost" {
+		t.Log(fmt.Sprintf("Expected TLS state, received: %v", req.TLS))
+		t.FailNow()
+	}
+}
+
+// timestampRequest returns a request signed by s in ModeTimestamp with the given timestamp.
+func timestampRequest(t *testing.T, s authenticator.Signer, ts time.Time, body string) *authenticator.Request {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	signature, err := s.SignTimestamp(timestamp, []byte(body))
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	return &authenticator.Request{
+		Body:      []byte(body),
+		Extracted: map[string]string{"timestamp": timestamp, "signature": signature},
+	}
+}
+
+func TestSigner_Timestamp(t *testing.T) {
+	params := map[string]string{"Key": `magickey`, "Hasher": "sha256", "Encrypter": "hex", "Mode": "timestamp", "MaxSkew": "1m"}
+	s, err := authenticator.NewSigner(params)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	_, err = s.Authenticate(timestampRequest(t, s, time.Now(), "Example message"))
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	// The body signature alone isn't valid in ModeTimestamp.
+	signature, err := s.Sign([]byte("Example message"))
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	_, err = s.Authenticate(&authenticator.Request{Body: []byte("Example message"), Extracted: map[string]string{
+		"timestamp": strconv.FormatInt(time.Now().Unix(), 10), "signature": signature}})
+	if err == nil {
+		t.Error("Expected error for the body signature.")
+		t.FailNow()
+	}
+
+	for _, ts := range []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(2 * time.Minute)} {
+		_, err = s.Authenticate(timestampRequest(t, s, ts, "Example message"))
+		if err == nil {
+			t.Error(fmt.Sprintf("Expected error for a timestamp outside the window: %v", ts))
+			t.FailNow()
+		}
+	}
+
+	_, err = s.Authenticate(&authenticator.Request{Body: []byte("Example message"), Extracted: map[string]string{"signature": "abc"}})
+	if err == nil {
+		t.Error("Expected error for a missing timestamp.")
+		t.FailNow()
+	}
+}
+
+func TestSigner_Replay(t *testing.T) {
+	params := map[string]string{"Key": `magickey`, "Hasher": "sha256", "Encrypter": "hex", "Mode": "timestamp", "ReplayCacheSize": "2"}
+	s, err := authenticator.NewSigner(params)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	now := time.Now()
+	first := timestampRequest(t, s, now, "message 1")
+	_, err = s.Authenticate(first)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	_, err = s.Authenticate(first)
+	if err == nil {
+		t.Error("Expected error for a replayed request.")
+		t.FailNow()
+	}
+
+	// The cache keeps 2 signatures, when it's full new requests are rejected instead of dropping the first signature.
+	_, err = s.Authenticate(timestampRequest(t, s, now, "message 2"))
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	_, err = s.Authenticate(timestampRequest(t, s, now, "message 3"))
+	if err == nil {
+		t.Error("Expected error when the replay cache is full.")
+		t.FailNow()
+	}
+	_, err = s.Authenticate(first)
+	if err == nil {
+		t.Error("Expected error for a replayed request with the cache full.")
+		t.FailNow()
+	}
+}
+
+func TestSigner_NoActiveKey(t *testing.T) {
+	params := map[string]string{
+		"Hasher": "sha256", "Encrypter": "hex",
+		"Key.expired": "expiredKey", "Key.expired.NotAfter": "2001-01-01",
+		"Key.future": "futureKey", "Key.future.NotBefore": "2999-01-01",
+	}
+	s, err := authenticator.NewSigner(params)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	// No key is used outside its window, not even the first one.
+	signature, err := s.Sign([]byte(`Example message`))
+	if err != authenticator.ErrNoActiveKey || signature != "" {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %q, %v", authenticator.ErrNoActiveKey, signature, err))
+		t.FailNow()
+	}
+	_, err = s.SignTimestamp("1600000000", []byte(`Example message`))
+	if err != authenticator.ErrNoActiveKey {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", authenticator.ErrNoActiveKey, err))
+		t.FailNow()
+	}
+}
+
+func TestSigner_ReplayCachePerSender(t *testing.T) {
+	params := map[string]string{"Key": `magickey`, "Hasher": "sha256", "Encrypter": "hex", "Mode": "timestamp",
+		"ReplayCacheSize": "2", "ReplayCacheTotalSize": "5"}
+	s, err := authenticator.NewSigner(params)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	// The busy sender fills its part of the cache, changing the forwarded IP doesn't give it more room.
+	now := time.Now()
+	var first *authenticator.Request
+	for i := 0; i < 3; i++ {
+		req := timestampRequest(t, s, now, fmt.Sprintf("busy message %d", i))
+		req.PeerIP, req.RemoteIP = "10.0.0.1", fmt.Sprintf("192.168.0.%d", i)
+		_, err = s.Authenticate(req)
+		if i < 2 && err != nil {
+			t.Error(err.Error())
+			t.FailNow()
+		}
+		if i == 2 && !errors.Is(err, authenticator.ErrReplayCacheFull) {
+			t.Log(fmt.Sprintf("Expected error: %v, received: %v", authenticator.ErrReplayCacheFull, err))
+			t.FailNow()
+		}
+		if i == 0 {
+			first = req
+		}
+	}
+
+	// The other senders aren't affected, until the cache is full.
+	for i := 0; i < 4; i++ {
+		req := timestampRequest(t, s, now, fmt.Sprintf("quiet message %d", i))
+		req.PeerIP = fmt.Sprintf("10.0.1.%d", i)
+		_, err = s.Authenticate(req)
+		if i < 3 && err != nil {
+			t.Error(err.Error())
+			t.FailNow()
+		}
+		if i == 3 && !errors.Is(err, authenticator.ErrReplayCacheFull) {
+			t.Log(fmt.Sprintf("Expected error for the full cache: %v, received: %v", authenticator.ErrReplayCacheFull, err))
+			t.FailNow()
+		}
+	}
+
+	// A signature of the busy sender is still a replay when another sender uses it.
+	first.PeerIP = "10.0.0.3"
+	_, err = s.Authenticate(first)
+	if err == nil || errors.Is(err, authenticator.ErrReplayCacheFull) {
+		t.Log(fmt.Sprintf("Expected a replay error, received: %v", err))
+		t.FailNow()
+	}
+}
+
+func TestSigner_ReplayCacheExpiry(t *testing.T) {
+	// Signatures are kept for twice MaxSkew, 2s.
+	params := map[string]string{"Key": `magickey`, "Hasher": "sha256", "Encrypter": "hex", "Mode": "timestamp", "MaxSkew": "1s", "ReplayCacheSize": "1"}
+	s, err := authenticator.NewSigner(params)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	_, err = s.Authenticate(timestampRequest(t, s, time.Now(), "message 1"))
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	_, err = s.Authenticate(timestampRequest(t, s, time.Now(), "message 2"))
+	if err == nil {
+		t.Error("Expected error when the replay cache is full.")
+		t.FailNow()
+	}
+
+	// Once the first signature expires there's room again.
+	time.Sleep(2100 * time.Millisecond)
+	_, err = s.Authenticate(timestampRequest(t, s, time.Now(), "message 2"))
 	if err != nil {
 		t.Error(err.Error())
 		t.FailNow()
 	}
 }
+
+func TestSigner_InvalidMode(t *testing.T) {
+	for _, params := range []map[string]string{
+		{"Key": `magickey`, "Hasher": "sha256", "Encrypter": "hex", "Mode": "header"},
+		{"Key": `magickey`, "Hasher": "sha256", "Encrypter": "hex", "ReplayCacheSize": "10"},
+		{"Key": `magickey`, "Hasher": "sha256", "Encrypter": "hex", "Mode": "timestamp", "ReplayCacheSize": "10", "ReplayCacheTotalSize": "5"},
+		{"Key": `magickey`, "Hasher": "sha256", "Encrypter": "hex", "Mode": "timestamp", "MaxSkew": "-1m"},
+	} {
+		_, err := authenticator.NewSigner(params)
+		if err == nil {
+			t.Error(fmt.Sprintf("Expected error for parameters: %v", params))
+			t.FailNow()
+		}
+	}
+}
+
+func TestSigner_Keyring(t *testing.T) {
+	now := time.Now().UTC()
+	params := map[string]string{
+		"Hasher": "sha256", "Encrypter": "hex",
+		"Key.old": "oldKey", "Key.old.NotAfter": now.Add(time.Hour).Format(time.RFC3339),
+		"Key.new": "newKey", "Key.new.NotBefore": now.Add(-time.Minute).Format(time.RFC3339),
+		"Key.expired": "expiredKey", "Key.expired.NotAfter": now.Add(-time.Hour).Format(time.RFC3339),
+		"Key.future": "futureKey", "Key.future.NotBefore": "2999-01-01",
+	}
+	s, err := authenticator.NewSigner(params)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	m := []byte(`Example message`)
+
+	// sign returns the signature of m with a single key.
+	sign := func(key string) string {
+		k, err := authenticator.NewSigner(map[string]string{"Key": key, "Hasher": "sha256", "Encrypter": "hex"})
+		if err != nil {
+			t.Error(err.Error())
+			t.FailNow()
+		}
+		signature, err := k.Sign(m)
+		if err != nil {
+			t.Error(err.Error())
+			t.FailNow()
+		}
+		return signature
+	}
+
+	// Outgoing messages are signed with the newest active key.
+	signature, err := s.Sign(m)
+	if err != nil || signature != sign("newKey") {
+		t.Log(fmt.Sprintf("Expected signature: %v, received: %v, error: %v", sign("newKey"), signature, err))
+		t.FailNow()
+	}
+
+	cases := []struct {
+		key, keyID string
+		valid      bool
+	}{
+		{"oldKey", "", true},
+		{"newKey", "", true},
+		{"oldKey", "old", true},
+		{"newKey", "new", true},
+		{"oldKey", "new", false},
+		{"expiredKey", "", false},
+		{"expiredKey", "expired", false},
+		{"futureKey", "", false},
+		{"newKey", "unknown", false},
+	}
+	for _, c := range cases {
+		extracted := map[string]string{"signature": sign(c.key)}
+		if c.keyID != "" {
+			extracted["key_id"] = c.keyID
+		}
+		p, err := s.Authenticate(&authenticator.Request{Body: m, Extracted: extracted})
+		if (err == nil) != c.valid {
+			t.Log(fmt.Sprintf("Expected valid: %v for key %q and key_id %q, received: %v", c.valid, c.key, c.keyID, err))
+			t.FailNow()
+		}
+		if c.valid && p.Claims["key_id"] != strings.TrimSuffix(c.key, "Key") {
+			t.Log(fmt.Sprintf("Expected key_id: %v, received: %v", strings.TrimSuffix(c.key, "Key"), p.Claims))
+			t.FailNow()
+		}
+	}
+}
+
+func TestSigner_InvalidKeys(t *testing.T) {
+	for _, params := range []map[string]string{
+		{"Hasher": "sha256", "Encrypter": "hex"},
+		{"Key.": "magickey", "Hasher": "sha256", "Encrypter": "hex"},
+		{"Key.a": "magickey", "Key.b.NotAfter": "2030-01-01", "Hasher": "sha256", "Encrypter": "hex"},
+		{"Key.a": "magickey", "Key.a.NotBefore": "yesterday", "Hasher": "sha256", "Encrypter": "hex"},
+	} {
+		_, err := authenticator.NewSigner(params)
+		if err == nil {
+			t.Error(fmt.Sprintf("Expected error for parameters: %v", params))
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,264 @@
+/*
+This file has the CredentialsAuthenticator, it authenticates every client of a service with its own credentials from a file.
+*/
+package authenticator
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultCredentialsReloadInterval is how often the credentials and JWKS files are checked for changes.
+const defaultCredentialsReloadInterval = 10 * time.Second
+
+// signerParams are the parameters of the CredentialsAuthenticator passed to the Signer of every client with a secret.
+var signerParams = []string{"Hasher", "Encrypter", "Mode", "MaxSkew", "ReplayCacheSize", "ReplayCacheTotalSize"}
+
+// credentialsFile is the content of the credentials file, the clients by their id.
+type credentialsFile struct {
+	Clients map[string]credential `json:"clients" yaml:"clients"`
+}
+
+// credential has either the HMAC key a client signs with, or the SHA-256 (hex encoded) of the token it sends.
+// Tokens are better when the client can use them, only their hash is stored.
+type credential struct {
+	Secret      string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	TokenSHA256 string `json:"token_sha256,omitempty" yaml:"token_sha256,omitempty"`
+}
+
+// client is a credential ready to check requests: a Signer for secrets or the decoded hash for tokens.
+type client struct {
+	cred   credential
+	signer *Signer
+	token  []byte
+}
+
+/*
+CredentialsAuthenticator looks up the client by the extracted "client_id" in a credentials file (Json or yaml) and checks
+the request with the client's credential: the extracted "signature" with its secret, like the Signer, or the SHA-256 of the
+extracted "token". The client id is the Principal.
+The file is checked for changes every reload interval, so clients can be added or removed without a restart.
+*/
+type CredentialsAuthenticator struct {
+	params map[string]string
+
+	file    *watchedFile
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+// NewCredentialsAuthenticator creates the authenticator from its parameters: CredentialsFile, ReloadInterval,
+// and Hasher, Encrypter, Mode, MaxSkew, ReplayCacheSize and ReplayCacheTotalSize for the clients with secrets, like the Signer.
+func NewCredentialsAuthenticator(params map[string]string) (*CredentialsAuthenticator, error) {
+	path := params["CredentialsFile"]
+	if path == "" {
+		return nil, errors.New("CredentialsFile not received for authenticator.")
+	}
+	file, err := newWatchedFile(path, params)
+	if err != nil {
+		return nil, err
+	}
+	sp := make(map[string]string)
+	for _, name := range signerParams {
+		if v, ok := params[name]; ok {
+			sp[name] = v
+		}
+	}
+
+	a := &CredentialsAuthenticator{params: sp, file: file}
+	err = a.file.reload(time.Now(), a.load)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Authenticate checks the request with the credential of the extracted "client_id", and returns it as the Principal.
+// Unknown clients and wrong credentials fail with ErrInvalidCredentials, only a full replay cache is told apart.
+func (a *CredentialsAuthenticator) Authenticate(req *Request) (Principal, error) {
+	clientID := req.Extracted["client_id"]
+	if clientID == "" {
+		return Principal{}, errors.New("Client id not received.")
+	}
+	err := a.check(clientID, req)
+	if errors.Is(err, ErrReplayCacheFull) {
+		return Principal{}, err
+	}
+	if err != nil {
+		log.Warn(fmt.Sprintf("Client %q not authenticated: %v", clientID, err))
+		return Principal{}, ErrInvalidCredentials
+	}
+	return Principal{ID: clientID}, nil
+}
+
+// check checks the request with the credential of the client, the error has the reason it failed.
+func (a *CredentialsAuthenticator) check(clientID string, req *Request) error {
+	c, ok := a.client(clientID)
+	if !ok {
+		return errors.New("Client not found.")
+	}
+	if c.signer != nil {
+		_, err := c.signer.Authenticate(req)
+		return err
+	}
+	token := req.Extracted["token"]
+	if token == "" {
+		return errors.New("Token not received.")
+	}
+	sum := sha256.Sum256([]byte(token))
+	if !hmac.Equal(sum[:], c.token) {
+		return errors.New("Invalid token.")
+	}
+	return nil
+}
+
+// client returns the client with the id, reloading the credentials file first when it's time to check it.
+// The file is read and loaded without holding the lock, so the other requests aren't blocked meanwhile.
+// If the file can't be loaded the error is logged and the previous credentials are kept.
+func (a *CredentialsAuthenticator) client(id string) (*client, bool) {
+	a.file.check(time.Now(), a.load)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.clients[id]
+	return c, ok
+}
+
+// load validates the content of the credentials file and replaces the clients. The watchedFile runs one load at a time.
+// Clients whose secret didn't change keep their Signer, so their replay cache isn't lost.
+func (a *CredentialsAuthenticator) load(b []byte) error {
+	var file credentialsFile
+	var err error
+	switch filepath.Ext(a.file.path) {
+	case ".json":
+		err = json.Unmarshal(b, &file)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &file)
+	default:
+		return fmt.Errorf("Credentials file %q must be json or yaml.", a.file.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	current := a.clients
+	a.mu.Unlock()
+	clients := make(map[string]*client, len(file.Clients))
+	for id, cred := range file.Clients {
+		if old, ok := current[id]; ok && old.cred == cred {
+			clients[id] = old
+			continue
+		}
+		c := &client{cred: cred}
+		switch {
+		case cred.Secret != "" && cred.TokenSHA256 == "":
+			params := map[string]string{"Key": cred.Secret}
+			for k, v := range a.params {
+				params[k] = v
+			}
+			s, err := NewSigner(params)
+			if err != nil {
+				return fmt.Errorf("Client %q: %v", id, err)
+			}
+			c.signer = &s
+		case cred.TokenSHA256 != "" && cred.Secret == "":
+			c.token, err = hex.DecodeString(cred.TokenSHA256)
+			if err != nil || len(c.token) != sha256.Size {
+				return fmt.Errorf("Client %q: token_sha256 must be a hex encoded SHA-256.", id)
+			}
+		default:
+			return fmt.Errorf("Client %q must have either a secret or a token_sha256.", id)
+		}
+		clients[id] = c
+	}
+	a.mu.Lock()
+	a.clients = clients
+	a.mu.Unlock()
+	log.Info(fmt.Sprintf("Loaded %d clients from %q.", len(clients), a.file.path))
+	return nil
+}
+
+/*
+watchedFile is a file that is loaded again when it changes. It's checked at most once every interval, when the modification
+time or the size changed since it was loaded its content is passed to the load function again.
+Only one check runs at a time, the calls made meanwhile return at once and the authenticators keep using what they have.
+*/
+type watchedFile struct {
+	path     string
+	interval time.Duration
+
+	mu        sync.Mutex
+	checked   time.Time
+	reloading bool
+	modTime   time.Time
+	size      int64
+}
+
+// newWatchedFile returns the watchedFile for path, checked every ReloadInterval in params (10s by default).
+func newWatchedFile(path string, params map[string]string) (*watchedFile, error) {
+	f := &watchedFile{path: path, interval: defaultCredentialsReloadInterval}
+	if v, ok := params["ReloadInterval"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid ReloadInterval %q.", v)
+		}
+		f.interval = d
+	}
+	return f, nil
+}
+
+// check reloads the file when the interval passed since the last check and no other check is running. Errors are logged,
+// and whatever was loaded before is kept.
+func (f *watchedFile) check(now time.Time, load func([]byte) error) {
+	f.mu.Lock()
+	if f.reloading || now.Sub(f.checked) < f.interval {
+		f.mu.Unlock()
+		return
+	}
+	f.reloading = true
+	f.mu.Unlock()
+
+	err := f.reload(now, load)
+	if err != nil {
+		slog.Error(fmt.Sprintf("File %q not reloaded: %v", f.path, err))
+	}
+	f.mu.Lock()
+	f.reloading = false
+	f.mu.Unlock()
+}
+
+// reload calls load with the content of the file if it changed since it was last loaded, or if it was never loaded.
+// It's called by check, or before the authenticator is used.
+func (f *watchedFile) reload(now time.Time, load func([]byte) error) error {
+	f.mu.Lock()
+	f.checked = now
+	f.mu.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if !f.modTime.IsZero() && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	err = load(b)
+	if err != nil {
+		return err
+	}
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
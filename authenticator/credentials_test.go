@@ -0,0 +1,209 @@
+package authenticator_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/efark/data-receiver/authenticator"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCredentials writes the content to the file, with a modification time different from the previous one.
+func writeCredentials(t *testing.T, path, content string, modTime time.Time) {
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+}
+
+// signedRequest returns the request of clientID with the body signed with the key.
+func signedRequest(t *testing.T, clientID, key, body string) *authenticator.Request {
+	s, err := authenticator.NewSigner(map[string]string{"Key": key, "Hasher": "sha256", "Encrypter": "hex"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	signature, err := s.Sign([]byte(body))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return &authenticator.Request{
+		Body:      []byte(body),
+		Extracted: map[string]string{"client_id": clientID, "signature": signature},
+	}
+}
+
+func TestCredentialsAuthenticator_Authenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	sum := sha256.Sum256([]byte("partnerToken"))
+	path := filepath.Join(dir, "clients.yaml")
+	writeCredentials(t, path, fmt.Sprintf(`
+clients:
+  partner-a:
+    secret: keyA
+  partner-b:
+    token_sha256: %s
+`, hex.EncodeToString(sum[:])), time.Now().Add(-time.Hour))
+
+	a, err := authenticator.CreateAuthenticator("CredentialsAuthenticator", map[string]string{
+		"CredentialsFile": path, "Hasher": "sha256", "Encrypter": "hex", "ReloadInterval": "1ns"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	p, err := a.Authenticate(signedRequest(t, "partner-a", "keyA", "Example message"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if p.ID != "partner-a" {
+		t.Log(fmt.Sprintf("Expected principal: %q, received: %v", "partner-a", p))
+		t.FailNow()
+	}
+
+	p, err = a.Authenticate(&authenticator.Request{Extracted: map[string]string{"client_id": "partner-b", "token": "partnerToken"}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if p.ID != "partner-b" {
+		t.Log(fmt.Sprintf("Expected principal: %q, received: %v", "partner-b", p))
+		t.FailNow()
+	}
+
+	_, err = a.Authenticate(signedRequest(t, "", "keyA", "Example message"))
+	if err == nil {
+		t.Error("Expected error without client id.")
+		t.FailNow()
+	}
+	// Unknown clients get the same error as wrong credentials.
+	for _, req := range []*authenticator.Request{
+		signedRequest(t, "partner-a", "keyB", "Example message"),
+		signedRequest(t, "partner-c", "keyA", "Example message"),
+		{Extracted: map[string]string{"client_id": "partner-b", "token": "wrongToken"}},
+		{Extracted: map[string]string{"client_id": "partner-b"}},
+		{Extracted: map[string]string{"client_id": "partner-c", "token": "wrongToken"}},
+	} {
+		_, err = a.Authenticate(req)
+		if err != authenticator.ErrInvalidCredentials {
+			t.Log(fmt.Sprintf("Expected error for request %v: %v, received: %v", req.Extracted, authenticator.ErrInvalidCredentials, err))
+			t.FailNow()
+		}
+	}
+
+	// The new file replaces the clients: partner-a gets a new secret, partner-b is removed and partner-c added.
+	writeCredentials(t, path, `
+clients:
+  partner-a:
+    secret: newKeyA
+  partner-c:
+    secret: keyC
+`, time.Now())
+
+	_, err = a.Authenticate(signedRequest(t, "partner-a", "keyA", "Example message"))
+	if err == nil {
+		t.Error("Expected error for the old secret.")
+		t.FailNow()
+	}
+	for _, req := range []*authenticator.Request{
+		signedRequest(t, "partner-a", "newKeyA", "Example message"),
+		signedRequest(t, "partner-c", "keyC", "Example message"),
+	} {
+		_, err = a.Authenticate(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	_, err = a.Authenticate(&authenticator.Request{Extracted: map[string]string{"client_id": "partner-b", "token": "partnerToken"}})
+	if err == nil {
+		t.Error("Expected error for a removed client.")
+		t.FailNow()
+	}
+
+	// An invalid file is ignored and the previous clients are kept.
+	writeCredentials(t, path, "clients: [", time.Now().Add(time.Hour))
+	_, err = a.Authenticate(signedRequest(t, "partner-c", "keyC", "Example message"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+}
+
+func TestCredentialsAuthenticator_JSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "clients.json")
+	writeCredentials(t, path, `{"clients": {"partner-a": {"secret": "keyA"}}}`, time.Now())
+
+	a, err := authenticator.NewCredentialsAuthenticator(map[string]string{
+		"CredentialsFile": path, "Hasher": "sha256", "Encrypter": "hex"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	p, err := a.Authenticate(signedRequest(t, "partner-a", "keyA", "Example message"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if p.ID != "partner-a" {
+		t.Log(fmt.Sprintf("Expected principal: %q, received: %v", "partner-a", p))
+		t.FailNow()
+	}
+}
+
+func TestCredentialsAuthenticator_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"both.yaml":    "clients:\n  partner-a:\n    secret: keyA\n    token_sha256: abc\n",
+		"none.yaml":    "clients:\n  partner-a: {}\n",
+		"hash.yaml":    "clients:\n  partner-a:\n    token_sha256: abc\n",
+		"clients.toml": "[clients]\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		writeCredentials(t, path, content, time.Now())
+		_, err = authenticator.NewCredentialsAuthenticator(map[string]string{
+			"CredentialsFile": path, "Hasher": "sha256", "Encrypter": "hex"})
+		if err == nil {
+			t.Error(fmt.Sprintf("Expected error for file %q.", name))
+			t.FailNow()
+		}
+	}
+
+	_, err = authenticator.NewCredentialsAuthenticator(map[string]string{"CredentialsFile": filepath.Join(dir, "missing.yaml")})
+	if err == nil {
+		t.Error("Expected error for a missing file.")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,5 @@
+package authenticator
+
+import "github.com/efark/data-receiver/logger"
+
+var log, slog = logger.GetLogger()
@@ -0,0 +1,436 @@
+/*
+This file has the JWTAuthenticator, it authenticates the requests by their bearer token.
+*/
+package authenticator
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultJWTLeeway is the clock skew allowed when checking exp and nbf.
+const defaultJWTLeeway = time.Minute
+
+// minRSAKeyBits is the size of the smallest RSA modulus accepted in the JWKS file.
+const minRSAKeyBits = 2048
+
+// jwtHMACs has the hash functions of the HMAC algorithms.
+var jwtHMACs = map[string]func() hash.Hash{"HS256": sha256.New, "HS384": sha512.New384, "HS512": sha512.New}
+
+// jwtHeader is the header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwk is a key of a JWKS file, only the fields of RSA, P-256 and Ed25519 public keys are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey is a key of the JWKS file ready to verify tokens of the algorithm alg.
+type publicKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+/*
+JWTAuthenticator validates the token in the "Authorization: Bearer" header.
+HS256, HS384 and HS512 tokens are checked with the configured secrets and RS256, ES256 and EdDSA tokens with the public keys of
+a JWKS file, which is reloaded when it changes. The kid of the token selects the key, without kid all the keys of the algorithm
+are tried.
+After the signature it checks exp and nbf (with some leeway), iss, aud and the required claims. The claims are the Principal,
+its ID is the "sub" claim or the one in PrincipalClaim.
+Tokens without exp are rejected, as they would be valid forever, unless AllowNoExp is "true".
+*/
+type JWTAuthenticator struct {
+	secrets        map[string][]byte
+	issuers        []string
+	audiences      []string
+	requiredClaims []string
+	principalClaim string
+	leeway         time.Duration
+	allowNoExp     bool
+
+	jwks *watchedFile
+	mu   sync.Mutex
+	keys []publicKey
+}
+
+// NewJWTAuthenticator creates the authenticator from its parameters: Secret and "Secret.<kid>" for the HMAC algorithms,
+// JWKSFile and ReloadInterval for the public keys, Issuer and Audience (comma separated, any of them is valid),
+// RequiredClaims (comma separated), Leeway, PrincipalClaim and AllowNoExp.
+func NewJWTAuthenticator(params map[string]string) (*JWTAuthenticator, error) {
+	a := &JWTAuthenticator{
+		secrets:        make(map[string][]byte),
+		issuers:        splitList(params["Issuer"]),
+		audiences:      splitList(params["Audience"]),
+		requiredClaims: splitList(params["RequiredClaims"]),
+		principalClaim: "sub",
+		leeway:         defaultJWTLeeway,
+	}
+	for name, value := range params {
+		if name != "Secret" && !strings.HasPrefix(name, "Secret.") {
+			continue
+		}
+		if value == "" || name == "Secret." {
+			return nil, fmt.Errorf("Invalid secret %q.", name)
+		}
+		a.secrets[strings.TrimPrefix(strings.TrimPrefix(name, "Secret"), ".")] = []byte(value)
+	}
+	if v, ok := params["PrincipalClaim"]; ok && v != "" {
+		a.principalClaim = v
+	}
+	if v, ok := params["Leeway"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("Invalid Leeway %q.", v)
+		}
+		a.leeway = d
+	}
+	if v, ok := params["AllowNoExp"]; ok {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid AllowNoExp %q.", v)
+		}
+		a.allowNoExp = allow
+	}
+
+	if path := params["JWKSFile"]; path != "" {
+		file, err := newWatchedFile(path, params)
+		if err != nil {
+			return nil, err
+		}
+		a.jwks = file
+		err = a.jwks.reload(time.Now(), a.loadJWKS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(a.secrets) == 0 && a.jwks == nil {
+		return nil, errors.New("Secret or JWKSFile not received for authenticator.")
+	}
+	return a, nil
+}
+
+// Authenticate validates the bearer token of the request and returns its claims as the Principal.
+func (a *JWTAuthenticator) Authenticate(req *Request) (Principal, error) {
+	auth := req.Headers.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return Principal{}, errors.New("Bearer token not received.")
+	}
+	token := strings.TrimSpace(auth[len("Bearer "):])
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, errors.New("Malformed token.")
+	}
+	var header jwtHeader
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return Principal{}, fmt.Errorf("Malformed token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, fmt.Errorf("Malformed token signature: %v", err)
+	}
+	err = a.verify(header, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	var claims map[string]interface{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return Principal{}, fmt.Errorf("Malformed token claims: %v", err)
+	}
+	err = a.checkClaims(claims, time.Now())
+	if err != nil {
+		return Principal{}, err
+	}
+	id, _ := claims[a.principalClaim].(string)
+	return Principal{ID: id, Claims: claims}, nil
+}
+
+// verify checks the signature of the token with the secrets or the public keys, depending on the algorithm.
+// The algorithm of the header can only pick a key of its kind, so a public key can't be used as an HMAC secret.
+func (a *JWTAuthenticator) verify(header jwtHeader, signed, signature []byte) error {
+	if hasher, ok := jwtHMACs[header.Alg]; ok {
+		// The kid selects the secret when there's one with that id, otherwise all the secrets are tried.
+		_, known := a.secrets[header.Kid]
+		for kid, secret := range a.secrets {
+			if known && kid != header.Kid {
+				continue
+			}
+			mac := hmac.New(hasher, secret)
+			mac.Write(signed)
+			if hmac.Equal(signature, mac.Sum(nil)) {
+				return nil
+			}
+		}
+		return errors.New("Invalid token signature.")
+	}
+
+	switch header.Alg {
+	case "RS256", "ES256", "EdDSA":
+	default:
+		return fmt.Errorf("Token algorithm %q not supported.", header.Alg)
+	}
+	if a.jwks == nil {
+		return fmt.Errorf("Token algorithm %q not supported.", header.Alg)
+	}
+	a.jwks.check(time.Now(), a.loadJWKS)
+	a.mu.Lock()
+	keys := a.keys
+	a.mu.Unlock()
+
+	digest := sha256.Sum256(signed)
+	for _, k := range keys {
+		if k.alg != header.Alg || (header.Kid != "" && k.kid != header.Kid) {
+			continue
+		}
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			// ES256 signatures are r and s, 32 bytes each.
+			if len(signature) == 64 {
+				r := new(big.Int).SetBytes(signature[:32])
+				s := new(big.Int).SetBytes(signature[32:])
+				if ecdsa.Verify(key, digest[:], r, s) {
+					return nil
+				}
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, signed, signature) {
+				return nil
+			}
+		}
+	}
+	return errors.New("Invalid token signature.")
+}
+
+// checkClaims checks exp, nbf, iss, aud and the required claims. exp is required unless allowNoExp is set.
+func (a *JWTAuthenticator) checkClaims(claims map[string]interface{}, now time.Time) error {
+	for _, name := range a.requiredClaims {
+		if claims[name] == nil {
+			return fmt.Errorf("Claim %q not received.", name)
+		}
+	}
+	if v, ok := claims["exp"]; ok {
+		exp, err := numericDate(v)
+		if err != nil {
+			return fmt.Errorf("Invalid exp: %v", err)
+		}
+		if now.After(exp.Add(a.leeway)) {
+			return errors.New("Token expired.")
+		}
+	} else if !a.allowNoExp {
+		return fmt.Errorf("Claim %q not received.", "exp")
+	}
+	if v, ok := claims["nbf"]; ok {
+		nbf, err := numericDate(v)
+		if err != nil {
+			return fmt.Errorf("Invalid nbf: %v", err)
+		}
+		if now.Before(nbf.Add(-a.leeway)) {
+			return errors.New("Token not valid yet.")
+		}
+	}
+	if len(a.issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !contains(a.issuers, iss) {
+			return fmt.Errorf("Issuer %q not accepted.", iss)
+		}
+	}
+	if len(a.audiences) > 0 {
+		var aud []string
+		switch v := claims["aud"].(type) {
+		case string:
+			aud = []string{v}
+		case []interface{}:
+			for _, s := range v {
+				if s, ok := s.(string); ok {
+					aud = append(aud, s)
+				}
+			}
+		}
+		accepted := false
+		for _, s := range aud {
+			accepted = accepted || contains(a.audiences, s)
+		}
+		if !accepted {
+			return fmt.Errorf("Audience %v not accepted.", aud)
+		}
+	}
+	return nil
+}
+
+// loadJWKS parses the JWKS file and replaces the public keys. The watchedFile runs one load at a time.
+// Keys of other types, curves or uses are skipped, as the file may have keys for other applications, and so are the
+// invalid or weak ones, with a warning. It fails when no key is left and there are no secrets either.
+func (a *JWTAuthenticator) loadJWKS(b []byte) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := json.Unmarshal(b, &set)
+	if err != nil {
+		return err
+	}
+	keys := make([]publicKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			log.Warn(fmt.Sprintf("Key %q of the JWKS file skipped: %v", k.Kid, err))
+			continue
+		}
+		if pk.key == nil || (k.Alg != "" && k.Alg != pk.alg) {
+			log.Warn(fmt.Sprintf("Key %q of the JWKS file skipped, kty %q, crv %q and alg %q not supported.", k.Kid, k.Kty, k.Crv, k.Alg))
+			continue
+		}
+		keys = append(keys, pk)
+	}
+	if len(keys) == 0 && len(a.secrets) == 0 {
+		return fmt.Errorf("No usable keys in the JWKS file %q.", a.jwks.path)
+	}
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	log.Info(fmt.Sprintf("Loaded %d keys from %q.", len(keys), a.jwks.path))
+	return nil
+}
+
+// publicKey decodes the key. The key is nil when its type or curve isn't supported.
+func (k jwk) publicKey() (publicKey, error) {
+	pk := publicKey{kid: k.Kid}
+	switch {
+	case k.Kty == "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return pk, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return pk, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return pk, errors.New("Invalid RSA exponent.")
+		}
+		if n.BitLen() < minRSAKeyBits {
+			return pk, fmt.Errorf("RSA key of %d bits, at least %d are required.", n.BitLen(), minRSAKeyBits)
+		}
+		pk.alg, pk.key = "RS256", &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return pk, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return pk, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return pk, errors.New("Point not on the P-256 curve.")
+		}
+		pk.alg, pk.key = "ES256", &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return pk, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return pk, errors.New("Invalid Ed25519 key size.")
+		}
+		pk.alg, pk.key = "EdDSA", ed25519.PublicKey(x)
+	}
+	return pk, nil
+}
+
+// decodeJWTPart decodes a base64url Json part of the token into v. Numbers are kept as json.Number.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// decodeBigInt decodes a base64url big-endian integer of a JWK.
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("Empty key parameter.")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// numericDate returns the time of a NumericDate claim, seconds since the epoch.
+func numericDate(v interface{}) (time.Time, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, fmt.Errorf("%v isn't a number.", v)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), nil
+}
+
+// splitList returns the trimmed, non empty values of a comma separated list.
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// contains returns true if s is in values.
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
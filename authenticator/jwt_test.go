@@ -0,0 +1,352 @@
+package authenticator_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/efark/data-receiver/authenticator"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// jwtSign returns the token with the header and the claims signed by sign.
+func jwtSign(t *testing.T, header, claims map[string]interface{}, sign func([]byte) []byte) string {
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+// hs256 signs with the secret.
+func hs256(secret string) func([]byte) []byte {
+	return func(b []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(b)
+		return mac.Sum(nil)
+	}
+}
+
+// bearerRequest returns a request with the token in the Authorization header.
+func bearerRequest(token string) *authenticator.Request {
+	return &authenticator.Request{Headers: http.Header{"Authorization": []string{"Bearer " + token}}}
+}
+
+func TestJWTAuthenticator_HMAC(t *testing.T) {
+	a, err := authenticator.CreateAuthenticator("JWTAuthenticator", map[string]string{
+		"Secret": "magickey", "Secret.2": "otherkey", "Issuer": "https://issuer.example",
+		"Audience": "data-receiver,other", "RequiredClaims": "sub,tenant", "Leeway": "1s",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"sub": "producer-1", "tenant": "acme", "iss": "https://issuer.example", "aud": []string{"data-receiver"},
+		"exp": now + 60, "nbf": now - 60,
+	}
+	p, err := a.Authenticate(bearerRequest(jwtSign(t, map[string]interface{}{"alg": "HS256"}, claims, hs256("magickey"))))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if p.ID != "producer-1" || p.Claims["tenant"] != "acme" {
+		t.Log(fmt.Sprintf("Unexpected principal: %v", p))
+		t.FailNow()
+	}
+
+	// The kid selects the secret.
+	_, err = a.Authenticate(bearerRequest(jwtSign(t, map[string]interface{}{"alg": "HS256", "kid": "2"}, claims, hs256("otherkey"))))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// with returns the claims with the value of one claim changed, or removed when it's nil.
+	with := func(name string, value interface{}) map[string]interface{} {
+		c := make(map[string]interface{}, len(claims))
+		for k, v := range claims {
+			c[k] = v
+		}
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+	invalid := map[string]string{
+		"wrong secret": jwtSign(t, map[string]interface{}{"alg": "HS256"}, claims, hs256("wrongkey")),
+		"wrong kid":    jwtSign(t, map[string]interface{}{"alg": "HS256", "kid": "2"}, claims, hs256("magickey")),
+		"alg none":     jwtSign(t, map[string]interface{}{"alg": "none"}, claims, func([]byte) []byte { return nil }),
+		"alg RS256":    jwtSign(t, map[string]interface{}{"alg": "RS256"}, claims, hs256("magickey")),
+		"expired":      jwtSign(t, map[string]interface{}{"alg": "HS256"}, with("exp", now-10), hs256("magickey")),
+		"not before":   jwtSign(t, map[string]interface{}{"alg": "HS256"}, with("nbf", now+10), hs256("magickey")),
+		"issuer":       jwtSign(t, map[string]interface{}{"alg": "HS256"}, with("iss", "https://other.example"), hs256("magickey")),
+		"audience":     jwtSign(t, map[string]interface{}{"alg": "HS256"}, with("aud", "someone-else"), hs256("magickey")),
+		"required":     jwtSign(t, map[string]interface{}{"alg": "HS256"}, with("tenant", nil), hs256("magickey")),
+		"no exp":       jwtSign(t, map[string]interface{}{"alg": "HS256"}, with("exp", nil), hs256("magickey")),
+		"malformed":    "not-a-token",
+	}
+	for name, token := range invalid {
+		_, err = a.Authenticate(bearerRequest(token))
+		if err == nil {
+			t.Error(fmt.Sprintf("Expected error for token: %s", name))
+			t.FailNow()
+		}
+	}
+
+	_, err = a.Authenticate(&authenticator.Request{Headers: http.Header{}})
+	if err == nil {
+		t.Error("Expected error without Authorization header.")
+		t.FailNow()
+	}
+}
+
+func TestJWTAuthenticator_AllowNoExp(t *testing.T) {
+	a, err := authenticator.NewJWTAuthenticator(map[string]string{"Secret": "magickey", "AllowNoExp": "true"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	now := time.Now().Unix()
+	_, err = a.Authenticate(bearerRequest(jwtSign(t, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": "producer-1"}, hs256("magickey"))))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// exp is still checked when the token has it.
+	_, err = a.Authenticate(bearerRequest(jwtSign(t, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": "producer-1", "exp": now - 120}, hs256("magickey"))))
+	if err == nil {
+		t.Error("Expected error for an expired token.")
+		t.FailNow()
+	}
+}
+
+func TestJWTAuthenticator_SmallRSAKey(t *testing.T) {
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	rsaJWK := func(kid string, k *rsa.PrivateKey) map[string]string {
+		return map[string]string{"kty": "RSA", "kid": kid, "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	}
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS := func(keys ...map[string]string) {
+		b, err := json.Marshal(map[string]interface{}{"keys": keys})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		writeCredentials(t, path, string(b), time.Now())
+	}
+	signRSA := func(k *rsa.PrivateKey) func([]byte) []byte {
+		return func(b []byte) []byte {
+			digest := sha256.Sum256(b)
+			sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+			if err != nil {
+				t.Error(err)
+				t.FailNow()
+			}
+			return sig
+		}
+	}
+
+	// Without any other key, the file can't be used.
+	writeJWKS(rsaJWK("small", smallKey))
+	_, err = authenticator.NewJWTAuthenticator(map[string]string{"JWKSFile": path})
+	if err == nil {
+		t.Error("Expected error for a JWKS file with a 1024 bits RSA key only.")
+		t.FailNow()
+	}
+
+	// The weak and invalid keys are skipped, the others are loaded.
+	writeJWKS(rsaJWK("small", smallKey), map[string]string{"kty": "RSA", "kid": "invalid", "n": "!", "e": "AQAB"}, rsaJWK("rsa", rsaKey))
+	a, err := authenticator.NewJWTAuthenticator(map[string]string{"JWKSFile": path})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	claims := map[string]interface{}{"sub": "producer-1", "exp": time.Now().Unix() + 60}
+	_, err = a.Authenticate(bearerRequest(jwtSign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims, signRSA(rsaKey))))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = a.Authenticate(bearerRequest(jwtSign(t, map[string]interface{}{"alg": "RS256", "kid": "small"}, claims, signRSA(smallKey))))
+	if err == nil {
+		t.Error("Expected error for a token signed with the 1024 bits RSA key.")
+		t.FailNow()
+	}
+}
+
+func TestJWTAuthenticator_JWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	rsaJWK := map[string]string{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())}
+	ecJWK := map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())}
+	edJWK := map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPublic)}
+
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS := func(keys []map[string]string, modTime time.Time) {
+		b, err := json.Marshal(map[string]interface{}{"keys": keys})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		writeCredentials(t, path, string(b), modTime)
+	}
+	writeJWKS([]map[string]string{rsaJWK, ecJWK, {"kty": "oct", "kid": "skipped", "k": "c2VjcmV0"}}, time.Now().Add(-time.Hour))
+
+	a, err := authenticator.NewJWTAuthenticator(map[string]string{"JWKSFile": path, "ReloadInterval": "1ns", "PrincipalClaim": "client_id"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	claims := map[string]interface{}{"client_id": "producer-1", "exp": time.Now().Unix() + 60}
+	signRSA := func(b []byte) []byte {
+		digest := sha256.Sum256(b)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		return sig
+	}
+	signEC := func(b []byte) []byte {
+		digest := sha256.Sum256(b)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		// r and s are padded to 32 bytes each.
+		sig := make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+		return sig
+	}
+	signEd := func(b []byte) []byte { return ed25519.Sign(edKey, b) }
+
+	for _, token := range []string{
+		jwtSign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims, signRSA),
+		jwtSign(t, map[string]interface{}{"alg": "RS256"}, claims, signRSA),
+		jwtSign(t, map[string]interface{}{"alg": "ES256", "kid": "ec"}, claims, signEC),
+	} {
+		p, err := a.Authenticate(bearerRequest(token))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if p.ID != "producer-1" {
+			t.Log(fmt.Sprintf("Expected principal: %q, received: %v", "producer-1", p))
+			t.FailNow()
+		}
+	}
+
+	for _, token := range []string{
+		jwtSign(t, map[string]interface{}{"alg": "RS256", "kid": "ec"}, claims, signRSA),
+		jwtSign(t, map[string]interface{}{"alg": "ES256"}, claims, signRSA),
+		jwtSign(t, map[string]interface{}{"alg": "EdDSA", "kid": "ed"}, claims, signEd),
+		// A public key can't be used as an HMAC secret.
+		jwtSign(t, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, claims, hs256(string(rsaKey.N.Bytes()))),
+	} {
+		_, err = a.Authenticate(bearerRequest(token))
+		if err == nil {
+			t.Error(fmt.Sprintf("Expected error for token: %s", token))
+			t.FailNow()
+		}
+	}
+
+	// The Ed25519 key is added to the file, and the RSA key removed.
+	writeJWKS([]map[string]string{ecJWK, edJWK}, time.Now())
+	_, err = a.Authenticate(bearerRequest(jwtSign(t, map[string]interface{}{"alg": "EdDSA", "kid": "ed"}, claims, signEd)))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = a.Authenticate(bearerRequest(jwtSign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims, signRSA)))
+	if err == nil {
+		t.Error("Expected error for a removed key.")
+		t.FailNow()
+	}
+}
+
+func TestNewJWTAuthenticator_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{},
+		{"Issuer": "https://issuer.example"},
+		{"Secret": ""},
+		{"Secret": "magickey", "Leeway": "soon"},
+		{"Secret": "magickey", "AllowNoExp": "maybe"},
+		{"JWKSFile": "/missing/jwks.json"},
+	}
+	for _, params := range tests {
+		_, err := authenticator.NewJWTAuthenticator(params)
+		if err == nil {
+			t.Error(fmt.Sprintf("Expected error for parameters: %v", params))
+			t.FailNow()
+		}
+	}
+}
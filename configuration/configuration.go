@@ -54,15 +54,40 @@ func (c *ServiceMap) Get(name string) (*ServiceConfig, error) {
 }
 
 // ServiceConfig has the necessary fields to store the configuration of each service.
+// A service can have one writer in WriConfig, a list of writers in WriConfigs, or both.
+// WriteTimeout is optional, it's a duration like "5s" that limits how long a request waits for the writers.
 type ServiceConfig struct {
-	ExtConfig  *SimpleConfig `json:"extractor" yaml:"extractor"`
-	AuthConfig *SimpleConfig `json:"authenticator" yaml:"authenticator"`
-	WriConfig  *SimpleConfig `json:"writer" yaml:"writer"`
+	ExtConfig    *SimpleConfig   `json:"extractor" yaml:"extractor"`
+	AuthConfig   *SimpleConfig   `json:"authenticator" yaml:"authenticator"`
+	WriConfig    *SimpleConfig   `json:"writer,omitempty" yaml:"writer,omitempty"`
+	WriConfigs   []*WriterConfig `json:"writers,omitempty" yaml:"writers,omitempty"`
+	WriteTimeout string          `json:"write_timeout,omitempty" yaml:"write_timeout,omitempty"`
 }
 
 // NewServiceConfig generates the config for a service based on the Config for each module.
 func NewServiceConfig(ext, auth, w *SimpleConfig) *ServiceConfig {
-	return &ServiceConfig{ext, auth, w}
+	return &ServiceConfig{ExtConfig: ext, AuthConfig: auth, WriConfig: w}
+}
+
+// Writers returns the config of all the writers of the service, the one in WriConfig goes first and is required.
+func (s *ServiceConfig) Writers() []*WriterConfig {
+	writers := make([]*WriterConfig, 0, len(s.WriConfigs)+1)
+	if s.WriConfig != nil {
+		writers = append(writers, &WriterConfig{SimpleConfig: *s.WriConfig, Policy: PolicyRequired})
+	}
+	return append(writers, s.WriConfigs...)
+}
+
+// Policies for the writers of a service, they define if a failed write fails the request.
+const (
+	PolicyRequired   = "required"
+	PolicyBestEffort = "best_effort"
+)
+
+// WriterConfig is the config of one of the writers in a list, Policy is PolicyRequired (the default) or PolicyBestEffort.
+type WriterConfig struct {
+	SimpleConfig `yaml:",inline"`
+	Policy       string `json:"policy,omitempty" yaml:"policy,omitempty"`
 }
 
 // SimpleConfig is a basic config that has a Class field to define the type of module (ie, MemoryWriter for Writer or HeaderExtractor for Header),
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/efark/data-receiver/configuration"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -283,3 +284,87 @@ func TestYamlFileParser(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestYamlFileParser_Writers(t *testing.T) {
+	content := `services:
+  test_service:
+    extractor:
+      type: HeaderExtractor
+    authenticator:
+      type: Signer
+    writer:
+      type: MemoryWriter
+    writers:
+      - type: FileWriter
+        parameters:
+          filepath: /data/test.jsonl
+      - type: ConsoleWriter
+        policy: best_effort`
+
+	f := strings.Join([]string{baseFilepath, "writers", "yaml"}, ".")
+	err := ioutil.WriteFile(f, []byte(content), 0644)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	defer os.Remove(f)
+
+	conf := configuration.NewServiceMap()
+	err = configuration.CreateParser(f, "").Parse(conf)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	serv, err := conf.Get("test_service")
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	writers := serv.Writers()
+	if len(writers) != 3 {
+		t.Error(fmt.Sprintf("Error: Expected len(writers) == %d, obtained %d.", 3, len(writers)))
+		t.FailNow()
+	}
+
+	expected := []struct{ class, policy string }{
+		{"MemoryWriter", configuration.PolicyRequired},
+		{"FileWriter", ""},
+		{"ConsoleWriter", configuration.PolicyBestEffort},
+	}
+	for i, e := range expected {
+		if writers[i].Class != e.class || writers[i].Policy != e.policy {
+			t.Error(fmt.Sprintf("Error: Expected writers[%d] == %s/%q, obtained %s/%q.", i, e.class, e.policy, writers[i].Class, writers[i].Policy))
+			t.FailNow()
+		}
+	}
+
+	if writers[1].Parameters["filepath"] != "/data/test.jsonl" {
+		t.Error(fmt.Sprintf("Error: Expected writers[1].Parameters['filepath'] == %s, obtained %s.", "/data/test.jsonl", writers[1].Parameters["filepath"]))
+		t.FailNow()
+	}
+}
+
+func TestJsonRecordParser_Writers(t *testing.T) {
+	content := `{"services": {"test_service": {"writers": [{"type": "MemoryWriter", "policy": "best_effort", "parameters": {"format": "json"}}]}}}`
+
+	conf := configuration.NewServiceMap()
+	err := configuration.CreateParser("", content).Parse(conf)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	serv, err := conf.Get("test_service")
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	writers := serv.Writers()
+	if len(writers) != 1 || writers[0].Class != "MemoryWriter" || writers[0].Policy != configuration.PolicyBestEffort || writers[0].Parameters["format"] != "json" {
+		t.Error(fmt.Sprintf("Error: Unexpected writers: %+v.", writers))
+		t.FailNow()
+	}
+}
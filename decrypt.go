@@ -0,0 +1,95 @@
+/*
+This file has the decrypt command, it decrypts the files written by a writer with encrypt_key_file.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"io"
+	"os"
+	"strings"
+)
+
+// maxDecryptLine is the longest line the decrypt command reads.
+const maxDecryptLine = 16 * 1024 * 1024
+
+// runDecrypt parses the flags of the decrypt command and writes the decrypted messages of the files, or of the
+// standard input, to the standard output.
+// Usage: data-receiver decrypt -key-file keys.txt [-format json] /data/my_service.jsonl
+func runDecrypt(args []string) error {
+	var keyFile, format string
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	fs.StringVar(&keyFile, "key-file", "", "Key file used by the writer.")
+	fs.StringVar(&format, "format", writer.FormatRaw, "Output format: raw writes the bodies, json the whole messages.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if keyFile == "" {
+		return errors.New("Required key file.")
+	}
+	if format != writer.FormatRaw && format != writer.FormatJSON {
+		return fmt.Errorf("Format %q not supported.", format)
+	}
+	keys, err := writer.LoadEncryptionKeys(keyFile)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if fs.NArg() == 0 {
+		return decryptLines(os.Stdin, "stdin", keys, format, out)
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = decryptLines(f, path, keys, format, out)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptLines decrypts every line of r. Lines can be the encrypted body, from the raw format,
+// or a Json message with the encrypted body, from the json format.
+func decryptLines(r io.Reader, name string, keys *writer.EncryptionKeys, format string, out io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxDecryptLine)
+	for line := 1; scanner.Scan(); line++ {
+		token := strings.TrimSpace(scanner.Text())
+		if token == "" {
+			continue
+		}
+		if strings.HasPrefix(token, "{") {
+			var m writer.Message
+			err := json.Unmarshal([]byte(token), &m)
+			if err != nil {
+				return fmt.Errorf("Line %d of %s: %v", line, name, err)
+			}
+			token = m.Body
+		}
+		msg, err := keys.Decrypt(token)
+		if err != nil {
+			return fmt.Errorf("Line %d of %s: %v", line, name, err)
+		}
+		content, err := msg.Format(format)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, strings.TrimSuffix(content, "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
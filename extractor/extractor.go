@@ -15,6 +15,13 @@ type Extractor interface {
 	Validate(m map[string]string) error
 }
 
+// HeaderSource can be implemented by the extractors that take the values from the request headers,
+// so the headers holding credentials can be found without looking at their values.
+type HeaderSource interface {
+	// Header returns the name of the header the key is extracted from.
+	Header(key string) (string, bool)
+}
+
 // CreateExtractor has a switch to create the right extractor.
 func CreateExtractor(class string, params map[string]string) (Extractor, error) {
 	var ext Extractor
@@ -76,6 +83,12 @@ func (h HeaderExtractor) Extract(c *gin.Context) map[string]string {
 	return m
 }
 
+// Header returns the name of the header configured for the key.
+func (h HeaderExtractor) Header(key string) (string, bool) {
+	name, ok := h.config[key]
+	return name, ok
+}
+
 // Validate checks that the values are not empty strings.
 func (h HeaderExtractor) Validate(m map[string]string) error {
 	for k, v := range m {
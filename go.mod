@@ -3,7 +3,11 @@ module github.com/efark/data-receiver
 go 1.14
 
 require (
+	github.com/Shopify/sarama v1.29.1
 	github.com/gin-gonic/gin v1.6.3
+	github.com/klauspost/compress v1.13.1
+	github.com/lib/pq v1.10.9
+	github.com/xitongsys/parquet-go v1.6.2
 	go.uber.org/zap v1.15.0
 	gopkg.in/yaml.v2 v2.2.8
 )
@@ -10,6 +10,8 @@ import (
 	"flag"
 	"fmt"
 	"github.com/efark/data-receiver/webserver"
+	// Database drivers available to the SQLWriter.
+	_ "github.com/lib/pq"
 	"net/http"
 	"os"
 	"os/signal"
@@ -19,6 +21,23 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := runReplay(os.Args[2:])
+		if err != nil {
+			slog.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		err := runDecrypt(os.Args[2:])
+		if err != nil {
+			slog.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Info("Starting webserver.")
 
 	var cfgFilepath, cfgInline string
@@ -0,0 +1,63 @@
+/*
+This file has the replay command, it writes the messages of a dead-letter file back through the writer that failed them.
+The server using the dead-letter file has to be stopped first.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/efark/data-receiver/configuration"
+	"github.com/efark/data-receiver/writer"
+)
+
+// runReplay parses the flags of the replay command and replays the file.
+// Usage: data-receiver replay -config config.yaml -service my_service -file /var/spool/dlq/my_service.jsonl
+func runReplay(args []string) error {
+	var cfgFilepath, cfgInline, service, dlqPath string
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.StringVar(&cfgFilepath, "config", "", "Configuration file path (json or yaml).")
+	fs.StringVar(&cfgInline, "inline-config", "", "Inline Json Configuration.")
+	fs.StringVar(&service, "service", "", "Service whose writer failed the messages.")
+	fs.StringVar(&dlqPath, "file", "", "Dead-letter file, it must be the dlq_path of one of the service's writers.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if cfgFilepath == "" && cfgInline == "" {
+		return errors.New("Required configuration filepath or inline configuration.")
+	}
+	if service == "" || dlqPath == "" {
+		return errors.New("Required service and file.")
+	}
+
+	conf := configuration.NewServiceMap()
+	err = configuration.CreateParser(cfgFilepath, cfgInline).Parse(conf)
+	if err != nil {
+		return err
+	}
+	serv, err := conf.Get(service)
+	if err != nil {
+		return err
+	}
+	var wc *configuration.WriterConfig
+	for _, c := range serv.Writers() {
+		if c.Parameters["dlq_path"] == dlqPath {
+			wc = c
+			break
+		}
+	}
+	if wc == nil {
+		return fmt.Errorf("No writer of service %q has dlq_path %q.", service, dlqPath)
+	}
+
+	// The writer is created without its wrappers and the file is locked, so the server must be stopped.
+	n, err := writer.ReplayDeadLetters(context.Background(), wc.Class, wc.Parameters)
+	log.Info(fmt.Sprintf("Replayed %d messages from %q.", n, dlqPath))
+	if err != nil {
+		return fmt.Errorf("Replay stopped after the first %d messages of %q, the rest are still in the file: %v", n, dlqPath, err)
+	}
+	return nil
+}
@@ -1,11 +1,27 @@
 package webserver
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/efark/data-receiver/authenticator"
+	"github.com/efark/data-receiver/extractor"
+	"github.com/efark/data-receiver/writer"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// sensitiveHeaders are left out of the messages, so credentials don't end up written with the data.
+var sensitiveHeaders = map[string]bool{"Authorization": true, "Proxy-Authorization": true, "Cookie": true}
+
+// credentialValues are the extracted values that authenticators use as credentials, like the token of the
+// CredentialsAuthenticator. They're removed from the messages after the authentication, with the headers they're extracted from.
+var credentialValues = []string{"token"}
+
 // HealthHandler returns Ok for all the requests.
 func HealthHandler(c *gin.Context) {
 	c.Status(http.StatusOK)
@@ -14,6 +30,7 @@ func HealthHandler(c *gin.Context) {
 
 // DataHandler has the logic to process the data requests.
 func DataHandler(c *gin.Context) {
+	receivedAt := time.Now()
 	service, ok := services[c.Param("service")]
 	if !ok {
 		err := fmt.Errorf("Service %q not found.", c.Param("service"))
@@ -37,20 +54,107 @@ func DataHandler(c *gin.Context) {
 		return
 	}
 
-	err = service.auth.Authenticate(body, extract["signature"])
+	principal, err := service.auth.Authenticate(authenticator.NewRequest(c.Request, body, c.ClientIP(), extract))
 	if err != nil {
 		slog.Error(err.Error())
-		c.JSON(http.StatusUnauthorized, gin.H{"Error": err.Error()})
+		c.JSON(authErrorStatus(err), gin.H{"Error": err.Error()})
 		return
 	}
 
-	err = service.w.Write(string(body))
+	msg := writer.Message{
+		Service:    c.Param("service"),
+		ReceivedAt: receivedAt,
+		RemoteIP:   c.ClientIP(),
+		RequestID:  requestID(c),
+		Headers:    headers(c.Request.Header),
+		Extracted:  extract,
+		Body:       string(body),
+	}
+	removeCredentials(msg, service.ext)
+	if !principal.IsZero() {
+		msg.Principal = &principal
+	}
+	// The request's context is done when the client disconnects, the write timeout is added on top of it.
+	ctx := c.Request.Context()
+	if service.writeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, service.writeTimeout)
+		defer cancel()
+	}
+
+	err = service.w.Write(ctx, msg)
 	if err != nil {
 		slog.Error(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+		c.JSON(writeErrorStatus(err), gin.H{"Error": err.Error()})
 		return
 	}
 
 	c.Status(http.StatusOK)
 	return
 }
+
+// requestID returns the X-Request-Id header, or a random id when the client didn't send one.
+func requestID(c *gin.Context) string {
+	if id := c.GetHeader("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		slog.Error(err.Error())
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// headers flattens the request headers into a map, joining repeated values with commas.
+func headers(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, v := range h {
+		if sensitiveHeaders[k] {
+			continue
+		}
+		m[k] = strings.Join(v, ",")
+	}
+	return m
+}
+
+// removeCredentials deletes the credentialValues from the extracted values of the message, and the headers that the
+// extractor maps to them. The other headers are kept even if they happen to contain the same value.
+func removeCredentials(msg writer.Message, ext extractor.Extractor) {
+	source, _ := ext.(extractor.HeaderSource)
+	for _, name := range credentialValues {
+		if _, ok := msg.Extracted[name]; !ok {
+			continue
+		}
+		delete(msg.Extracted, name)
+		if source == nil {
+			continue
+		}
+		if header, ok := source.Header(name); ok {
+			delete(msg.Headers, http.CanonicalHeaderKey(header))
+		}
+	}
+}
+
+// authErrorStatus returns 503 when the request couldn't be checked because the replay cache is full, so the sender
+// can retry it later, and 401 for any other error.
+func authErrorStatus(err error) int {
+	if errors.Is(err, authenticator.ErrReplayCacheFull) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnauthorized
+}
+
+// writeErrorStatus returns 504 when the write timed out, 503 when it was cancelled or the writer queue is full
+// and 500 for any other error.
+func writeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, writer.ErrQueueFull):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -5,16 +5,23 @@ package webserver_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"github.com/efark/data-receiver/authenticator"
 	"github.com/efark/data-receiver/extractor"
 	"github.com/efark/data-receiver/webserver"
 	"github.com/efark/data-receiver/writer"
 	"github.com/gin-gonic/gin"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	net_url "net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -29,13 +36,13 @@ func TestDataHandler(t *testing.T) {
 		t.FailNow()
 	}
 
-	destroy := setupTest(t, mw)
+	destroy := setupTest(t, mw, 0)
 	defer destroy()
 
 	method := http.MethodPost
 	url := "localhost:8080"
 	body := []byte(`test message`)
-	urlParams := []gin.Param{{"service", "test"}}
+	urlParams := []gin.Param{{Key: "service", Value: "test"}}
 	queryParams := net_url.Values{}
 	headers := map[string]string{"x-user-id": "test_id", "x-signature": "GXjQXzGexUuSH444qEyMI-b9Lif_Uq39gElhs_7PMVY="}
 
@@ -56,14 +63,238 @@ func TestDataHandler(t *testing.T) {
 	}
 
 	message := messages[0]
-	if message != "test message" {
+	if message.Body != "test message" {
 		t.Error("message content error.")
 		t.FailNow()
 	}
+
+	if message.Service != "test" || message.Extracted["signature"] != headers["x-signature"] || message.Headers["X-User-Id"] != "test_id" {
+		t.Error(fmt.Sprintf("message metadata error: %+v", message))
+		t.FailNow()
+	}
+
+	if message.ReceivedAt.IsZero() || message.RequestID == "" {
+		t.Error(fmt.Sprintf("message metadata error: %+v", message))
+		t.FailNow()
+	}
+}
+
+// blockingWriter never finishes a write, it only returns when the context is done.
+type blockingWriter struct{}
+
+func (w blockingWriter) Write(ctx context.Context, _ writer.Message) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (w blockingWriter) Close() {}
+
+func TestDataHandler_WriteTimeout(t *testing.T) {
+	destroy := setupTest(t, blockingWriter{}, 10*time.Millisecond)
+	defer destroy()
+
+	body := []byte(`test message`)
+	urlParams := []gin.Param{{Key: "service", Value: "test"}}
+	headers := map[string]string{"x-signature": "GXjQXzGexUuSH444qEyMI-b9Lif_Uq39gElhs_7PMVY="}
+
+	c, record := createGinContext(http.MethodPost, "localhost:8080", body, urlParams, net_url.Values{}, headers)
+
+	webserver.DataHandler(c)
+
+	if record.Result().StatusCode != http.StatusGatewayTimeout {
+		t.Error(fmt.Sprintf("Status code: %v\n", record.Result().StatusCode))
+		t.FailNow()
+	}
+}
+
+// fullWriter answers every write with writer.ErrQueueFull.
+type fullWriter struct{}
+
+func (w fullWriter) Write(_ context.Context, _ writer.Message) error {
+	return writer.ErrQueueFull
+}
+
+func (w fullWriter) Close() {}
+
+func TestDataHandler_QueueFull(t *testing.T) {
+	destroy := setupTest(t, fullWriter{}, 0)
+	defer destroy()
+
+	body := []byte(`test message`)
+	urlParams := []gin.Param{{Key: "service", Value: "test"}}
+	headers := map[string]string{"x-signature": "GXjQXzGexUuSH444qEyMI-b9Lif_Uq39gElhs_7PMVY="}
+
+	c, record := createGinContext(http.MethodPost, "localhost:8080", body, urlParams, net_url.Values{}, headers)
+
+	webserver.DataHandler(c)
+
+	if record.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Error(fmt.Sprintf("Status code: %v\n", record.Result().StatusCode))
+		t.FailNow()
+	}
+}
+
+// userAuthenticator accepts POST requests and returns the X-User-Id header as the principal.
+type userAuthenticator struct{}
+
+func (a userAuthenticator) Authenticate(req *authenticator.Request) (authenticator.Principal, error) {
+	if req.Method != http.MethodPost || req.Headers.Get("X-User-Id") == "" {
+		return authenticator.Principal{}, fmt.Errorf("Request %v %v not allowed.", req.Method, req.Path)
+	}
+	return authenticator.Principal{ID: req.Headers.Get("X-User-Id")}, nil
+}
+
+func TestDataHandler_Principal(t *testing.T) {
+	mw, err := writer.NewMemoryWriter()
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	ext, err := extractor.NewEmptyExtractor(nil)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	webserver.SetService("test", ext, userAuthenticator{}, mw, 0)
+	defer webserver.CloseWriters()
+
+	body := []byte(`test message`)
+	urlParams := []gin.Param{{Key: "service", Value: "test"}}
+	headers := map[string]string{"x-user-id": "test_id"}
+
+	c, record := createGinContext(http.MethodPost, "localhost:8080", body, urlParams, net_url.Values{}, headers)
+	webserver.DataHandler(c)
+	if record.Result().StatusCode != http.StatusOK {
+		t.Error(fmt.Sprintf("Status code: %v\n", record.Result().StatusCode))
+		t.FailNow()
+	}
+	messages := mw.GetMessages()
+	if len(messages) != 1 || messages[0].Principal == nil || messages[0].Principal.ID != "test_id" {
+		t.Error(fmt.Sprintf("Expected principal: %q, received: %+v", "test_id", messages))
+		t.FailNow()
+	}
+
+	c, record = createGinContext(http.MethodPost, "localhost:8080", body, urlParams, net_url.Values{}, nil)
+	webserver.DataHandler(c)
+	if record.Result().StatusCode != http.StatusUnauthorized {
+		t.Error(fmt.Sprintf("Status code: %v\n", record.Result().StatusCode))
+		t.FailNow()
+	}
+}
+
+// busyAuthenticator answers every request as if the replay cache of its sender was full.
+type busyAuthenticator struct{}
+
+func (a busyAuthenticator) Authenticate(req *authenticator.Request) (authenticator.Principal, error) {
+	return authenticator.Principal{}, fmt.Errorf("Client %q: %w", req.RemoteIP, authenticator.ErrReplayCacheFull)
+}
+
+func TestDataHandler_ReplayCacheFull(t *testing.T) {
+	mw, err := writer.NewMemoryWriter()
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	ext, err := extractor.NewEmptyExtractor(nil)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	webserver.SetService("test", ext, busyAuthenticator{}, mw, 0)
+	defer webserver.CloseWriters()
+
+	urlParams := []gin.Param{{Key: "service", Value: "test"}}
+	c, record := createGinContext(http.MethodPost, "localhost:8080", []byte(`test message`), urlParams, net_url.Values{}, nil)
+	webserver.DataHandler(c)
+	if record.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Error(fmt.Sprintf("Status code: %v\n", record.Result().StatusCode))
+		t.FailNow()
+	}
+	if len(mw.GetMessages()) != 0 {
+		t.Error("Expected no messages.")
+		t.FailNow()
+	}
+}
+
+func TestDataHandler_TokenNotWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	token := "partnerToken"
+	sum := sha256.Sum256([]byte(token))
+	path := filepath.Join(dir, "clients.yaml")
+	err = ioutil.WriteFile(path, []byte(fmt.Sprintf("clients:\n  partner-b:\n    token_sha256: %x\n", sum)), 0600)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	ext, err := extractor.NewHeaderExtractor(map[string]string{"client_id": "x-client-id", "token": "x-api-key"})
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	auth, err := authenticator.NewCredentialsAuthenticator(map[string]string{"CredentialsFile": path})
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	mw, err := writer.NewMemoryWriter()
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	webserver.SetService("test", ext, auth, mw, 0)
+	defer webserver.CloseWriters()
+
+	urlParams := []gin.Param{{Key: "service", Value: "test"}}
+	headers := map[string]string{"x-client-id": "partner-b", "x-api-key": token}
+	c, record := createGinContext(http.MethodPost, "localhost:8080", []byte(`test message`), urlParams, net_url.Values{}, headers)
+	webserver.DataHandler(c)
+	if record.Result().StatusCode != http.StatusOK {
+		t.Error(fmt.Sprintf("Status code: %v\n", record.Result().StatusCode))
+		t.FailNow()
+	}
+
+	messages := mw.GetMessages()
+	if len(messages) != 1 || messages[0].Principal == nil || messages[0].Principal.ID != "partner-b" {
+		t.Error(fmt.Sprintf("Expected principal: %q, received: %+v", "partner-b", messages))
+		t.FailNow()
+	}
+	content, err := messages[0].Format(writer.FormatJSON)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	if strings.Contains(content, token) || messages[0].Extracted["client_id"] != "partner-b" {
+		t.Error(fmt.Sprintf("Expected message without the token, received: %s", content))
+		t.FailNow()
+	}
+
+	// Only the header the token is extracted from is removed, not the ones that contain the same text.
+	headers["x-trace-id"] = "trace-" + token
+	c, record = createGinContext(http.MethodPost, "localhost:8080", []byte(`test message`), urlParams, net_url.Values{}, headers)
+	webserver.DataHandler(c)
+	if record.Result().StatusCode != http.StatusOK {
+		t.Error(fmt.Sprintf("Status code: %v\n", record.Result().StatusCode))
+		t.FailNow()
+	}
+	messages = mw.GetMessages()
+	if len(messages) != 2 {
+		t.Error(fmt.Sprintf("Expected 2 messages, received: %+v", messages))
+		t.FailNow()
+	}
+	if _, ok := messages[1].Headers["X-Api-Key"]; ok || messages[1].Headers["X-Trace-Id"] != "trace-"+token {
+		t.Error(fmt.Sprintf("Expected only X-Api-Key removed, received: %v", messages[1].Headers))
+		t.FailNow()
+	}
 }
 
 //key []byte, hasher func() hash.Hash, encrypter func([]byte) string
-func setupTest(t *testing.T, w writer.Writer) func() {
+func setupTest(t *testing.T, w writer.Writer, writeTimeout time.Duration) func() {
 	t.Log("Setting up test service.")
 
 	extConfig := map[string]string{"signature": "x-signature"}
@@ -75,9 +306,12 @@ func setupTest(t *testing.T, w writer.Writer) func() {
 
 	authConfig := map[string]string{"Key": "magicKey", "Hasher": "sha256", "Encrypter": "base64.URL"}
 	auth, err := authenticator.NewSigner(authConfig)
-	w = mw
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
 
-	webserver.SetService("test", ext, auth, w)
+	webserver.SetService("test", ext, auth, w, writeTimeout)
 	return func() {
 		t.Log("Closing service.")
 		webserver.CloseWriters()
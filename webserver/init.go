@@ -4,12 +4,14 @@ Package webserver has the logic to process the requests.
 package webserver
 
 import (
+	"errors"
 	"fmt"
 	"github.com/efark/data-receiver/authenticator"
 	"github.com/efark/data-receiver/configuration"
 	"github.com/efark/data-receiver/extractor"
 	"github.com/efark/data-receiver/logger"
 	"github.com/efark/data-receiver/writer"
+	"time"
 )
 
 var (
@@ -18,9 +20,10 @@ var (
 )
 
 type service struct {
-	ext  extractor.Extractor
-	auth authenticator.Authenticator
-	w    writer.Writer
+	ext          extractor.Extractor
+	auth         authenticator.Authenticator
+	w            writer.Writer
+	writeTimeout time.Duration
 }
 
 // Initialize reads and parses the configuration and stores it in memory.
@@ -56,19 +59,61 @@ func Initialize(filepath, cfgInline string) error {
 			continue
 		}
 
-		newWriter, err := writer.CreateWriter(serv.WriConfig.Class, serv.WriConfig.Parameters)
+		var writeTimeout time.Duration
+		if serv.WriteTimeout != "" {
+			writeTimeout, err = time.ParseDuration(serv.WriteTimeout)
+			if err != nil {
+				slog.Error(err)
+				log.Info(fmt.Sprintf("Write timeout for service %q couldn't be parsed.", s))
+				continue
+			}
+		}
+
+		newWriter, err := createWriters(serv.Writers(), writeTimeout)
 		if err != nil {
 			slog.Error(err)
 			log.Info(fmt.Sprintf("Writer for service %q couldn't be created.", s))
 			continue
 		}
-		SetService(s, newExt, newAuth, newWriter)
+		SetService(s, newExt, newAuth, newWriter, writeTimeout)
 	}
 
 	//log.Info(fmt.Sprintf("%+v\n", services))
 	return nil
 }
 
+// createWriters creates the writers of a service. When there's more than one, they're grouped in a MultiWriter,
+// whose best effort writes get the service's write timeout.
+func createWriters(configs []*configuration.WriterConfig, writeTimeout time.Duration) (writer.Writer, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("No writers configured.")
+	}
+
+	multi := writer.NewMultiWriterWithTimeout(writeTimeout)
+	for _, c := range configs {
+		var required bool
+		switch c.Policy {
+		case "", configuration.PolicyRequired:
+			required = true
+		case configuration.PolicyBestEffort:
+		default:
+			multi.Close()
+			return nil, fmt.Errorf("Invalid writer policy %q.", c.Policy)
+		}
+
+		w, err := writer.CreateWriter(c.Class, c.Parameters)
+		if err != nil {
+			multi.Close()
+			return nil, err
+		}
+		if len(configs) == 1 && required {
+			return w, nil
+		}
+		multi.Add(w, required)
+	}
+	return multi, nil
+}
+
 // CloseWriters close all the writers for a graceful shutdown.
 func CloseWriters() {
 	for k, v := range services {
@@ -79,6 +124,7 @@ func CloseWriters() {
 }
 
 // SetService creates a service with the received name, extractor, authenticator and writer.
-func SetService(key string, ext extractor.Extractor, auth authenticator.Authenticator, writer writer.Writer) {
-	services[key] = &service{ext: ext, auth: auth, w: writer}
+// When writeTimeout is greater than zero, writes taking longer than that are cancelled.
+func SetService(key string, ext extractor.Extractor, auth authenticator.Authenticator, writer writer.Writer, writeTimeout time.Duration) {
+	services[key] = &service{ext: ext, auth: auth, w: writer, writeTimeout: writeTimeout}
 }
@@ -0,0 +1,38 @@
+package webserver_test
+
+import (
+	"fmt"
+	"github.com/efark/data-receiver/webserver"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	net_url "net/url"
+	"testing"
+)
+
+func TestInitialize_Writers(t *testing.T) {
+	config := `{"services": {
+		"fanout": {"extractor": {"type": ""}, "authenticator": {"type": ""},
+			"writers": [{"type": "ConsoleWriter"}, {"type": "MemoryWriter", "policy": "best_effort"}]},
+		"invalid": {"extractor": {"type": ""}, "authenticator": {"type": ""},
+			"writers": [{"type": "ConsoleWriter", "policy": "sometimes"}]}}}`
+
+	err := webserver.Initialize("", config)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	defer webserver.CloseWriters()
+
+	expected := map[string]int{"fanout": http.StatusOK, "invalid": http.StatusNotFound}
+	for service, status := range expected {
+		urlParams := []gin.Param{{Key: "service", Value: service}}
+		c, record := createGinContext(http.MethodPost, "localhost:8080", []byte(`test message`), urlParams, net_url.Values{}, nil)
+
+		webserver.DataHandler(c)
+
+		if record.Result().StatusCode != status {
+			t.Error(fmt.Sprintf("Service %q - expected status code: %v, received: %v\n", service, status, record.Result().StatusCode))
+			t.FailNow()
+		}
+	}
+}
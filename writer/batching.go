@@ -0,0 +1,222 @@
+/*
+This file has the BatchingWriter, a wrapper that groups messages before sending them to another writer.
+*/
+package writer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default values for the batching parameters, used when at least one of them is set.
+const (
+	defaultBatchSize     = 100
+	defaultBatchInterval = 100 * time.Millisecond
+)
+
+// BatchWriter is implemented by the writers that can write several messages in one call.
+type BatchWriter interface {
+	WriteBatch(ctx context.Context, msgs []Message) error
+}
+
+// BatchingOptions are the limits of a batch, it's flushed when it reaches any of them. Zero disables a limit.
+type BatchingOptions struct {
+	// MaxMessages is the number of messages in a batch.
+	MaxMessages int
+	// MaxBytes is the sum of the size of the bodies in a batch.
+	MaxBytes int
+	// Interval is the time since the first message of the batch was received.
+	Interval time.Duration
+}
+
+// hasBatchingParams returns true when any of the batching parameters was received.
+func hasBatchingParams(params map[string]string) bool {
+	for _, k := range []string{"batch_size", "batch_bytes", "batch_interval"} {
+		if _, ok := params[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBatchingOptions reads batch_size, batch_bytes and batch_interval from the parameters.
+// batch_size and batch_interval take their default values when they're missing, so a batch is always flushed.
+func parseBatchingOptions(params map[string]string) (BatchingOptions, error) {
+	opts := BatchingOptions{MaxMessages: defaultBatchSize, Interval: defaultBatchInterval}
+	var err error
+	if v, ok := params["batch_size"]; ok {
+		opts.MaxMessages, err = strconv.Atoi(v)
+		if err != nil || opts.MaxMessages < 0 {
+			return opts, fmt.Errorf("Invalid batch_size %q.", v)
+		}
+	}
+	if v, ok := params["batch_bytes"]; ok {
+		opts.MaxBytes, err = strconv.Atoi(v)
+		if err != nil || opts.MaxBytes < 0 {
+			return opts, fmt.Errorf("Invalid batch_bytes %q.", v)
+		}
+	}
+	if v, ok := params["batch_interval"]; ok {
+		opts.Interval, err = time.ParseDuration(v)
+		if err != nil || opts.Interval <= 0 {
+			return opts, fmt.Errorf("Invalid batch_interval %q.", v)
+		}
+	}
+	return opts, nil
+}
+
+// BatchingWriter groups the messages and writes them to the inner writer when the batch reaches
+// MaxMessages, MaxBytes or Interval, whichever comes first.
+// Write waits until its batch is flushed and returns the result of the flush, so errors still get to the request.
+type BatchingWriter struct {
+	w    Writer
+	opts BatchingOptions
+
+	mu     sync.Mutex
+	batch  *batch
+	closed bool
+	// flushing counts the batches taken for flushing, it's incremented holding mu so Close can wait for all of them.
+	flushing sync.WaitGroup
+	// flushMu keeps the batches in order, only one is written to the inner writer at a time.
+	flushMu sync.Mutex
+}
+
+// batch is a group of messages waiting to be flushed, done is closed after the flush and err has its result.
+// When the messages are written one by one, errs has the result of each of them instead.
+type batch struct {
+	msgs  []Message
+	size  int
+	timer *time.Timer
+	done  chan struct{}
+	err   error
+	errs  []error
+}
+
+// NewBatchingWriter wraps the writer, batches are sent with WriteBatch when the writer implements BatchWriter.
+func NewBatchingWriter(w Writer, opts BatchingOptions) *BatchingWriter {
+	return &BatchingWriter{w: w, opts: opts}
+}
+
+// Write adds the message to the current batch and waits until the batch is flushed or the context is done.
+func (b *BatchingWriter) Write(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	if b.batch == nil {
+		b.batch = b.newBatch()
+	}
+	current := b.batch
+	i := len(current.msgs)
+	current.msgs = append(current.msgs, msg)
+	current.size += len(msg.Body)
+	full := b.opts.MaxMessages > 0 && len(current.msgs) >= b.opts.MaxMessages ||
+		b.opts.MaxBytes > 0 && current.size >= b.opts.MaxBytes
+	if full {
+		b.take()
+	}
+	b.mu.Unlock()
+
+	if full {
+		b.flush(current)
+	}
+
+	select {
+	case <-current.done:
+		if current.errs != nil {
+			return current.errs[i]
+		}
+		return current.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close flushes the pending batch and closes the inner writer.
+func (b *BatchingWriter) Close() {
+	log.Info("Closing BatchingWriter.")
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	current := b.take()
+	b.mu.Unlock()
+
+	if current != nil {
+		b.flush(current)
+	}
+	// Waits for the flushes started by the timers.
+	b.flushing.Wait()
+	b.w.Close()
+}
+
+// newBatch creates an empty batch, with a timer to flush it after Interval. It must be called holding mu.
+func (b *BatchingWriter) newBatch() *batch {
+	current := &batch{done: make(chan struct{})}
+	if b.opts.Interval > 0 {
+		current.timer = time.AfterFunc(b.opts.Interval, func() { b.flushIfCurrent(current) })
+	}
+	return current
+}
+
+// take removes the current batch, if there's one, so it can be flushed. It must be called holding mu.
+func (b *BatchingWriter) take() *batch {
+	current := b.batch
+	if current != nil {
+		b.batch = nil
+		b.flushing.Add(1)
+	}
+	return current
+}
+
+// flushIfCurrent is called by the timer, it flushes the batch unless it was already taken.
+func (b *BatchingWriter) flushIfCurrent(current *batch) {
+	b.mu.Lock()
+	if b.batch != current {
+		b.mu.Unlock()
+		return
+	}
+	b.take()
+	b.mu.Unlock()
+	b.flush(current)
+}
+
+// flush writes the batch to the inner writer and wakes up all the writers waiting for it.
+// The messages come from different requests, so the flush doesn't use any of their contexts.
+// Without WriteBatch every message gets its own result, so a failed message doesn't fail the others.
+func (b *BatchingWriter) flush(current *batch) {
+	defer b.flushing.Done()
+	if current.timer != nil {
+		current.timer.Stop()
+	}
+
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	ctx := context.Background()
+	if bw, ok := b.w.(BatchWriter); ok {
+		current.err = bw.WriteBatch(ctx, current.msgs)
+		if current.err != nil {
+			slog.Error(current.err.Error())
+		}
+	} else {
+		current.errs = make([]error, len(current.msgs))
+		for i, msg := range current.msgs {
+			current.errs[i] = b.w.Write(ctx, msg)
+			if current.errs[i] != nil {
+				slog.Error(current.errs[i].Error())
+			}
+		}
+	}
+	close(current.done)
+}
@@ -0,0 +1,197 @@
+package writer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchRecorder implements BatchWriter and keeps the size of every batch it receives.
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches []int
+	closed  bool
+}
+
+func (r *batchRecorder) Write(ctx context.Context, msg writer.Message) error {
+	return r.WriteBatch(ctx, []writer.Message{msg})
+}
+
+func (r *batchRecorder) WriteBatch(_ context.Context, msgs []writer.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, len(msgs))
+	return nil
+}
+
+func (r *batchRecorder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+func writeConcurrently(w writer.Writer, n int) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = w.Write(context.Background(), writer.Message{Body: fmt.Sprintf("Test message %d.", i)})
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestBatchingWriter_MaxMessages(t *testing.T) {
+	r := &batchRecorder{}
+	w := writer.NewBatchingWriter(r, writer.BatchingOptions{MaxMessages: 3, Interval: time.Minute})
+
+	for _, err := range writeConcurrently(w, 6) {
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	w.Close()
+
+	if len(r.batches) != 2 || r.batches[0] != 3 || r.batches[1] != 3 {
+		t.Log(fmt.Sprintf("Expected batches: %v, received: %v", []int{3, 3}, r.batches))
+		t.FailNow()
+	}
+	if !r.closed {
+		t.Log("Expected the inner writer to be closed.")
+		t.FailNow()
+	}
+}
+
+func TestBatchingWriter_Interval(t *testing.T) {
+	r := &batchRecorder{}
+	w := writer.NewBatchingWriter(r, writer.BatchingOptions{MaxMessages: 100, Interval: 20 * time.Millisecond})
+
+	start := time.Now()
+	for _, err := range writeConcurrently(w, 2) {
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Log("Expected the batch to be flushed after the interval.")
+		t.FailNow()
+	}
+	w.Close()
+
+	if len(r.batches) != 1 || r.batches[0] != 2 {
+		t.Log(fmt.Sprintf("Expected batches: %v, received: %v", []int{2}, r.batches))
+		t.FailNow()
+	}
+}
+
+func TestBatchingWriter_FlushOnClose(t *testing.T) {
+	r := &batchRecorder{}
+	w := writer.NewBatchingWriter(r, writer.BatchingOptions{MaxMessages: 100, Interval: time.Minute})
+
+	result := make(chan error)
+	go func() {
+		result <- w.Write(context.Background(), writer.Message{Body: "Test message."})
+	}()
+	// Gives the goroutine time to add the message to the batch.
+	time.Sleep(20 * time.Millisecond)
+
+	w.Close()
+	err := <-result
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(r.batches) != 1 || r.batches[0] != 1 {
+		t.Log(fmt.Sprintf("Expected batches: %v, received: %v", []int{1}, r.batches))
+		t.FailNow()
+	}
+
+	err = w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != writer.ErrClosed {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", writer.ErrClosed, err))
+		t.FailNow()
+	}
+}
+
+// selectiveWriter doesn't implement BatchWriter and fails the messages in fail.
+type selectiveWriter struct {
+	fail map[string]bool
+}
+
+func (w *selectiveWriter) Write(_ context.Context, msg writer.Message) error {
+	if w.fail[msg.Body] {
+		return errors.New("Write failed.")
+	}
+	return nil
+}
+
+func (w *selectiveWriter) Close() {}
+
+func TestBatchingWriter_MessageErrors(t *testing.T) {
+	inner := &selectiveWriter{fail: map[string]bool{"Test message 1.": true, "Test message 3.": true}}
+	w := writer.NewBatchingWriter(inner, writer.BatchingOptions{MaxMessages: 4, Interval: time.Minute})
+	defer w.Close()
+
+	// The messages of the batch are written one by one, each request gets the result of its own message.
+	for i, err := range writeConcurrently(w, 4) {
+		if (err != nil) != (i%2 == 1) {
+			t.Log(fmt.Sprintf("Unexpected result for message %d: %v", i, err))
+			t.Fail()
+		}
+	}
+}
+
+func TestBatchingWriter_FileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batching")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.txt")
+	w, err := writer.CreateWriter("FileWriter", map[string]string{"filepath": path, "batch_size": "2"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for _, err := range writeConcurrently(w, 2) {
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	w.Close()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Log(fmt.Sprintf("Expected len(lines): %d, received: %d", 2, len(lines)))
+		t.FailNow()
+	}
+}
+
+func TestCreateWriter_Batching(t *testing.T) {
+	_, err := writer.CreateWriter("MemoryWriter", map[string]string{"batch_interval": "soon"})
+	if err == nil {
+		t.Error("Expected error for invalid batch_interval.")
+		t.FailNow()
+	}
+}
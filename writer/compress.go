@@ -0,0 +1,157 @@
+/*
+This file has the helpers to compress and prune the files rotated by FileWriter.
+*/
+package writer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedExt maps the compression values accepted in the configuration to the suffix of the compressed files.
+var compressedExt = map[string]string{"gzip": ".gz", "zstd": ".zst"}
+
+// isCompressed returns true when the file has one of the suffixes in compressedExt.
+func isCompressed(path string) bool {
+	for _, ext := range compressedExt {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressFile writes a compressed copy of the file with the right suffix and removes the original one.
+// The copy is written to a temporary file first, so a half compressed file never looks like a backup,
+// and it keeps the modification time of the original one, so MaxAge still counts from the rotation.
+func compressFile(path, compression string) error {
+	ext, ok := compressedExt[compression]
+	if !ok {
+		return fmt.Errorf("Compression %q not supported.", compression)
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ext + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = compressTo(dst, src, compression)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path+ext)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// compressTo copies src into dst using the compression algorithm.
+func compressTo(dst io.Writer, src io.Reader, compression string) error {
+	var cw io.WriteCloser
+	var err error
+	switch compression {
+	case "gzip":
+		cw = gzip.NewWriter(dst)
+	case "zstd":
+		cw, err = zstd.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Compression %q not supported.", compression)
+	}
+
+	_, err = io.Copy(cw, src)
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// housekeep compresses the rotated files and deletes the ones that don't fit the retention rules.
+// It runs in its own goroutine so rotations never wait for it, housekeeping itself is serialized with a mutex.
+func (w *FileWriter) housekeep() {
+	defer w.housekeeping.Done()
+	w.housekeepingMu.Lock()
+	defer w.housekeepingMu.Unlock()
+
+	backups, err := listBackups(w.path)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	if w.options.Compression != "" {
+		for i, b := range backups {
+			if isCompressed(b) {
+				continue
+			}
+			err = compressFile(b, w.options.Compression)
+			if err != nil {
+				slog.Error(err.Error())
+				continue
+			}
+			backups[i] = b + compressedExt[w.options.Compression]
+		}
+	}
+
+	w.removeOldBackups(backups)
+}
+
+// removeOldBackups deletes the rotated files, sorted from oldest to newest, exceeding MaxBackups, MaxAge or MaxTotalSize.
+// The files are checked from newest to oldest, the first one breaking a rule is deleted along with all the older ones.
+func (w *FileWriter) removeOldBackups(backups []string) {
+	var keep int
+	var total int64
+	now := time.Now()
+	for i := len(backups) - 1; i >= 0; i-- {
+		if w.options.MaxBackups > 0 && keep >= w.options.MaxBackups {
+			break
+		}
+		info, err := os.Stat(backups[i])
+		if err == nil {
+			total += info.Size()
+			if w.options.MaxAge > 0 && now.Sub(info.ModTime()) > w.options.MaxAge {
+				break
+			}
+			if w.options.MaxTotalSize > 0 && total > w.options.MaxTotalSize {
+				break
+			}
+		}
+		keep++
+	}
+
+	for _, b := range backups[:len(backups)-keep] {
+		err := os.Remove(b)
+		if err != nil {
+			slog.Error(err.Error())
+		}
+	}
+}
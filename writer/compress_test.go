@@ -0,0 +1,163 @@
+package writer_test
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func rotateMessages(t *testing.T, params map[string]string, n int) string {
+	dir, err := ioutil.TempDir("", "compress")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	params["filepath"] = filepath.Join(dir, "test.txt")
+	// Each message takes 16 bytes with the newline, so every message after the first one rotates the file.
+	params["max_size"] = "20"
+	w, err := writer.CreateWriter("FileWriter", params)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Error(err)
+		t.FailNow()
+	}
+	for i := 1; i <= n; i++ {
+		err = w.Write(context.Background(), writer.Message{Body: fmt.Sprintf("Test message %d.", i)})
+		if err != nil {
+			t.Error(err)
+			t.Fail()
+		}
+	}
+	w.Close()
+	return dir
+}
+
+func readCompressed(t *testing.T, path string, open func(io.Reader) (io.Reader, error)) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer f.Close()
+
+	r, err := open(f)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return string(b)
+}
+
+func TestFileWriter_Gzip(t *testing.T) {
+	dir := rotateMessages(t, map[string]string{"compression": "gzip"}, 3)
+	defer os.RemoveAll(dir)
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "test.txt.*.gz"))
+	if len(backups) != 2 {
+		t.Log(fmt.Sprintf("Expected len(backups): %d, received: %d", 2, len(backups)))
+		t.FailNow()
+	}
+	uncompressed, _ := filepath.Glob(filepath.Join(dir, "test.txt.*[0-9]"))
+	if len(uncompressed) != 0 {
+		t.Log(fmt.Sprintf("Expected no uncompressed backups, received: %v", uncompressed))
+		t.FailNow()
+	}
+
+	content := readCompressed(t, backups[0], func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) })
+	if content != "Test message 1.\n" {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", "Test message 1.\n", content))
+		t.FailNow()
+	}
+}
+
+func TestFileWriter_Zstd(t *testing.T) {
+	dir := rotateMessages(t, map[string]string{"compression": "zstd"}, 2)
+	defer os.RemoveAll(dir)
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "test.txt.*.zst"))
+	if len(backups) != 1 {
+		t.Log(fmt.Sprintf("Expected len(backups): %d, received: %d", 1, len(backups)))
+		t.FailNow()
+	}
+
+	content := readCompressed(t, backups[0], func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) })
+	if content != "Test message 1.\n" {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", "Test message 1.\n", content))
+		t.FailNow()
+	}
+}
+
+func TestFileWriter_MaxTotalSize(t *testing.T) {
+	// Uncompressed backups take 16 bytes each, so only two fit in the budget.
+	dir := rotateMessages(t, map[string]string{"max_total_size": "40"}, 5)
+	defer os.RemoveAll(dir)
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "test.txt.*"))
+	if len(backups) != 2 {
+		t.Log(fmt.Sprintf("Expected len(backups): %d, received: %d", 2, len(backups)))
+		t.FailNow()
+	}
+}
+
+func TestCreateWriter_InvalidCompression(t *testing.T) {
+	_, err := writer.CreateWriter("FileWriter", map[string]string{"filepath": "./test.txt", "compression": "lzma"})
+	if err == nil {
+		t.Error("Expected error for unsupported compression.")
+		t.FailNow()
+	}
+}
+
+func TestFileWriter_CompressKeepsModTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	// A backup left uncompressed by a previous run, rotated two hours ago.
+	path := filepath.Join(dir, "test.txt")
+	backup := path + "." + time.Now().Add(-2*time.Hour).Format("20060102T150405.000")
+	err = ioutil.WriteFile(backup, []byte("Test message 1.\n"), 0644)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	rotated := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	err = os.Chtimes(backup, rotated, rotated)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	w, err := writer.CreateWriter("FileWriter", map[string]string{"filepath": path, "compression": "gzip"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+
+	info, err := os.Stat(backup + ".gz")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if !info.ModTime().Equal(rotated) {
+		t.Log(fmt.Sprintf("Expected ModTime: %v, received: %v", rotated, info.ModTime()))
+		t.FailNow()
+	}
+}
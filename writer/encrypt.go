@@ -0,0 +1,180 @@
+/*
+This file has the EncryptingWriter, it encrypts the messages with AES-256-GCM before the writer gets them.
+*/
+package writer
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/authenticator"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix starts every encrypted body, it's followed by the key ID, a colon, and the nonce and the
+// ciphertext in base64. The prefix and the key ID are authenticated along with the ciphertext.
+const encryptedPrefix = "enc:v1:"
+
+// EncryptionKeys holds the AES-256 keys of a key file, by ID.
+type EncryptionKeys struct {
+	keys map[string]cipher.AEAD
+	last string
+}
+
+// LoadEncryptionKeys reads a key file with a key per line, as the key ID and the base64 of 32 random bytes separated
+// by a space. Empty lines and lines starting with # are ignored.
+func LoadEncryptionKeys(path string) (*EncryptionKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &EncryptionKeys{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return nil, fmt.Errorf("Invalid key in line %d of %q.", line, path)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Key in line %d of %q must be 32 bytes in base64.", line, path)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[fields[0]], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.last = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("No keys found in %q.", path)
+	}
+	return k, nil
+}
+
+// Encrypt returns the message in Json, encrypted with the key.
+func (k *EncryptionKeys) Encrypt(keyID string, msg Message) (string, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("Key %q not found.", keyID)
+	}
+	plaintext, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	header := encryptedPrefix + keyID + ":"
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(header))
+	return header + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the message encrypted by Encrypt, with any of the keys.
+func (k *EncryptionKeys) Decrypt(token string) (Message, error) {
+	var msg Message
+	if !strings.HasPrefix(token, encryptedPrefix) {
+		return msg, errors.New("Message is not encrypted.")
+	}
+	i := strings.Index(token[len(encryptedPrefix):], ":")
+	if i == -1 {
+		return msg, errors.New("Invalid encrypted message.")
+	}
+	header := token[:len(encryptedPrefix)+i+1]
+	keyID := header[len(encryptedPrefix) : len(header)-1]
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return msg, fmt.Errorf("Key %q not found.", keyID)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(token[len(header):])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return msg, errors.New("Invalid encrypted message.")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(header))
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(plaintext, &msg)
+	return msg, err
+}
+
+// EncryptingWriter encrypts every message and writes it with the encrypted Json message as body.
+// The service, the time, the request id, the extracted values and the principal's ID stay in clear, so writers can
+// still use them in paths, keys and columns. Don't extract values that must be protected. The headers, the remote ip
+// and the principal's claims are only in the encrypted message.
+// Every body is encrypted, even if it looks encrypted: a client could send one that was encrypted for another service.
+// Dead letters are replayed without this wrapper, so they aren't encrypted twice.
+type EncryptingWriter struct {
+	w     Writer
+	keys  *EncryptionKeys
+	keyID string
+}
+
+// NewEncryptingWriter creates the wrapper, encrypting with the key keyID.
+func NewEncryptingWriter(w Writer, keys *EncryptionKeys, keyID string) (*EncryptingWriter, error) {
+	if _, ok := keys.keys[keyID]; !ok {
+		return nil, fmt.Errorf("Key %q not found.", keyID)
+	}
+	log.Info(fmt.Sprintf("Encrypting messages with key %q.", keyID))
+	return &EncryptingWriter{w: w, keys: keys, keyID: keyID}, nil
+}
+
+// newEncryptingWriter creates the wrapper from the encrypt_key_file and encrypt_key_id parameters.
+// The last key of the file is used when there's no encrypt_key_id.
+func newEncryptingWriter(w Writer, params map[string]string) (*EncryptingWriter, error) {
+	keys, err := LoadEncryptionKeys(params["encrypt_key_file"])
+	if err != nil {
+		return nil, err
+	}
+	keyID := params["encrypt_key_id"]
+	if keyID == "" {
+		keyID = keys.last
+	}
+	return NewEncryptingWriter(w, keys, keyID)
+}
+
+// Write encrypts the message and writes it, with only the principal's ID in clear.
+func (w *EncryptingWriter) Write(ctx context.Context, msg Message) error {
+	token, err := w.keys.Encrypt(w.keyID, msg)
+	if err != nil {
+		return err
+	}
+	var principal *authenticator.Principal
+	if msg.Principal != nil && msg.Principal.ID != "" {
+		principal = &authenticator.Principal{ID: msg.Principal.ID}
+	}
+	return w.w.Write(ctx, Message{
+		Service:    msg.Service,
+		ReceivedAt: msg.ReceivedAt,
+		RequestID:  msg.RequestID,
+		Extracted:  msg.Extracted,
+		Principal:  principal,
+		Body:       token,
+	})
+}
+
+// Close closes the writer.
+func (w *EncryptingWriter) Close() {
+	w.w.Close()
+}
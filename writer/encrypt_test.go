@@ -0,0 +1,219 @@
+package writer_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/efark/data-receiver/authenticator"
+	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keyFile writes the key file content in a temporary directory, and returns its path and a function to remove it.
+func keyFile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	path := filepath.Join(dir, "keys.txt")
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+const testKeys = `# Keys for the tests.
+2021-01 MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=
+2021-02 ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=
+`
+
+func TestEncryptingWriter_Write(t *testing.T) {
+	path, remove := keyFile(t, testKeys)
+	defer remove()
+
+	m, _ := writer.NewMemoryWriter()
+	keys, err := writer.LoadEncryptionKeys(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w, err := writer.NewEncryptingWriter(m, keys, "2021-01")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	msg := writer.Message{
+		Service: "test", RemoteIP: "10.0.0.1", Headers: map[string]string{"X-Partner": "acme"},
+		Extracted: map[string]string{"source": "a"}, Body: "secret payload",
+		Principal: &authenticator.Principal{ID: "client-1", Claims: map[string]interface{}{"email": "user@example.com"}},
+	}
+	err = w.Write(context.Background(), msg)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	ms := m.GetMessages()
+	if len(ms) != 1 {
+		t.Log(fmt.Sprintf("Expected len(ms): %d, received: %d", 1, len(ms)))
+		t.FailNow()
+	}
+	stored := ms[0]
+	if !strings.HasPrefix(stored.Body, "enc:v1:2021-01:") || strings.Contains(stored.Body, "secret") {
+		t.Log(fmt.Sprintf("Unexpected body: %q", stored.Body))
+		t.FailNow()
+	}
+	if stored.Service != "test" || stored.Extracted["source"] != "a" || stored.RemoteIP != "" || stored.Headers != nil {
+		t.Log(fmt.Sprintf("Unexpected message: %+v", stored))
+		t.FailNow()
+	}
+	// Only the principal's ID stays in clear, its claims are encrypted.
+	if stored.Principal == nil || stored.Principal.ID != "client-1" || stored.Principal.Claims != nil {
+		t.Log(fmt.Sprintf("Unexpected principal: %+v", stored.Principal))
+		t.FailNow()
+	}
+
+	decrypted, err := keys.Decrypt(stored.Body)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if decrypted.Body != msg.Body || decrypted.RemoteIP != msg.RemoteIP || decrypted.Headers["X-Partner"] != "acme" ||
+		decrypted.Principal == nil || decrypted.Principal.Claims["email"] != "user@example.com" {
+		t.Log(fmt.Sprintf("Expected message: %+v, received: %+v", msg, decrypted))
+		t.FailNow()
+	}
+
+	// Bodies that are already encrypted are encrypted again, so a client can't submit a message encrypted for another
+	// service with its metadata.
+	forged := writer.Message{Service: "other", Body: stored.Body}
+	err = w.Write(context.Background(), forged)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ms = m.GetMessages()
+	if ms[1].Body == stored.Body {
+		t.Log("Expected the encrypted body to be encrypted again.")
+		t.FailNow()
+	}
+	decrypted, err = keys.Decrypt(ms[1].Body)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if decrypted.Service != "other" || decrypted.Body != stored.Body {
+		t.Log(fmt.Sprintf("Expected message: %+v, received: %+v", forged, decrypted))
+		t.FailNow()
+	}
+}
+
+func TestCreateWriter_Encrypt(t *testing.T) {
+	path, remove := keyFile(t, testKeys)
+	defer remove()
+	output := filepath.Join(filepath.Dir(path), "output.jsonl")
+
+	w, err := writer.CreateWriter("FileWriter", map[string]string{"filepath": output, "format": "json", "encrypt_key_file": path})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = w.Write(context.Background(), writer.Message{Service: "test", Body: "secret payload"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+
+	// The last key of the file is used by default.
+	content, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if strings.Contains(string(content), "secret") || !strings.Contains(string(content), `"body":"enc:v1:2021-02:`) {
+		t.Log(fmt.Sprintf("Unexpected content: %q", content))
+		t.FailNow()
+	}
+}
+
+func TestEncryptionKeys_Decrypt(t *testing.T) {
+	path, remove := keyFile(t, testKeys)
+	defer remove()
+	keys, err := writer.LoadEncryptionKeys(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// Messages encrypted with an older key can still be decrypted after the rotation.
+	for _, keyID := range []string{"2021-01", "2021-02"} {
+		token, err := keys.Encrypt(keyID, writer.Message{Body: keyID})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		msg, err := keys.Decrypt(token)
+		if err != nil || msg.Body != keyID {
+			t.Log(fmt.Sprintf("Expected body: %q, received: %q, %v", keyID, msg.Body, err))
+			t.FailNow()
+		}
+	}
+
+	token, err := keys.Encrypt("2021-01", writer.Message{Body: "test"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	tests := []string{
+		"plain text",
+		// The key ID is authenticated.
+		strings.Replace(token, "2021-01", "2021-02", 1),
+		strings.Replace(token, "2021-01", "2020-12", 1),
+		token[:len(token)-2],
+	}
+	for _, test := range tests {
+		_, err = keys.Decrypt(test)
+		if err == nil {
+			t.Log(fmt.Sprintf("Expected an error for: %q", test))
+			t.Fail()
+		}
+	}
+}
+
+func TestLoadEncryptionKeys_Invalid(t *testing.T) {
+	tests := []string{
+		"",
+		"# Only comments.\n",
+		"2021-01\n",
+		"2021-01 c2hvcnQ=\n",
+		"2021:01 MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n",
+	}
+	for _, test := range tests {
+		path, remove := keyFile(t, test)
+		_, err := writer.LoadEncryptionKeys(path)
+		remove()
+		if err == nil {
+			t.Log(fmt.Sprintf("Expected an error for: %q", test))
+			t.Fail()
+		}
+	}
+
+	m, _ := writer.NewMemoryWriter()
+	path, remove := keyFile(t, testKeys)
+	defer remove()
+	keys, _ := writer.LoadEncryptionKeys(path)
+	_, err := writer.NewEncryptingWriter(m, keys, "2020-12")
+	if err == nil {
+		t.Log("Expected an error for an unknown key.")
+		t.FailNow()
+	}
+}
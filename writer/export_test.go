@@ -0,0 +1,54 @@
+package writer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// FailOpenActiveFile makes FileWriters fail to open their active file with err, until restore is called.
+func FailOpenActiveFile(err error) (restore func()) {
+	openActiveFile = func(string) (*os.File, int64, error) {
+		return nil, 0, err
+	}
+	return func() { openActiveFile = openLogFile }
+}
+
+// SetSocketDial makes the SocketWriters created afterwards connect with dial, until restore is called.
+func SetSocketDial(dial func(network, address string, timeout time.Duration) (net.Conn, error)) (restore func()) {
+	dialSocket = dial
+	return func() { dialSocket = net.DialTimeout }
+}
+
+// parquetFailures is the number of writes to the Parquet files that will fail.
+var parquetFailures int32
+
+// failingParquetFile writes half of the data and fails while there are parquetFailures.
+type failingParquetFile struct {
+	source.ParquetFile
+}
+
+func (f failingParquetFile) Write(b []byte) (int, error) {
+	if atomic.AddInt32(&parquetFailures, -1) >= 0 {
+		n, _ := f.ParquetFile.Write(b[:len(b)/2])
+		return n, errors.New("Injected write error.")
+	}
+	return f.ParquetFile.Write(b)
+}
+
+// FailParquetWrites makes the next n writes to the Parquet files fail, for the files opened after the first call,
+// until restore is called.
+func FailParquetWrites(n int32) (restore func()) {
+	atomic.StoreInt32(&parquetFailures, n)
+	newParquetFile = func(f *os.File) source.ParquetFile {
+		return failingParquetFile{osParquetFile{f}}
+	}
+	return func() {
+		atomic.StoreInt32(&parquetFailures, 0)
+		newParquetFile = func(f *os.File) source.ParquetFile { return osParquetFile{f} }
+	}
+}
@@ -0,0 +1,186 @@
+/*
+This file has the HTTPWriter, it forwards the messages to another url, like another receiver or a webhook.
+*/
+package writer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/authenticator"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default values for the HTTPWriter parameters.
+const (
+	defaultHTTPTimeout         = 10 * time.Second
+	defaultHTTPSignatureHeader = "X-Signature"
+	httpHeaderPrefix           = "header."
+	// maxHTTPErrorBody is how much of the response body is added to the error when the upstream fails.
+	maxHTTPErrorBody = 512
+)
+
+// HTTPWriter POSTs every message, or every batch as newline delimited messages, to an url.
+// Optionally it signs the body with the same HMAC the Signer authenticator checks, so receivers can be chained.
+type HTTPWriter struct {
+	url             string
+	format          string
+	headers         map[string]string
+	client          *http.Client
+	signer          *authenticator.Signer
+	signatureHeader string
+	timestampHeader string
+}
+
+// NewHTTPWriter creates the writer from its parameters:
+// url, format, timeout, ca_file, every "header.<Name>" as a header to send,
+// and sign_key, sign_hasher, sign_encrypter and sign_header to sign the body.
+// With sign_timestamp_header the timestamp is sent in that header and signed with the body, like the Signer's timestamp mode.
+func NewHTTPWriter(params map[string]string) (*HTTPWriter, error) {
+	url := params["url"]
+	if url == "" {
+		return nil, errors.New("url not received for HTTPWriter.")
+	}
+	format, err := parseFormat(params)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultHTTPTimeout
+	if v, ok := params["timeout"]; ok {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %q.", v)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile := params["ca_file"]; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %q.", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	headers := make(map[string]string)
+	for k, v := range params {
+		if strings.HasPrefix(k, httpHeaderPrefix) {
+			headers[strings.TrimPrefix(k, httpHeaderPrefix)] = v
+		}
+	}
+
+	w := &HTTPWriter{
+		url:     url,
+		format:  format,
+		headers: headers,
+		client:  &http.Client{Timeout: timeout, Transport: transport},
+	}
+
+	if key, ok := params["sign_key"]; ok {
+		signParams := map[string]string{"Key": key, "Hasher": params["sign_hasher"], "Encrypter": params["sign_encrypter"]}
+		w.timestampHeader = params["sign_timestamp_header"]
+		if w.timestampHeader != "" {
+			signParams["Mode"] = authenticator.ModeTimestamp
+		}
+		signer, err := authenticator.NewSigner(signParams)
+		if err != nil {
+			return nil, err
+		}
+		w.signer = &signer
+		w.signatureHeader = params["sign_header"]
+		if w.signatureHeader == "" {
+			w.signatureHeader = defaultHTTPSignatureHeader
+		}
+	}
+
+	log.Info(fmt.Sprintf("Starting HTTPWriter for %q.", url))
+	return w, nil
+}
+
+// Write sends the message in the body of a POST request.
+func (w *HTTPWriter) Write(ctx context.Context, msg Message) error {
+	content, err := msg.Format(w.format)
+	if err != nil {
+		return err
+	}
+	return w.post(ctx, []byte(content), msg.RequestID)
+}
+
+// WriteBatch sends all the messages in one POST request, one message per line.
+func (w *HTTPWriter) WriteBatch(ctx context.Context, msgs []Message) error {
+	var b bytes.Buffer
+	for _, msg := range msgs {
+		content, err := msg.Format(w.format)
+		if err != nil {
+			return err
+		}
+		b.WriteString(content)
+		if !strings.HasSuffix(content, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	return w.post(ctx, b.Bytes(), "")
+}
+
+// Close releases the idle connections.
+func (w *HTTPWriter) Close() {
+	log.Info("Closing HTTPWriter.")
+	w.client.CloseIdleConnections()
+}
+
+// post sends the body and returns an error when the response isn't a 2xx.
+func (w *HTTPWriter) post(ctx context.Context, body []byte, requestID string) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	if requestID != "" {
+		req.Header.Set("X-Request-Id", requestID)
+	}
+	if w.signer != nil && w.timestampHeader != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		signature, err := w.signer.SignTimestamp(timestamp, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(w.timestampHeader, timestamp)
+		req.Header.Set(w.signatureHeader, signature)
+	} else if w.signer != nil {
+		signature, err := w.signer.Sign(body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(w.signatureHeader, signature)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPErrorBody))
+		return fmt.Errorf("Upstream %q answered %d: %s", w.url, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	// The body is read so the connection can be reused.
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
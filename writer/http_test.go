@@ -0,0 +1,184 @@
+package writer_test
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"github.com/efark/data-receiver/authenticator"
+	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// upstream records the bodies and headers it receives and answers with status.
+type upstream struct {
+	status  int
+	bodies  []string
+	headers []http.Header
+}
+
+func (u *upstream) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	u.bodies = append(u.bodies, string(b))
+	u.headers = append(u.headers, r.Header)
+	rw.WriteHeader(u.status)
+}
+
+func TestHTTPWriter_Write(t *testing.T) {
+	u := &upstream{status: http.StatusOK}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	params := map[string]string{
+		"url": server.URL, "header.X-Source": "edge",
+		"sign_key": "magicKey", "sign_hasher": "sha256", "sign_encrypter": "base64.URL",
+	}
+	w, err := writer.NewHTTPWriter(params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	err = w.Write(context.Background(), writer.Message{RequestID: "abc", Body: "test message"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if len(u.bodies) != 1 || u.bodies[0] != "test message" {
+		t.Log(fmt.Sprintf("Expected body: %q, received: %v", "test message", u.bodies))
+		t.FailNow()
+	}
+	if u.headers[0].Get("X-Source") != "edge" || u.headers[0].Get("X-Request-Id") != "abc" {
+		t.Log(fmt.Sprintf("Unexpected headers: %v", u.headers[0]))
+		t.FailNow()
+	}
+
+	// The receiving side checks the signature with a Signer using the same key.
+	signer, err := authenticator.NewSigner(map[string]string{"Key": "magicKey", "Hasher": "sha256", "Encrypter": "base64.URL"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = signer.Authenticate(&authenticator.Request{
+		Body:      []byte(u.bodies[0]),
+		Extracted: map[string]string{"signature": u.headers[0].Get("X-Signature")},
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+}
+
+func TestHTTPWriter_SignTimestamp(t *testing.T) {
+	u := &upstream{status: http.StatusOK}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	signParams := map[string]string{"Key": "magicKey", "Hasher": "sha256", "Encrypter": "hex"}
+	w, err := writer.NewHTTPWriter(map[string]string{
+		"url": server.URL, "sign_key": signParams["Key"], "sign_hasher": signParams["Hasher"],
+		"sign_encrypter": signParams["Encrypter"], "sign_timestamp_header": "X-Timestamp",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	err = w.Write(context.Background(), writer.Message{Body: "test message"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	signParams["Mode"] = "timestamp"
+	signer, err := authenticator.NewSigner(signParams)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = signer.Authenticate(&authenticator.Request{
+		Body: []byte(u.bodies[0]),
+		Extracted: map[string]string{
+			"signature": u.headers[0].Get("X-Signature"), "timestamp": u.headers[0].Get("X-Timestamp")},
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+}
+
+func TestHTTPWriter_WriteBatch(t *testing.T) {
+	u := &upstream{status: http.StatusOK}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	w, err := writer.NewHTTPWriter(map[string]string{"url": server.URL})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	err = w.WriteBatch(context.Background(), []writer.Message{{Body: "message 1"}, {Body: "message 2"}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(u.bodies) != 1 || u.bodies[0] != "message 1\nmessage 2\n" {
+		t.Log(fmt.Sprintf("Expected body: %q, received: %v", "message 1\nmessage 2\n", u.bodies))
+		t.FailNow()
+	}
+}
+
+func TestHTTPWriter_UpstreamError(t *testing.T) {
+	u := &upstream{status: http.StatusBadGateway}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	w, err := writer.NewHTTPWriter(map[string]string{"url": server.URL})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	err = w.Write(context.Background(), writer.Message{Body: "test message"})
+	if err == nil {
+		t.Error("Expected error when the upstream fails.")
+		t.FailNow()
+	}
+}
+
+func TestHTTPWriter_CAFile(t *testing.T) {
+	u := &upstream{status: http.StatusOK}
+	server := httptest.NewTLSServer(u)
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.Remove(file.Name())
+	pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	file.Close()
+
+	w, err := writer.NewHTTPWriter(map[string]string{"url": server.URL, "ca_file": file.Name()})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	err = w.Write(context.Background(), writer.Message{Body: "test message"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,255 @@
+/*
+This file has the KafkaWriter, it produces the messages to a Kafka topic.
+*/
+package writer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// Default values for the KafkaWriter parameters.
+const (
+	defaultKafkaTimeout = 10 * time.Second
+	defaultKafkaRetries = 3
+)
+
+// KafkaWriter produces every message to a topic and waits for its delivery report, so the request fails when the
+// message isn't stored with the configured acks. Messages are keyed by an extracted value, so the ones with the
+// same value go to the same partition.
+type KafkaWriter struct {
+	producer sarama.SyncProducer
+	topic    *pathTemplate
+	keyField string
+	format   string
+}
+
+// NewKafkaWriter creates the writer from its parameters: brokers (comma separated), topic, key_field, acks
+// (none, leader or all), linger, compression, version, client_id, timeout, retries, max_message_bytes, format,
+// tls, ca_file, sasl_user and sasl_password.
+// The topic is a template that can use the time placeholders, the service and the extracted values.
+func NewKafkaWriter(params map[string]string) (*KafkaWriter, error) {
+	if params["brokers"] == "" {
+		return nil, errors.New("brokers not received for KafkaWriter.")
+	}
+	if params["topic"] == "" {
+		return nil, errors.New("topic not received for KafkaWriter.")
+	}
+	topic, err := parseTemplate(params["topic"])
+	if err != nil {
+		return nil, err
+	}
+	format, err := parseFormat(params)
+	if err != nil {
+		return nil, err
+	}
+	config, err := kafkaConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
+	brokers := strings.Split(params["brokers"], ",")
+	for i := range brokers {
+		brokers[i] = strings.TrimSpace(brokers[i])
+	}
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info(fmt.Sprintf("Starting KafkaWriter for brokers %v.", brokers))
+	return &KafkaWriter{producer: producer, topic: topic, keyField: params["key_field"], format: format}, nil
+}
+
+// kafkaConfig builds the producer configuration from the parameters.
+func kafkaConfig(params map[string]string) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.Timeout = defaultKafkaTimeout
+	config.Producer.Retry.Max = defaultKafkaRetries
+	if v, ok := params["client_id"]; ok {
+		config.ClientID = v
+	}
+
+	switch params["acks"] {
+	case "", "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	case "leader":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, fmt.Errorf("Invalid acks %q.", params["acks"])
+	}
+
+	switch params["compression"] {
+	case "", "none":
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+		// zstd needs Kafka 2.1.0 or newer.
+		config.Version = sarama.V2_1_0_0
+	default:
+		return nil, fmt.Errorf("Compression %q not supported.", params["compression"])
+	}
+
+	if v, ok := params["version"]; ok {
+		version, err := sarama.ParseKafkaVersion(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid version %q.", v)
+		}
+		config.Version = version
+	}
+	if v, ok := params["linger"]; ok {
+		linger, err := time.ParseDuration(v)
+		if err != nil || linger < 0 {
+			return nil, fmt.Errorf("Invalid linger %q.", v)
+		}
+		config.Producer.Flush.Frequency = linger
+	}
+	if v, ok := params["timeout"]; ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %q.", v)
+		}
+		config.Producer.Timeout = timeout
+		config.Net.DialTimeout = timeout
+		config.Net.ReadTimeout = timeout
+		config.Net.WriteTimeout = timeout
+	}
+	if v, ok := params["retries"]; ok {
+		retries, err := strconv.Atoi(v)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("Invalid retries %q.", v)
+		}
+		config.Producer.Retry.Max = retries
+	}
+	if _, ok := params["max_message_bytes"]; ok {
+		size, err := intParam(params, "max_message_bytes", 0)
+		if err != nil {
+			return nil, err
+		}
+		config.Producer.MaxMessageBytes = size
+	}
+
+	if params["tls"] == "true" || params["ca_file"] != "" {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = &tls.Config{}
+		if v := params["ca_file"]; v != "" {
+			pem, err := ioutil.ReadFile(v)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates found in %q.", v)
+			}
+			config.Net.TLS.Config.RootCAs = pool
+		}
+	}
+	if v, ok := params["sasl_user"]; ok {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = v
+		config.Net.SASL.Password = params["sasl_password"]
+	}
+
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Write produces the message and waits for its delivery report. When ctx is done first the message may still be delivered.
+func (w *KafkaWriter) Write(ctx context.Context, msg Message) error {
+	pm, err := w.producerMessage(msg)
+	if err != nil {
+		return err
+	}
+	return w.send(ctx, func() error {
+		_, _, err := w.producer.SendMessage(pm)
+		return err
+	})
+}
+
+// WriteBatch produces the messages together and waits for all their delivery reports.
+func (w *KafkaWriter) WriteBatch(ctx context.Context, msgs []Message) error {
+	pms := make([]*sarama.ProducerMessage, len(msgs))
+	for i, msg := range msgs {
+		pm, err := w.producerMessage(msg)
+		if err != nil {
+			return err
+		}
+		pms[i] = pm
+	}
+	return w.send(ctx, func() error {
+		return w.producer.SendMessages(pms)
+	})
+}
+
+// Close waits for the messages in flight and closes the producer.
+func (w *KafkaWriter) Close() {
+	log.Info("Closing KafkaWriter.")
+	err := w.producer.Close()
+	if err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// send runs produce until it returns or ctx is done.
+func (w *KafkaWriter) send(ctx context.Context, produce func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- produce()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// producerMessage builds the Kafka message, with the service, the request id and the principal (if any) as headers.
+func (w *KafkaWriter) producerMessage(msg Message) (*sarama.ProducerMessage, error) {
+	value, err := msg.Format(w.format)
+	if err != nil {
+		return nil, err
+	}
+	pm := &sarama.ProducerMessage{
+		Topic: w.topic.Execute(msg.ReceivedAt.UTC(), msg.Fields()),
+		Value: sarama.StringEncoder(value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("service"), Value: []byte(msg.Service)},
+			{Key: []byte("request_id"), Value: []byte(msg.RequestID)},
+		},
+	}
+	if msg.Principal != nil && msg.Principal.ID != "" {
+		pm.Headers = append(pm.Headers, sarama.RecordHeader{Key: []byte("principal"), Value: []byte(msg.Principal.ID)})
+	}
+	if !msg.ReceivedAt.IsZero() {
+		pm.Timestamp = msg.ReceivedAt
+	}
+	if key, ok := msg.Fields()[w.keyField]; ok && w.keyField != "" {
+		pm.Key = sarama.StringEncoder(key)
+	}
+	return pm, nil
+}
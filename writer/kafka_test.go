@@ -0,0 +1,137 @@
+package writer_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/efark/data-receiver/writer"
+	"testing"
+)
+
+// kafkaBroker starts a mock broker with the "events" topic in two partitions. Produce requests to partition 1 fail.
+func kafkaBroker(t *testing.T) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("events", 0, broker.BrokerID()).
+			SetLeader("events", 1, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3).
+			SetError("events", 1, sarama.ErrMessageSizeTooLarge),
+	})
+	return broker
+}
+
+// kafkaPartition returns the partition of the key with the default partitioner.
+func kafkaPartition(t *testing.T, key string) int32 {
+	p, err := sarama.NewHashPartitioner("events").Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(key)}, 2)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return p
+}
+
+// produceRequests counts the produce requests received by the broker.
+func produceRequests(broker *sarama.MockBroker) int {
+	var n int
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestKafkaWriter_Write(t *testing.T) {
+	broker := kafkaBroker(t)
+	defer broker.Close()
+
+	w, err := writer.NewKafkaWriter(map[string]string{
+		"brokers": broker.Addr(), "topic": "events", "key_field": "device", "retries": "0", "format": "json",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	// The delivery report of each message is the result of its write.
+	for _, device := range []string{"a", "b", "c", "d", "a"} {
+		msg := writer.Message{Service: "test", Extracted: map[string]string{"device": device}, Body: "test message"}
+		err = w.Write(context.Background(), msg)
+		failed := kafkaPartition(t, device) == 1
+		if failed != (err != nil) {
+			t.Log(fmt.Sprintf("Expected failure for device %s: %v, received: %v", device, failed, err))
+			t.Fail()
+		}
+	}
+	if n := produceRequests(broker); n != 5 {
+		t.Log(fmt.Sprintf("Expected produce requests: %v, received: %v", 5, n))
+		t.FailNow()
+	}
+}
+
+func TestKafkaWriter_WriteBatch(t *testing.T) {
+	broker := kafkaBroker(t)
+	defer broker.Close()
+
+	w, err := writer.NewKafkaWriter(map[string]string{
+		"brokers": broker.Addr(), "topic": "{service}", "key_field": "device", "acks": "leader",
+		"compression": "gzip", "linger": "50ms", "retries": "0",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	var msgs []writer.Message
+	for _, device := range []string{"a", "b", "c", "d"} {
+		if kafkaPartition(t, device) == 0 {
+			msgs = append(msgs, writer.Message{Service: "events", Extracted: map[string]string{"device": device}, Body: device})
+		}
+	}
+	err = w.WriteBatch(context.Background(), msgs)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// The linger groups the batch in a single request.
+	if n := produceRequests(broker); n != 1 {
+		t.Log(fmt.Sprintf("Expected produce requests: %v, received: %v", 1, n))
+		t.FailNow()
+	}
+
+	// A message to the failing partition fails the batch.
+	device := "x"
+	for kafkaPartition(t, device) != 1 {
+		device += "x"
+	}
+	msgs = append(msgs, writer.Message{Service: "events", Extracted: map[string]string{"device": device}, Body: device})
+	err = w.WriteBatch(context.Background(), msgs)
+	if err == nil {
+		t.Log("Expected an error.")
+		t.FailNow()
+	}
+}
+
+func TestNewKafkaWriter_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"topic": "events"},
+		{"brokers": "localhost:9092"},
+		{"brokers": "localhost:9092", "topic": "events", "acks": "some"},
+		{"brokers": "localhost:9092", "topic": "events", "compression": "brotli"},
+		{"brokers": "localhost:9092", "topic": "events", "linger": "soon"},
+		{"brokers": "localhost:9092", "topic": "events", "version": "latest"},
+		{"brokers": "localhost:9092", "topic": "events", "retries": "-1"},
+		{"brokers": "localhost:9092", "topic": "events", "compression": "zstd", "version": "1.0.0"},
+	}
+	for _, params := range tests {
+		_, err := writer.NewKafkaWriter(params)
+		if err == nil {
+			t.Log(fmt.Sprintf("Expected an error for params: %v", params))
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+/*
+This file has the adapter for the writers written against the original interface, that receive only the content.
+*/
+package writer
+
+import "context"
+
+// LegacyWriter is the original Writer interface, its Write method receives the content without a context.
+type LegacyWriter interface {
+	Write(content string) error
+	Close()
+}
+
+// LegacyAdapter makes a LegacyWriter implement Writer.
+type LegacyAdapter struct {
+	w      LegacyWriter
+	format string
+}
+
+// FromLegacy wraps a LegacyWriter so it can be used as a Writer, it receives the body of the messages as before.
+func FromLegacy(w LegacyWriter) *LegacyAdapter {
+	return FromLegacyWithFormat(w, FormatRaw)
+}
+
+// FromLegacyWithFormat wraps a LegacyWriter so it can be used as a Writer, it receives the messages in the given format.
+func FromLegacyWithFormat(w LegacyWriter, format string) *LegacyAdapter {
+	return &LegacyAdapter{w: w, format: format}
+}
+
+// Write formats the message and runs the legacy Write in its own goroutine, it returns when it finishes or when
+// the context is done. A legacy write can't be cancelled, so after a timeout it keeps running in the background
+// and its result is only logged.
+func (a *LegacyAdapter) Write(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	content, err := msg.Format(a.format)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- a.w.Write(content)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		go func() {
+			if err := <-result; err != nil {
+				slog.Error(err.Error())
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+// Close closes the legacy writer.
+func (a *LegacyAdapter) Close() {
+	a.w.Close()
+}
@@ -0,0 +1,82 @@
+package writer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"strings"
+	"testing"
+	"time"
+)
+
+// legacyWriter implements the original Writer interface, it takes delay to write every message.
+type legacyWriter struct {
+	delay    time.Duration
+	messages chan string
+}
+
+func (w *legacyWriter) Write(content string) error {
+	time.Sleep(w.delay)
+	w.messages <- content
+	return nil
+}
+
+func (w *legacyWriter) Close() {
+	close(w.messages)
+}
+
+func TestLegacyAdapter_Write(t *testing.T) {
+	legacy := &legacyWriter{messages: make(chan string, 1)}
+	var w writer.Writer = writer.FromLegacy(legacy)
+
+	err := w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+
+	content := <-legacy.messages
+	if content != "Test message." {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", "Test message.", content))
+		t.FailNow()
+	}
+}
+
+func TestLegacyAdapter_Format(t *testing.T) {
+	legacy := &legacyWriter{messages: make(chan string, 1)}
+	w := writer.FromLegacyWithFormat(legacy, writer.FormatJSON)
+
+	err := w.Write(context.Background(), writer.Message{Service: "test", Body: "Test message."})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+
+	content := <-legacy.messages
+	if !strings.Contains(content, `"service":"test"`) || !strings.Contains(content, `"body":"Test message."`) {
+		t.Log(fmt.Sprintf("Expected a Json envelope, received: %q", content))
+		t.FailNow()
+	}
+}
+
+func TestLegacyAdapter_Timeout(t *testing.T) {
+	legacy := &legacyWriter{delay: time.Second, messages: make(chan string, 1)}
+	w := writer.FromLegacy(legacy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := w.Write(ctx, writer.Message{Body: "Test message."})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", context.DeadlineExceeded, err))
+		t.FailNow()
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Log("Write didn't return when the deadline was exceeded.")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package writer
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens the file and takes an exclusive lock on it, it fails right away when another process has it.
+// The lock is released when the file is closed, or when the process ends.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,73 @@
+/*
+This file has the Message type, the envelope with the body and the metadata of a request that writers receive.
+*/
+package writer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/efark/data-receiver/authenticator"
+	"time"
+)
+
+// Formats accepted in the "format" parameter of the writers.
+const (
+	// FormatRaw keeps only the body of the message, it's the default.
+	FormatRaw = "raw"
+	// FormatJSON writes the whole envelope as a Json object.
+	FormatJSON = "json"
+)
+
+// Message is the envelope that writers receive, with the body of the request and its metadata.
+type Message struct {
+	Service    string            `json:"service"`
+	ReceivedAt time.Time         `json:"received_at"`
+	RemoteIP   string            `json:"remote_ip,omitempty"`
+	RequestID  string            `json:"request_id,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Extracted  map[string]string `json:"extracted,omitempty"`
+	// Principal is who sent the message, it's nil when the authenticator doesn't identify the senders.
+	Principal *authenticator.Principal `json:"principal,omitempty"`
+	Body      string                   `json:"body"`
+}
+
+// Format serializes the message: FormatRaw returns the body and FormatJSON the whole envelope.
+func (m Message) Format(format string) (string, error) {
+	switch format {
+	case "", FormatRaw:
+		return m.Body, nil
+	case FormatJSON:
+		b, err := json.Marshal(m)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("Format %q not supported.", format)
+	}
+}
+
+// Fields returns the values that templates can use: the extracted values, the service and the principal's ID.
+func (m Message) Fields() map[string]string {
+	fields := make(map[string]string, len(m.Extracted)+2)
+	for k, v := range m.Extracted {
+		fields[k] = v
+	}
+	fields["service"] = m.Service
+	if m.Principal != nil && m.Principal.ID != "" {
+		fields["principal"] = m.Principal.ID
+	}
+	return fields
+}
+
+// parseFormat validates the "format" parameter and returns FormatRaw when it's not set.
+func parseFormat(params map[string]string) (string, error) {
+	switch f := params["format"]; f {
+	case "", FormatRaw:
+		return FormatRaw, nil
+	case FormatJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("Format %q not supported.", f)
+	}
+}
@@ -0,0 +1,58 @@
+package writer_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"testing"
+	"time"
+)
+
+func TestMessage_Format(t *testing.T) {
+	msg := writer.Message{
+		Service:    "test",
+		ReceivedAt: time.Date(2020, 10, 16, 9, 30, 0, 0, time.UTC),
+		Extracted:  map[string]string{"user_id": "test_id"},
+		Body:       `{"hello": "world"}`,
+	}
+
+	raw, err := msg.Format(writer.FormatRaw)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if raw != msg.Body {
+		t.Log(fmt.Sprintf("Expected raw: %q, received: %q", msg.Body, raw))
+		t.FailNow()
+	}
+
+	wrapped, err := msg.Format(writer.FormatJSON)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	var decoded writer.Message
+	err = json.Unmarshal([]byte(wrapped), &decoded)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if decoded.Service != "test" || decoded.Body != msg.Body || decoded.Extracted["user_id"] != "test_id" || !decoded.ReceivedAt.Equal(msg.ReceivedAt) {
+		t.Log(fmt.Sprintf("Expected decoded: %+v, received: %+v", msg, decoded))
+		t.FailNow()
+	}
+
+	_, err = msg.Format("xml")
+	if err == nil {
+		t.Error("Expected error for unsupported format.")
+		t.FailNow()
+	}
+}
+
+func TestCreateWriter_InvalidFormat(t *testing.T) {
+	_, err := writer.CreateWriter("FileWriter", map[string]string{"filepath": "./test.txt", "format": "xml"})
+	if err == nil {
+		t.Error("Expected error for unsupported format.")
+		t.FailNow()
+	}
+}
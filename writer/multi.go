@@ -0,0 +1,143 @@
+/*
+This file has the MultiWriter, it sends every message to several writers.
+*/
+package writer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultBestEffortTimeout is how long a best effort write can take when the MultiWriter doesn't set a timeout.
+const defaultBestEffortTimeout = 10 * time.Second
+
+// defaultBestEffortConcurrency is how many writes a best effort writer can have in progress, the messages that
+// arrive when it has that many are dropped.
+const defaultBestEffortConcurrency = 100
+
+// MultiWriter writes every message to all its writers at the same time.
+// Only the required writers make Write wait and fail, the best effort ones run in the background
+// with their own timeout and their errors are logged. Each best effort writer has a limited number of writes in
+// progress, so a slow one can't pile up goroutines: when it's at the limit, the message is dropped for it and logged.
+type MultiWriter struct {
+	writers           []Writer
+	required          []bool
+	slots             []chan struct{}
+	bestEffortTimeout time.Duration
+	concurrency       int
+
+	mu      sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+}
+
+// NewMultiWriter returns an empty MultiWriter, writers are added with Add.
+func NewMultiWriter() *MultiWriter {
+	return NewMultiWriterWithLimits(defaultBestEffortTimeout, defaultBestEffortConcurrency)
+}
+
+// NewMultiWriterWithTimeout returns an empty MultiWriter whose best effort writes are cancelled after timeout.
+func NewMultiWriterWithTimeout(timeout time.Duration) *MultiWriter {
+	return NewMultiWriterWithLimits(timeout, defaultBestEffortConcurrency)
+}
+
+// NewMultiWriterWithLimits returns an empty MultiWriter whose best effort writes are cancelled after timeout,
+// with up to concurrency writes in progress for each best effort writer.
+func NewMultiWriterWithLimits(timeout time.Duration, concurrency int) *MultiWriter {
+	if timeout <= 0 {
+		timeout = defaultBestEffortTimeout
+	}
+	if concurrency <= 0 {
+		concurrency = defaultBestEffortConcurrency
+	}
+	return &MultiWriter{bestEffortTimeout: timeout, concurrency: concurrency}
+}
+
+// Add appends a writer, when required is false its errors don't fail the write and Write doesn't wait for it.
+func (m *MultiWriter) Add(w Writer, required bool) {
+	m.writers = append(m.writers, w)
+	m.required = append(m.required, required)
+	var slots chan struct{}
+	if !required {
+		slots = make(chan struct{}, m.concurrency)
+	}
+	m.slots = append(m.slots, slots)
+}
+
+// Write sends the message to all the writers concurrently and waits only for the required ones.
+// The best effort writes don't use the request's context, so they aren't cancelled when the request finishes.
+// It returns the error of the first required writer that failed.
+func (m *MultiWriter) Write(ctx context.Context, msg Message) error {
+	// pending.Add can't run at the same time as the pending.Wait of Close, so both are guarded by mu.
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	for i, w := range m.writers {
+		if m.required[i] {
+			continue
+		}
+		select {
+		case m.slots[i] <- struct{}{}:
+			m.pending.Add(1)
+			go m.writeBestEffort(i, w, msg)
+		default:
+			slog.Error(fmt.Sprintf("Best effort writer %d has %d writes in progress, message %q dropped for it.", i, m.concurrency, msg.RequestID))
+		}
+	}
+	// Close waits for the required writes too, so the writers aren't closed under them.
+	m.pending.Add(1)
+	m.mu.Unlock()
+	defer m.pending.Done()
+
+	errs := make([]error, len(m.writers))
+	var wg sync.WaitGroup
+	for i, w := range m.writers {
+		if !m.required[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, w Writer) {
+			defer wg.Done()
+			errs[i] = w.Write(ctx, msg)
+		}(i, w)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBestEffort writes the message to a best effort writer with its own timeout and logs the error.
+func (m *MultiWriter) writeBestEffort(i int, w Writer, msg Message) {
+	defer m.pending.Done()
+	defer func() { <-m.slots[i] }()
+	ctx, cancel := context.WithTimeout(context.Background(), m.bestEffortTimeout)
+	defer cancel()
+	err := w.Write(ctx, msg)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Best effort writer %d failed: %v", i, err))
+	}
+}
+
+// Close waits for the writes in progress and closes all the writers. Writes after Close fail with ErrClosed.
+func (m *MultiWriter) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	m.mu.Unlock()
+	m.pending.Wait()
+	for _, w := range m.writers {
+		w.Close()
+	}
+}
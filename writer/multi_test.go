@@ -0,0 +1,158 @@
+package writer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"testing"
+	"time"
+)
+
+// failingWriter fails every write with err.
+type failingWriter struct {
+	err    error
+	closed bool
+}
+
+func (w *failingWriter) Write(_ context.Context, _ writer.Message) error {
+	return w.err
+}
+
+func (w *failingWriter) Close() {
+	w.closed = true
+}
+
+func TestMultiWriter_Write(t *testing.T) {
+	m1, _ := writer.NewMemoryWriter()
+	m2, _ := writer.NewMemoryWriter()
+	failing := &failingWriter{err: errors.New("Write failed.")}
+
+	w := writer.NewMultiWriter()
+	w.Add(m1, true)
+	w.Add(m2, true)
+	w.Add(failing, false)
+
+	err := w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != nil {
+		t.Log(fmt.Sprintf("Expected best effort errors to be ignored, received: %v", err))
+		t.FailNow()
+	}
+
+	for _, m := range []*writer.MemoryWriter{m1, m2} {
+		ms := m.GetMessages()
+		if len(ms) != 1 || ms[0].Body != "Test message." {
+			t.Log(fmt.Sprintf("Expected one message in each MemoryWriter, received: %v", ms))
+			t.FailNow()
+		}
+	}
+
+	w.Close()
+	if !failing.closed {
+		t.Log("Expected all the writers to be closed.")
+		t.FailNow()
+	}
+}
+
+func TestMultiWriter_RequiredFails(t *testing.T) {
+	m, _ := writer.NewMemoryWriter()
+	failing := &failingWriter{err: errors.New("Write failed.")}
+
+	messages, cancel := m.Subscribe()
+	defer cancel()
+
+	w := writer.NewMultiWriter()
+	w.Add(m, false)
+	w.Add(failing, true)
+	defer w.Close()
+
+	err := w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != failing.err {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", failing.err, err))
+		t.FailNow()
+	}
+
+	// The other writers still get the message.
+	select {
+	case <-messages:
+	case <-time.After(time.Second):
+		t.Log("Expected the best effort writer to get the message.")
+		t.FailNow()
+	}
+}
+
+// hungWriter blocks every write until its context is done, and sends the context's error through errs.
+type hungWriter struct {
+	errs chan error
+}
+
+func (w *hungWriter) Write(ctx context.Context, _ writer.Message) error {
+	<-ctx.Done()
+	w.errs <- ctx.Err()
+	return ctx.Err()
+}
+
+func (w *hungWriter) Close() {}
+
+func TestMultiWriter_BestEffortDoesNotBlock(t *testing.T) {
+	m, _ := writer.NewMemoryWriter()
+	hung := &hungWriter{errs: make(chan error, 1)}
+
+	w := writer.NewMultiWriterWithTimeout(100 * time.Millisecond)
+	w.Add(m, true)
+	w.Add(hung, false)
+
+	start := time.Now()
+	err := w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Log("Write waited for the best effort writer.")
+		t.FailNow()
+	}
+
+	// The best effort write is cancelled by its own timeout, and Close waits for it.
+	w.Close()
+	select {
+	case err = <-hung.errs:
+	default:
+		t.Log("Expected Close to wait for the best effort write.")
+		t.FailNow()
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", context.DeadlineExceeded, err))
+		t.FailNow()
+	}
+}
+
+func TestMultiWriter_BestEffortLimit(t *testing.T) {
+	m, _ := writer.NewMemoryWriter()
+	hung := &hungWriter{errs: make(chan error, 3)}
+
+	w := writer.NewMultiWriterWithLimits(100*time.Millisecond, 1)
+	w.Add(m, true)
+	w.Add(hung, false)
+
+	// The best effort writer only gets the first message while its write is in progress, the required one gets all.
+	for i := 0; i < 3; i++ {
+		err := w.Write(context.Background(), writer.Message{Body: fmt.Sprintf("Test message %d.", i)})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	required := len(m.GetMessages())
+	w.Close()
+	if len(hung.errs) != 1 || required != 3 {
+		t.Log(fmt.Sprintf("Expected %d best effort and %d required writes, received: %d and %d", 1, 3, len(hung.errs), required))
+		t.FailNow()
+	}
+
+	err := w.Write(context.Background(), writer.Message{Body: "Late message."})
+	if err != writer.ErrClosed {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", writer.ErrClosed, err))
+		t.FailNow()
+	}
+}
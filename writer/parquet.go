@@ -0,0 +1,559 @@
+/*
+This file has the ParquetWriter, it converts Json bodies to rows of Parquet files.
+*/
+package writer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go/layout"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	parquetwriter "github.com/xitongsys/parquet-go/writer"
+)
+
+// Default values for the ParquetWriter parameters.
+const (
+	defaultParquetRowGroupSize = 10000
+	defaultParquetMaxSize      = 128 * 1024 * 1024
+	defaultParquetRotateEvery  = time.Hour
+	parquetFinishAttempts      = 3
+)
+
+// parquetTypes maps the types accepted in the schema to the type and converted type of the parquet-go metadata.
+var parquetTypes = map[string]string{
+	"string":    "type=BYTE_ARRAY, convertedtype=UTF8",
+	"boolean":   "type=BOOLEAN",
+	"int32":     "type=INT32",
+	"int64":     "type=INT64",
+	"float":     "type=FLOAT",
+	"double":    "type=DOUBLE",
+	"timestamp": "type=INT64, convertedtype=TIMESTAMP_MILLIS",
+}
+
+// parquetCodecs maps the compression values accepted in the configuration to the Parquet codecs.
+var parquetCodecs = map[string]parquet.CompressionCodec{
+	"none": parquet.CompressionCodec_UNCOMPRESSED, "snappy": parquet.CompressionCodec_SNAPPY,
+	"gzip": parquet.CompressionCodec_GZIP, "zstd": parquet.CompressionCodec_ZSTD,
+}
+
+// parquetColumn is a column of the schema.
+type parquetColumn struct {
+	name     string
+	typ      string
+	required bool
+}
+
+// parquetFile is a file being written by parquet-go. Rows are kept in memory until they fill a row group, and the file
+// has the .tmp suffix until it's finished with the footer and renamed. unfinished is set when finishing it failed,
+// so it's tried again. broken is set when a failed write couldn't be removed from the file, it can't be finished.
+type parquetFile struct {
+	path       string
+	file       *os.File
+	pw         *parquetwriter.CSVWriter
+	opened     time.Time
+	rows       [][]interface{}
+	written    int64
+	unfinished bool
+	broken     error
+}
+
+// osParquetFile lets parquet-go write to an *os.File. The writer never opens other files.
+type osParquetFile struct {
+	*os.File
+}
+
+func (f osParquetFile) Open(string) (source.ParquetFile, error) {
+	return nil, errors.New("Parquet files are only written.")
+}
+
+func (f osParquetFile) Create(string) (source.ParquetFile, error) {
+	return nil, errors.New("Parquet files are only written.")
+}
+
+// newParquetFile returns the file parquet-go writes to, tests replace it to make the writes fail.
+var newParquetFile = func(f *os.File) source.ParquetFile {
+	return osParquetFile{f}
+}
+
+// ParquetWriter converts every Json body to a row with the columns of the schema, and writes the rows to Parquet files.
+// Bodies that can't be converted go to the bad records file, if there's one.
+// Files are written with parquet-go in row groups, and finished when they reach max_size or rotate_every, or on Close.
+// Write acknowledges a row once it's in memory, before its row group is written: up to row_group_size acknowledged
+// rows of every file are lost if the process crashes. Keep row_group_size and rotate_every low when that matters.
+// A file that can't be finished stays open and is tried again, Close gives up after a few attempts and logs the rows lost.
+type ParquetWriter struct {
+	template     *pathTemplate
+	columns      []parquetColumn
+	codec        parquet.CompressionCodec
+	rowGroupSize int
+	maxSize      int64
+	rotateEvery  time.Duration
+	badRecords   *FileWriter
+
+	mu     sync.Mutex
+	files  map[string]*parquetFile
+	closed bool
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// NewParquetWriter creates the writer from its parameters: filepath, schema, compression (snappy by default, none,
+// gzip or zstd), row_group_size (rows), max_size (bytes), rotate_every and bad_records_path.
+// The schema is a comma separated list of name:type columns, with :required at the end of the required ones.
+// The filepath is a template like the PartitionedFileWriter ones, that can also use {object_id}, a random id.
+// Its time is the one of the first row of the file.
+func NewParquetWriter(params map[string]string) (*ParquetWriter, error) {
+	if params["filepath"] == "" {
+		return nil, errors.New("filepath not received for ParquetWriter.")
+	}
+	template, err := parseTemplate(params["filepath"])
+	if err != nil {
+		return nil, err
+	}
+	columns, err := parseParquetSchema(params["schema"])
+	if err != nil {
+		return nil, err
+	}
+	w := &ParquetWriter{
+		template:     template,
+		columns:      columns,
+		codec:        parquet.CompressionCodec_SNAPPY,
+		rowGroupSize: defaultParquetRowGroupSize,
+		maxSize:      defaultParquetMaxSize,
+		rotateEvery:  defaultParquetRotateEvery,
+		files:        make(map[string]*parquetFile),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if v, ok := params["compression"]; ok {
+		codec, ok := parquetCodecs[v]
+		if !ok {
+			return nil, fmt.Errorf("Compression %q not supported.", v)
+		}
+		w.codec = codec
+	}
+	w.rowGroupSize, err = intParam(params, "row_group_size", defaultParquetRowGroupSize)
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := intParam(params, "max_size", defaultParquetMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	w.maxSize = int64(maxSize)
+	if v, ok := params["rotate_every"]; ok {
+		w.rotateEvery, err = time.ParseDuration(v)
+		if err != nil || w.rotateEvery <= 0 {
+			return nil, fmt.Errorf("Invalid rotate_every %q.", v)
+		}
+	}
+	if v := params["bad_records_path"]; v != "" {
+		w.badRecords, err = NewFileWriterWithOptions(v, FileWriterOptions{Format: FormatJSON, AckMode: AckWritten})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go w.rotateOld()
+	log.Info(fmt.Sprintf("Starting ParquetWriter with %d columns.", len(w.columns)))
+	return w, nil
+}
+
+// parseParquetSchema parses a schema like "id:int64:required,name:string,created:timestamp".
+func parseParquetSchema(schema string) ([]parquetColumn, error) {
+	if strings.TrimSpace(schema) == "" {
+		return nil, errors.New("schema not received for ParquetWriter.")
+	}
+	var columns []parquetColumn
+	names := make(map[string]bool)
+	for _, def := range strings.Split(schema, ",") {
+		parts := strings.Split(strings.TrimSpace(def), ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || (len(parts) == 3 && parts[2] != "required") {
+			return nil, fmt.Errorf("Invalid column %q, it must be name:type or name:type:required.", def)
+		}
+		_, ok := parquetTypes[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("Invalid type %q for column %q.", parts[1], parts[0])
+		}
+		// parquet-go capitalizes the names internally, so "id" and "Id" would be the same column.
+		key := strings.ToUpper(parts[0][:1]) + parts[0][1:]
+		if names[key] {
+			return nil, fmt.Errorf("Column %q is repeated.", parts[0])
+		}
+		if strings.Contains(parts[0], "=") {
+			return nil, fmt.Errorf("Invalid column name %q.", parts[0])
+		}
+		names[key] = true
+		columns = append(columns, parquetColumn{name: parts[0], typ: parts[1], required: len(parts) == 3})
+	}
+	return columns, nil
+}
+
+// Write converts the body to a row and adds it to its file, it returns before the row is on the disk unless the row
+// fills a row group. Bodies that can't be converted go to the bad records file, the write fails when there's
+// no bad records file or it fails. If the row group can't be written, the row is dropped and the write fails,
+// the rows before it stay in memory for the next attempt.
+func (w *ParquetWriter) Write(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	row, err := w.convert(msg.Body)
+	if err != nil {
+		if w.badRecords == nil {
+			return err
+		}
+		slog.Error(fmt.Sprintf("Message %q sent to the bad records file: %v", msg.RequestID, err))
+		return w.badRecords.Write(ctx, msg)
+	}
+
+	fields := msg.Fields()
+	// Rows whose path only differs in the time go to the same file, named after the first row.
+	partition := w.template.Execute(time.Time{}, fields)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	f, ok := w.files[partition]
+	if !ok {
+		f, err = w.open(msg, fields)
+		if err != nil {
+			return err
+		}
+		w.files[partition] = f
+	}
+	f.rows = append(f.rows, row)
+	if len(f.rows) < w.rowGroupSize {
+		return nil
+	}
+	err = w.writeRowGroup(f)
+	if err != nil {
+		f.rows = f.rows[:len(f.rows)-1]
+		return err
+	}
+	if f.pw.Offset >= w.maxSize {
+		// The row is already in the file, a failure to finish it is retried by rotateOld.
+		w.finishOrKeep(partition, f)
+	}
+	return nil
+}
+
+// Close finishes all the files. A file that can't be finished after a few attempts is removed, and its rows logged as lost.
+func (w *ParquetWriter) Close() {
+	log.Info("Closing ParquetWriter.")
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.quit)
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for partition, f := range w.files {
+		backoff := defaultRetryBackoff
+		for attempt := 1; ; attempt++ {
+			err := w.finish(f)
+			if err == nil {
+				break
+			}
+			slog.Error(err.Error())
+			if f.broken != nil || attempt == parquetFinishAttempts {
+				w.discard(f)
+				break
+			}
+			time.Sleep(jitter(backoff))
+			backoff *= 2
+		}
+		delete(w.files, partition)
+	}
+	if w.badRecords != nil {
+		w.badRecords.Close()
+	}
+}
+
+// rotateOld finishes the files older than rotateEvery, and tries again the ones that couldn't be finished, until Close.
+func (w *ParquetWriter) rotateOld() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.rotateEvery / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			limit := time.Now().Add(-w.rotateEvery)
+			w.mu.Lock()
+			for partition, f := range w.files {
+				if f.unfinished || f.opened.Before(limit) {
+					w.finishOrKeep(partition, f)
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// finishOrKeep finishes the file and removes it from the map. If it fails the file stays in the map, so it's tried
+// again, unless it's broken: then it's discarded. It must be called holding mu.
+func (w *ParquetWriter) finishOrKeep(partition string, f *parquetFile) {
+	err := w.finish(f)
+	if err == nil {
+		delete(w.files, partition)
+		return
+	}
+	slog.Error(err.Error())
+	if f.broken != nil {
+		w.discard(f)
+		delete(w.files, partition)
+		return
+	}
+	f.unfinished = true
+}
+
+// discard closes and removes the temporary file that couldn't be finished, logging the rows lost with it.
+func (w *ParquetWriter) discard(f *parquetFile) {
+	f.file.Close()
+	err := os.Remove(f.path + ".tmp")
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error(err.Error())
+	}
+	slog.Error(fmt.Sprintf("Parquet file %q discarded, %d rows are lost.", f.path, f.written+int64(len(f.rows))))
+}
+
+// convert returns the values of the columns in the Json body.
+func (w *ParquetWriter) convert(body string) ([]interface{}, error) {
+	var record map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(body))
+	d.UseNumber()
+	err := d.Decode(&record)
+	if err != nil {
+		return nil, fmt.Errorf("Body is not a Json object: %v", err)
+	}
+
+	row := make([]interface{}, len(w.columns))
+	for i, col := range w.columns {
+		v := record[col.name]
+		if v == nil {
+			if col.required {
+				return nil, fmt.Errorf("Column %q is required.", col.name)
+			}
+			continue
+		}
+		row[i], err = parquetValue(col, v)
+		if err != nil {
+			return nil, fmt.Errorf("Column %q: %v", col.name, err)
+		}
+	}
+	return row, nil
+}
+
+// parquetValue converts a Json value to the Go type parquet-go uses for the column.
+func parquetValue(col parquetColumn, v interface{}) (interface{}, error) {
+	switch col.typ {
+	case "timestamp":
+		switch t := v.(type) {
+		case string:
+			ts, err := time.Parse(time.RFC3339Nano, t)
+			if err != nil {
+				return nil, err
+			}
+			return ts.UnixNano() / int64(time.Millisecond), nil
+		case json.Number:
+			return t.Int64()
+		}
+		return nil, fmt.Errorf("%v is not a timestamp.", v)
+	case "string":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "int32", "int64":
+		if n, ok := v.(json.Number); ok {
+			i, err := n.Int64()
+			if err != nil {
+				return nil, err
+			}
+			if col.typ == "int64" {
+				return i, nil
+			}
+			if i < math.MinInt32 || i > math.MaxInt32 {
+				return nil, fmt.Errorf("%d is out of the int32 range.", i)
+			}
+			return int32(i), nil
+		}
+	case "float", "double":
+		if n, ok := v.(json.Number); ok {
+			f, err := n.Float64()
+			if err != nil {
+				return nil, err
+			}
+			if col.typ == "double" {
+				return f, nil
+			}
+			return float32(f), nil
+		}
+	}
+	return nil, fmt.Errorf("%v doesn't match the column type.", v)
+}
+
+// open creates the file for the message, with the .tmp suffix and the magic number.
+func (w *ParquetWriter) open(msg Message, fields map[string]string) (*parquetFile, error) {
+	fields["object_id"] = randomID()
+	ts := msg.ReceivedAt
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	path := w.template.Execute(ts.UTC(), fields)
+	if fileExists(path) {
+		ext := filepath.Ext(path)
+		path = strings.TrimSuffix(path, ext) + "-" + randomID() + ext
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := parquetwriter.NewCSVWriter(w.metadata(), newParquetFile(file), 1)
+	if err != nil {
+		file.Close()
+		os.Remove(path + ".tmp")
+		return nil, err
+	}
+	pw.CompressionType = w.codec
+	// Row groups are only written by writeRowGroup, every rowGroupSize rows.
+	pw.RowGroupSize = math.MaxInt64
+	return &parquetFile{path: path, file: file, pw: pw, opened: time.Now()}, nil
+}
+
+// metadata returns the schema of the files in the format of parquet-go's CSVWriter.
+func (w *ParquetWriter) metadata() []string {
+	md := make([]string, len(w.columns))
+	for i, col := range w.columns {
+		repetition := "OPTIONAL"
+		if col.required {
+			repetition = "REQUIRED"
+		}
+		md[i] = fmt.Sprintf("name=%s, %s, repetitiontype=%s", col.name, parquetTypes[col.typ], repetition)
+	}
+	return md
+}
+
+// writeRowGroup writes the rows in memory as a row group. parquet-go can't undo a failed row group, so the state
+// of its writer is saved before and restored on failure, and the file is truncated back to the start of the group.
+// The rows stay in memory for the next attempt. When the file can't be truncated, it's marked as broken.
+func (w *ParquetWriter) writeRowGroup(f *parquetFile) error {
+	if f.broken != nil {
+		return f.broken
+	}
+	if len(f.rows) == 0 {
+		return nil
+	}
+	pw := f.pw
+	offset, numRows, groups, indexes := pw.Offset, pw.Footer.NumRows, len(pw.Footer.RowGroups), len(pw.ColumnIndexes)
+
+	var err error
+	for _, row := range f.rows {
+		if err = pw.Write(row); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = pw.Flush(true)
+	}
+	if err != nil {
+		pw.Offset, pw.Footer.NumRows, pw.Footer.RowGroups = offset, numRows, pw.Footer.RowGroups[:groups]
+		pw.ColumnIndexes, pw.OffsetIndexes = pw.ColumnIndexes[:indexes], pw.OffsetIndexes[:indexes]
+		pw.Objs, pw.ObjsSize, pw.CheckSizeCritical, pw.Size, pw.NumRows = pw.Objs[:0], 0, 0, 0, 0
+		pw.PagesMapBuf = make(map[string][]*layout.Page)
+		pw.DictRecs = make(map[string]*layout.DictRecType)
+		w.truncate(f, offset)
+		return fmt.Errorf("Row group of Parquet file %q couldn't be written: %v", f.path, err)
+	}
+	f.written += int64(len(f.rows))
+	f.rows = f.rows[:0]
+	return nil
+}
+
+// truncate removes everything after offset from the file, or marks the file as broken.
+func (w *ParquetWriter) truncate(f *parquetFile, offset int64) {
+	err := f.file.Truncate(offset)
+	if err == nil {
+		_, err = f.file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.broken = fmt.Errorf("Parquet file %q is broken, a failed write couldn't be removed: %v", f.path, err)
+		slog.Error(f.broken.Error())
+	}
+}
+
+// finish writes the last row group and the footer, and renames the file to its final path.
+// If the footer can't be written, it's removed from the file so finish can be called again.
+func (w *ParquetWriter) finish(f *parquetFile) error {
+	err := w.writeRowGroup(f)
+	if err != nil {
+		return err
+	}
+
+	// WriteStop renames the paths of the column chunks, they're saved to call it again after a failure.
+	pw := f.pw
+	offset := pw.Offset
+	var paths [][]string
+	for _, group := range pw.Footer.RowGroups {
+		for _, chunk := range group.Columns {
+			paths = append(paths, append([]string(nil), chunk.MetaData.PathInSchema...))
+		}
+	}
+	err = pw.WriteStop()
+	if err == nil {
+		err = f.file.Sync()
+	}
+	if err != nil {
+		pw.Offset = offset
+		i := 0
+		for _, group := range pw.Footer.RowGroups {
+			for _, chunk := range group.Columns {
+				chunk.MetaData.PathInSchema = paths[i]
+				i++
+			}
+		}
+		w.truncate(f, offset)
+		return fmt.Errorf("Parquet file %q couldn't be finished: %v", f.path, err)
+	}
+
+	err = f.file.Close()
+	if err == nil {
+		err = os.Rename(f.path+".tmp", f.path)
+	}
+	if err != nil {
+		f.broken = fmt.Errorf("Parquet file %q couldn't be finished: %v", f.path, err)
+		return f.broken
+	}
+	log.Info(fmt.Sprintf("Finished Parquet file %q with %d rows.", f.path, f.written))
+	return nil
+}
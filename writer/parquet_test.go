@@ -0,0 +1,409 @@
+package writer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parquetRows returns the number of rows of the file, read with parquet-go.
+func parquetRows(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r, err := reader.NewParquetColumnReader(parquetSource{f}, 1)
+	if err != nil {
+		return 0, err
+	}
+	defer r.ReadStop()
+	return r.GetNumRows(), nil
+}
+
+// parquetFiles returns the finished files in the directory.
+func parquetFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, ".parquet") {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return files
+}
+
+func TestParquetWriter_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := writer.NewParquetWriter(map[string]string{
+		"filepath":         filepath.Join(dir, "{service}/{yyyy-MM-dd}/events.parquet"),
+		"schema":           "id:int64:required,name:string,score:double,active:boolean,created:timestamp",
+		"row_group_size":   "2",
+		"bad_records_path": filepath.Join(dir, "bad.jsonl"),
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	bodies := []string{
+		`{"id": 1, "name": "a", "score": 1.5, "active": true, "created": "2021-03-04T05:06:07Z"}`,
+		`{"id": 2, "name": null}`,
+		`{"name": "no id"}`,
+		`{"id": "three"}`,
+		`not json`,
+		`{"id": 4, "created": 1614834367000, "extra": [1, 2]}`,
+		`{"id": 5, "active": false}`,
+	}
+	for _, body := range bodies {
+		err = w.Write(context.Background(), writer.Message{Service: "test", ReceivedAt: ts, Body: body})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	// The file is only in its final path when it's finished.
+	path := filepath.Join(dir, "test/2021-03-04/events.parquet")
+	if fileExists(path) {
+		t.Log("Expected the file to be finished on Close.")
+		t.FailNow()
+	}
+	w.Close()
+
+	rows, err := parquetRows(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if rows != 4 {
+		t.Log(fmt.Sprintf("Expected rows: %d, received: %d", 4, rows))
+		t.FailNow()
+	}
+
+	bad, err := ioutil.ReadFile(filepath.Join(dir, "bad.jsonl"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if lines := strings.Count(string(bad), "\n"); lines != 3 || !strings.Contains(string(bad), `"body":"not json"`) {
+		t.Log(fmt.Sprintf("Expected 3 bad records, received: %q", bad))
+		t.FailNow()
+	}
+}
+
+func TestParquetWriter_BadRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := writer.NewParquetWriter(map[string]string{"filepath": filepath.Join(dir, "events.parquet"), "schema": "id:int32"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	// Without a bad records file, the write fails.
+	err = w.Write(context.Background(), writer.Message{Body: `{"id": 3000000000}`})
+	if err == nil {
+		t.Log("Expected an error.")
+		t.FailNow()
+	}
+}
+
+func TestParquetWriter_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := writer.NewParquetWriter(map[string]string{
+		"filepath": filepath.Join(dir, "{HH}{mm}{ss}-{object_id}.parquet"), "schema": "id:int64",
+		"compression": "zstd", "row_group_size": "2", "max_size": "1", "rotate_every": "100ms",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	// Every row group fills a file.
+	for i := 0; i < 5; i++ {
+		err = w.Write(context.Background(), writer.Message{Body: fmt.Sprintf(`{"id": %d}`, i)})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	if files := parquetFiles(t, dir); len(files) != 2 {
+		t.Log(fmt.Sprintf("Expected files: %d, received: %v", 2, files))
+		t.FailNow()
+	}
+
+	// The last row is written when the file is rotated by time.
+	var files []string
+	for i := 0; i < 100; i++ {
+		files = parquetFiles(t, dir)
+		if len(files) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var total int64
+	for _, f := range files {
+		rows, err := parquetRows(f)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		total += rows
+	}
+	if len(files) != 3 || total != 5 {
+		t.Log(fmt.Sprintf("Expected %d files and %d rows, received: %v and %d", 3, 5, files, total))
+		t.FailNow()
+	}
+}
+
+func TestNewParquetWriter_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"schema": "id:int64"},
+		{"filepath": "events.parquet"},
+		{"filepath": "events.parquet", "schema": "id"},
+		{"filepath": "events.parquet", "schema": "id:uuid"},
+		{"filepath": "events.parquet", "schema": "id:int64:optional"},
+		{"filepath": "events.parquet", "schema": "id:int64,id:string"},
+		{"filepath": "events.parquet", "schema": "id:int64", "compression": "lzo"},
+		{"filepath": "events.parquet", "schema": "id:int64", "row_group_size": "0"},
+		{"filepath": "events.parquet", "schema": "id:int64", "rotate_every": "daily"},
+	}
+	for _, params := range tests {
+		_, err := writer.NewParquetWriter(params)
+		if err == nil {
+			t.Log(fmt.Sprintf("Expected an error for params: %v", params))
+			t.Fail()
+		}
+	}
+}
+
+// parquetSource opens a file for the reader of xitongsys/parquet-go.
+type parquetSource struct {
+	*os.File
+}
+
+func (s parquetSource) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = s.Name()
+	}
+	f, err := os.Open(name)
+	return parquetSource{f}, err
+}
+
+func (s parquetSource) Create(string) (source.ParquetFile, error) {
+	return nil, errors.New("Read only.")
+}
+
+func TestParquetWriter_ReadBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	bodies := []string{
+		`{"id": 1, "name": "a", "count": 10, "ratio": 0.5, "score": 1.5, "active": true, "created": "2021-03-04T05:06:07Z"}`,
+		`{"id": 2, "name": null, "active": false}`,
+		`{"id": 3, "name": "ñandú", "count": -2147483648, "score": -0.25}`,
+		`{"id": 4, "created": 1614834367000, "active": true}`,
+		`{"id": 5, "name": "", "ratio": 2.25}`,
+	}
+	expected := [][]interface{}{
+		{int64(1), int64(2), int64(3), int64(4), int64(5)},
+		{"a", nil, "ñandú", nil, ""},
+		{int32(10), nil, int32(-2147483648), nil, nil},
+		{float32(0.5), nil, nil, nil, float32(2.25)},
+		{1.5, nil, -0.25, nil, nil},
+		{true, false, nil, true, nil},
+		{int64(1614834367000), nil, nil, int64(1614834367000), nil},
+	}
+
+	// Every codec, with several row groups and a last one that isn't full.
+	for _, codec := range []string{"none", "snappy", "gzip", "zstd"} {
+		path := filepath.Join(dir, codec+".parquet")
+		w, err := writer.NewParquetWriter(map[string]string{
+			"filepath":       path,
+			"schema":         "id:int64:required,name:string,count:int32,ratio:float,score:double,active:boolean,created:timestamp",
+			"compression":    codec,
+			"row_group_size": "2",
+		})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		for _, body := range bodies {
+			err = w.Write(context.Background(), writer.Message{Body: body})
+			if err != nil {
+				t.Error(err)
+				t.FailNow()
+			}
+		}
+		w.Close()
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		r, err := reader.NewParquetColumnReader(parquetSource{f}, 1)
+		if err != nil {
+			f.Close()
+			t.Error(err)
+			t.FailNow()
+		}
+		if r.GetNumRows() != int64(len(bodies)) || len(r.Footer.RowGroups) != 3 {
+			t.Log(fmt.Sprintf("Expected %d rows in %d row groups with %s, received: %d in %d", len(bodies), 3, codec,
+				r.GetNumRows(), len(r.Footer.RowGroups)))
+			t.Fail()
+		}
+		schema := r.Footer.Schema
+		if schema[2].GetConvertedType() != parquet.ConvertedType_UTF8 || schema[7].GetConvertedType() != parquet.ConvertedType_TIMESTAMP_MILLIS ||
+			schema[1].GetRepetitionType() != parquet.FieldRepetitionType_REQUIRED || schema[2].GetRepetitionType() != parquet.FieldRepetitionType_OPTIONAL {
+			t.Log(fmt.Sprintf("Unexpected schema with %s: %v", codec, schema))
+			t.Fail()
+		}
+		for i, column := range expected {
+			values, _, _, err := r.ReadColumnByIndex(int64(i), int64(len(bodies)))
+			if err != nil {
+				t.Error(err)
+				t.Fail()
+				continue
+			}
+			if fmt.Sprintf("%#v", values) != fmt.Sprintf("%#v", column) {
+				t.Log(fmt.Sprintf("Expected column %d with %s: %#v, received: %#v", i, codec, column, values))
+				t.Fail()
+			}
+		}
+		r.ReadStop()
+		f.Close()
+	}
+}
+
+func TestParquetWriter_WriteErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	restore := writer.FailParquetWrites(0)
+	defer restore()
+	path := filepath.Join(dir, "events.parquet")
+	w, err := writer.NewParquetWriter(map[string]string{"filepath": path, "schema": "id:int64:required,name:string", "row_group_size": "2"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	write := func(id int) error {
+		return w.Write(context.Background(), writer.Message{Body: fmt.Sprintf(`{"id": %d, "name": "row %d"}`, id, id)})
+	}
+
+	err = write(1)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// The row group fails, the row that filled it is dropped and the one before stays for the next attempt.
+	writer.FailParquetWrites(1)
+	if write(2) == nil {
+		t.Log("Expected an error for the failed row group.")
+		t.FailNow()
+	}
+	for id := 2; id <= 4; id++ {
+		err = write(id)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	// Writing the footer fails once, Close tries again.
+	writer.FailParquetWrites(1)
+	w.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer f.Close()
+	r, err := reader.NewParquetColumnReader(parquetSource{f}, 1)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer r.ReadStop()
+	values, _, _, err := r.ReadColumnByIndex(0, r.GetNumRows())
+	if err != nil || fmt.Sprint(values) != "[1 2 3 4]" {
+		t.Log(fmt.Sprintf("Expected ids: %v, received: %v, %v", "[1 2 3 4]", values, err))
+		t.FailNow()
+	}
+}
+
+func TestParquetWriter_Discard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	restore := writer.FailParquetWrites(0)
+	defer restore()
+	path := filepath.Join(dir, "events.parquet")
+	w, err := writer.NewParquetWriter(map[string]string{"filepath": path, "schema": "id:int64"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = w.Write(context.Background(), writer.Message{Body: `{"id": 1}`})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// The file can't be finished, Close gives up and removes it.
+	writer.FailParquetWrites(1000)
+	w.Close()
+	if fileExists(path) || fileExists(path+".tmp") {
+		t.Log("Expected the file that couldn't be finished to be removed.")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,211 @@
+/*
+This file has the PartitionedFileWriter, it writes messages into files whose path depends on the time and the message fields.
+*/
+package writer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default values for the PartitionedFileWriter parameters.
+const (
+	defaultMaxOpenFiles = 16
+	defaultIdleTimeout  = 5 * time.Minute
+)
+
+// PartitionedFileWriter writes each message to the file rendered from a path template,
+// like "/data/{service}/dt={yyyy-MM-dd}/hour={HH}/part.jsonl". Field placeholders take the service or an extracted value.
+// It keeps an LRU of open files, the least recently used one is closed when there are too many,
+// and the ones that weren't written for idleTimeout are closed in the background.
+type PartitionedFileWriter struct {
+	template    *pathTemplate
+	format      string
+	maxOpen     int
+	idleTimeout time.Duration
+
+	mu         sync.Mutex
+	partitions map[string]*list.Element
+	lru        *list.List
+	closed     bool
+	quit       chan bool
+	done       chan bool
+}
+
+// partition is an open file of the PartitionedFileWriter.
+type partition struct {
+	path      string
+	file      *os.File
+	lastWrite time.Time
+}
+
+// NewPartitionedFileWriter creates the writer from its parameters: filepath (the template), format,
+// max_open_files and idle_timeout.
+func NewPartitionedFileWriter(params map[string]string) (*PartitionedFileWriter, error) {
+	tmpl, err := parseTemplate(params["filepath"])
+	if err != nil {
+		return nil, err
+	}
+	if len(tmpl.parts) == 0 {
+		return nil, errors.New("filepath not received for PartitionedFileWriter.")
+	}
+
+	format, err := parseFormat(params)
+	if err != nil {
+		return nil, err
+	}
+
+	maxOpen := defaultMaxOpenFiles
+	if v, ok := params["max_open_files"]; ok {
+		maxOpen, err = strconv.Atoi(v)
+		if err != nil || maxOpen < 1 {
+			return nil, fmt.Errorf("Invalid max_open_files %q.", v)
+		}
+	}
+	idleTimeout := defaultIdleTimeout
+	if v, ok := params["idle_timeout"]; ok {
+		idleTimeout, err = time.ParseDuration(v)
+		if err != nil || idleTimeout <= 0 {
+			return nil, fmt.Errorf("Invalid idle_timeout %q.", v)
+		}
+	}
+
+	w := &PartitionedFileWriter{
+		template:    tmpl,
+		format:      format,
+		maxOpen:     maxOpen,
+		idleTimeout: idleTimeout,
+		partitions:  make(map[string]*list.Element),
+		lru:         list.New(),
+		quit:        make(chan bool),
+		done:        make(chan bool),
+	}
+	go w.closeIdle()
+
+	log.Info("Starting PartitionedFileWriter.")
+	return w, nil
+}
+
+// Write appends the message to the file of its partition, the time placeholders use the time it was received.
+func (w *PartitionedFileWriter) Write(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	content, err := msg.Format(w.format)
+	if err != nil {
+		return err
+	}
+	path := w.template.Execute(msg.ReceivedAt.UTC(), msg.Fields())
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	p, err := w.get(path)
+	if err != nil {
+		return err
+	}
+
+	var newline string
+	if !strings.HasSuffix(content, "\n") {
+		newline = "\n"
+	}
+	_, err = p.file.WriteString(content + newline)
+	p.lastWrite = time.Now()
+	return err
+}
+
+// Close stops the background routine and closes all the open files, closing it again does nothing.
+func (w *PartitionedFileWriter) Close() {
+	log.Info("Closing PartitionedFileWriter.")
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.quit)
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.lru.Len() > 0 {
+		w.closePartition(w.lru.Back())
+	}
+}
+
+// get returns the open partition for the path, opening it and creating its directory when needed.
+// It must be called holding the mutex.
+func (w *PartitionedFileWriter) get(path string) (*partition, error) {
+	if e, ok := w.partitions[path]; ok {
+		w.lru.MoveToFront(e)
+		return e.Value.(*partition), nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, _, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &partition{path: path, file: file}
+	w.partitions[path] = w.lru.PushFront(p)
+	for w.lru.Len() > w.maxOpen {
+		w.closePartition(w.lru.Back())
+	}
+	return p, nil
+}
+
+// closePartition closes the file and removes it from the LRU. It must be called holding the mutex.
+func (w *PartitionedFileWriter) closePartition(e *list.Element) {
+	p := w.lru.Remove(e).(*partition)
+	delete(w.partitions, p.path)
+	err := p.file.Close()
+	if err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// closeIdle periodically closes the partitions that weren't written for idleTimeout.
+func (w *PartitionedFileWriter) closeIdle() {
+	ticker := time.NewTicker(w.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.quit:
+			w.done <- true
+			return
+		case <-ticker.C:
+			limit := time.Now().Add(-w.idleTimeout)
+			w.mu.Lock()
+			// The LRU is sorted by last write, so the idle partitions are at the back.
+			for e := w.lru.Back(); e != nil && e.Value.(*partition).lastWrite.Before(limit); e = w.lru.Back() {
+				w.closePartition(e)
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// OpenFiles returns the number of partitions that are currently open.
+func (w *PartitionedFileWriter) OpenFiles() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lru.Len()
+}
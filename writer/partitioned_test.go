@@ -0,0 +1,188 @@
+package writer_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPartitionedFileWriter_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitioned")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	params := map[string]string{"filepath": filepath.Join(dir, "{service}/dt={yyyy-MM-dd}/hour={HH}/{user_id}.jsonl")}
+	w, err := writer.NewPartitionedFileWriter(params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	receivedAt := time.Date(2020, 10, 16, 9, 30, 0, 0, time.UTC)
+	extracted := map[string]string{"user_id": "test_id"}
+	err = w.Write(context.Background(), writer.Message{Service: "test", ReceivedAt: receivedAt, Extracted: extracted, Body: "Test message 1."})
+	if err != nil {
+		t.Error(err)
+		t.Fail()
+	}
+	err = w.Write(context.Background(), writer.Message{Service: "test", ReceivedAt: receivedAt, Extracted: extracted, Body: "Test message 2."})
+	if err != nil {
+		t.Error(err)
+		t.Fail()
+	}
+	w.Close()
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "test", "dt=2020-10-16", "hour=09", "test_id.jsonl"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(content) != "Test message 1.\nTest message 2.\n" {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", "Test message 1.\nTest message 2.\n", string(content)))
+		t.FailNow()
+	}
+}
+
+func TestPartitionedFileWriter_SanitizeFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitioned")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	params := map[string]string{"filepath": filepath.Join(dir, "{user_id}.jsonl")}
+	w, err := writer.NewPartitionedFileWriter(params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = w.Write(context.Background(), writer.Message{Extracted: map[string]string{"user_id": "../test"}, Body: "Test message."})
+	if err != nil {
+		t.Error(err)
+		t.Fail()
+	}
+	w.Close()
+
+	if !fileExists(filepath.Join(dir, ".._test.jsonl")) {
+		t.Log("Expected the separators in the field to be replaced.")
+		t.FailNow()
+	}
+}
+
+func TestPartitionedFileWriter_MaxOpenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitioned")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	params := map[string]string{"filepath": filepath.Join(dir, "{service}.jsonl"), "max_open_files": "2"}
+	w, err := writer.NewPartitionedFileWriter(params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	for _, s := range []string{"a", "b", "c", "a"} {
+		err = w.Write(context.Background(), writer.Message{Service: s, Body: "Test message."})
+		if err != nil {
+			t.Error(err)
+			t.Fail()
+		}
+	}
+	if w.OpenFiles() != 2 {
+		t.Log(fmt.Sprintf("Expected OpenFiles(): %d, received: %d", 2, w.OpenFiles()))
+		t.FailNow()
+	}
+
+	// Reopened partitions keep appending to the same file.
+	content, err := ioutil.ReadFile(filepath.Join(dir, "a.jsonl"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(content) != "Test message.\nTest message.\n" {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", "Test message.\nTest message.\n", string(content)))
+		t.FailNow()
+	}
+}
+
+func TestPartitionedFileWriter_CloseIdle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitioned")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	params := map[string]string{"filepath": filepath.Join(dir, "part.jsonl"), "idle_timeout": "20ms"}
+	w, err := writer.NewPartitionedFileWriter(params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	err = w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != nil {
+		t.Error(err)
+		t.Fail()
+	}
+	if w.OpenFiles() != 1 {
+		t.Log(fmt.Sprintf("Expected OpenFiles(): %d, received: %d", 1, w.OpenFiles()))
+		t.FailNow()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if w.OpenFiles() != 0 {
+		t.Log(fmt.Sprintf("Expected OpenFiles(): %d, received: %d", 0, w.OpenFiles()))
+		t.FailNow()
+	}
+}
+
+func TestNewPartitionedFileWriter_InvalidTemplate(t *testing.T) {
+	_, err := writer.NewPartitionedFileWriter(map[string]string{"filepath": "/data/{service/part.jsonl"})
+	if err == nil {
+		t.Error("Expected error for unclosed placeholder.")
+		t.FailNow()
+	}
+}
+
+func TestPartitionedFileWriter_WriteAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitioned")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := writer.NewPartitionedFileWriter(map[string]string{"filepath": filepath.Join(dir, "{service}.jsonl")})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+
+	err = w.Write(context.Background(), writer.Message{Service: "test", Body: "Test message."})
+	if err != writer.ErrClosed {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", writer.ErrClosed, err))
+		t.FailNow()
+	}
+	if w.OpenFiles() != 0 {
+		t.Log(fmt.Sprintf("Expected OpenFiles: %d, received: %d", 0, w.OpenFiles()))
+		t.FailNow()
+	}
+	// Closing twice doesn't panic.
+	w.Close()
+}
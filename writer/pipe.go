@@ -0,0 +1,279 @@
+/*
+This file has the PipeWriter, it writes the messages to the standard input of a command.
+*/
+package writer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default values for the PipeWriter parameters.
+const (
+	// defaultPipeStopTimeout is how long Close waits for the command to exit before killing it.
+	defaultPipeStopTimeout = 5 * time.Second
+	// defaultPipeTimeout is how long a line can take to be written to the command.
+	defaultPipeTimeout = 5 * time.Second
+)
+
+// errPipeNotRunning is returned by the writes while the command is being restarted.
+var errPipeNotRunning = errors.New("Command is not running.")
+
+// pipeLine is a line for the goroutine writing to the command, with the channel that gets the result of the write.
+type pipeLine struct {
+	b      []byte
+	result chan error
+}
+
+// PipeWriter runs a command with sh -c and writes every message as a line to its standard input.
+// The command is restarted with backoff when it exits, and every line of its standard error is logged.
+// Its standard output is discarded.
+// The lines are written one at a time by a goroutine, with a deadline, so a write that failed can't reach the
+// command later.
+type PipeWriter struct {
+	command     string
+	format      string
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	stopTimeout time.Duration
+	timeout     time.Duration
+	lines       chan pipeLine
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	stdin     *os.File
+	closed    bool
+	quit      chan struct{}
+	done      chan struct{}
+	linesDone chan struct{}
+}
+
+// NewPipeWriter creates the writer from its parameters: command, format, restart_backoff, restart_max_backoff,
+// stop_timeout and timeout, and starts the command.
+func NewPipeWriter(params map[string]string) (*PipeWriter, error) {
+	if params["command"] == "" {
+		return nil, errors.New("command not received for PipeWriter.")
+	}
+	format, err := parseFormat(params)
+	if err != nil {
+		return nil, err
+	}
+	w := &PipeWriter{
+		command:     params["command"],
+		format:      format,
+		backoff:     defaultRetryBackoff,
+		maxBackoff:  defaultRetryMaxBackoff,
+		stopTimeout: defaultPipeStopTimeout,
+		timeout:     defaultPipeTimeout,
+		lines:       make(chan pipeLine),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+		linesDone:   make(chan struct{}),
+	}
+	for name, d := range map[string]*time.Duration{
+		"restart_backoff": &w.backoff, "restart_max_backoff": &w.maxBackoff, "stop_timeout": &w.stopTimeout,
+		"timeout": &w.timeout,
+	} {
+		if v, ok := params[name]; ok {
+			*d, err = time.ParseDuration(v)
+			if err != nil || *d <= 0 {
+				return nil, fmt.Errorf("Invalid %s %q.", name, v)
+			}
+		}
+	}
+
+	go w.supervise()
+	go w.writeLines()
+	log.Info(fmt.Sprintf("Starting PipeWriter with command %q.", w.command))
+	return w, nil
+}
+
+// Write writes the message as a line to the command. It fails while the command is restarting.
+// The context is only checked until the line is taken to be written, then Write waits for the result, which takes
+// up to timeout, so it doesn't fail for a line the command may still get.
+func (w *PipeWriter) Write(ctx context.Context, msg Message) error {
+	content, err := msg.Format(w.format)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	closed, stdin := w.closed, w.stdin
+	w.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if stdin == nil {
+		return errPipeNotRunning
+	}
+
+	line := pipeLine{b: []byte(strings.TrimSuffix(content, "\n") + "\n"), result: make(chan error, 1)}
+	select {
+	case w.lines <- line:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-w.quit:
+		return ErrClosed
+	}
+	return <-line.result
+}
+
+// writeLines writes the lines of Write to the command one at a time, until Close.
+func (w *PipeWriter) writeLines() {
+	defer close(w.linesDone)
+	for {
+		select {
+		case line := <-w.lines:
+			line.result <- w.writeLine(line.b)
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// writeLine writes the line to the command, failing when it doesn't finish in timeout. If only part of the line was
+// written, the command is killed, so the rest of the line isn't joined with the next one. It's restarted as usual.
+func (w *PipeWriter) writeLine(b []byte) error {
+	w.mu.Lock()
+	cmd, stdin := w.cmd, w.stdin
+	w.mu.Unlock()
+	if stdin == nil {
+		return errPipeNotRunning
+	}
+
+	err := stdin.SetWriteDeadline(time.Now().Add(w.timeout))
+	if err != nil {
+		return err
+	}
+	n, err := stdin.Write(b)
+	if err != nil && n > 0 {
+		slog.Error(fmt.Sprintf("Command %q got part of a line, killing it: %v", w.command, err))
+		cmd.Process.Kill()
+	}
+	return err
+}
+
+// Close closes the standard input of the command and waits for it to exit, or kills it after stop_timeout.
+func (w *PipeWriter) Close() {
+	log.Info("Closing PipeWriter.")
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.quit)
+	<-w.done
+	<-w.linesDone
+}
+
+// supervise runs the command and restarts it with backoff when it exits, until Close.
+func (w *PipeWriter) supervise() {
+	defer close(w.done)
+	backoff := w.backoff
+
+	for {
+		started := time.Now()
+		cmd, stdin, err := w.start()
+		if err != nil {
+			slog.Error(fmt.Sprintf("Command %q failed to start: %v", w.command, err))
+		} else {
+			exited := make(chan error, 1)
+			go func() {
+				exited <- cmd.Wait()
+			}()
+			w.mu.Lock()
+			w.cmd, w.stdin = cmd, stdin
+			w.mu.Unlock()
+
+			select {
+			case err = <-exited:
+				w.mu.Lock()
+				w.cmd, w.stdin = nil, nil
+				w.mu.Unlock()
+				stdin.Close()
+				slog.Error(fmt.Sprintf("Command %q exited: %v", w.command, err))
+			case <-w.quit:
+				// The line being written is finished first.
+				<-w.linesDone
+				w.stop(cmd, stdin, exited)
+				return
+			}
+			// A command that ran for a while starts again with the shortest backoff.
+			if time.Since(started) > w.maxBackoff {
+				backoff = w.backoff
+			}
+		}
+
+		select {
+		case <-time.After(jitter(backoff)):
+		case <-w.quit:
+			return
+		}
+		backoff *= 2
+		if backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// start runs the command, with a goroutine logging its standard error.
+func (w *PipeWriter) start() (*exec.Cmd, *os.File, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, nil, err
+	}
+
+	cmd := exec.Command("sh", "-c", w.command)
+	cmd.Stdin = stdinR
+	cmd.Stderr = stderrW
+	err = cmd.Start()
+	// The command has its own copies of these ends.
+	stdinR.Close()
+	stderrW.Close()
+	if err != nil {
+		stdinW.Close()
+		stderrR.Close()
+		return nil, nil, err
+	}
+
+	go func() {
+		defer stderrR.Close()
+		scanner := bufio.NewScanner(stderrR)
+		for scanner.Scan() {
+			log.Warn(fmt.Sprintf("Command %q: %s", w.command, scanner.Text()))
+		}
+	}()
+	return cmd, stdinW, nil
+}
+
+// stop closes the standard input so the command finishes, and kills it if it doesn't exit in time.
+func (w *PipeWriter) stop(cmd *exec.Cmd, stdin *os.File, exited <-chan error) {
+	w.mu.Lock()
+	w.cmd, w.stdin = nil, nil
+	w.mu.Unlock()
+	stdin.Close()
+
+	select {
+	case <-exited:
+	case <-time.After(w.stopTimeout):
+		slog.Error(fmt.Sprintf("Command %q didn't exit in %v, killing it.", w.command, w.stopTimeout))
+		cmd.Process.Kill()
+		<-exited
+	}
+}
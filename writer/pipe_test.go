@@ -0,0 +1,214 @@
+package writer_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFile waits until the file has n lines, or a second has passed, and returns its lines.
+func waitFile(path string, n int) []string {
+	var lines []string
+	for i := 0; i < 100; i++ {
+		b, _ := ioutil.ReadFile(path)
+		lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		if len(b) > 0 && len(lines) >= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return lines
+}
+
+func TestPipeWriter_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipe")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.txt")
+
+	w, err := writer.NewPipeWriter(map[string]string{"command": "echo starting >&2; cat > " + path})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// Writes fail until the command is running.
+	for i := 0; i < 3; i++ {
+		msg := writer.Message{Body: fmt.Sprintf("message %d", i)}
+		err = w.Write(context.Background(), msg)
+		for j := 0; err != nil && j < 100; j++ {
+			time.Sleep(10 * time.Millisecond)
+			err = w.Write(context.Background(), msg)
+		}
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	// Close waits for the command to finish the input.
+	w.Close()
+
+	expected := "message 0\nmessage 1\nmessage 2\n"
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(b) != expected {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", expected, b))
+		t.FailNow()
+	}
+
+	err = w.Write(context.Background(), writer.Message{Body: "late"})
+	if err != writer.ErrClosed {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", writer.ErrClosed, err))
+		t.FailNow()
+	}
+}
+
+func TestPipeWriter_Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipe")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.txt")
+	marker := filepath.Join(dir, "started")
+
+	// The command fails the first time it runs.
+	command := fmt.Sprintf("if [ ! -f %s ]; then touch %s; exit 1; fi; cat >> %s", marker, marker, path)
+	w, err := writer.NewPipeWriter(map[string]string{"command": command, "restart_backoff": "10ms"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	// Lines written while the command exits are lost, so the writes start after the restart.
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(marker); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		msg := writer.Message{Body: fmt.Sprintf("message %d", i)}
+		for j := 0; j < 100; j++ {
+			err = w.Write(context.Background(), msg)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	expected := []string{"message 0", "message 1", "message 2"}
+	lines := waitFile(path, 3)
+	if strings.Join(lines, ",") != strings.Join(expected, ",") {
+		t.Log(fmt.Sprintf("Expected lines: %v, received: %v", expected, lines))
+		t.FailNow()
+	}
+}
+
+func TestPipeWriter_SlowCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipe")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.txt")
+
+	// The command doesn't read for a while, the line is bigger than the pipe buffer.
+	w, err := writer.NewPipeWriter(map[string]string{"command": "sleep 0.3; cat > " + path, "timeout": "2s"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The line was taken before the context was done, so the write waits for it instead of failing.
+	body := strings.Repeat("a", 1024*1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = w.Write(ctx, writer.Message{Body: body})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(b) != body+"\n" {
+		t.Log(fmt.Sprintf("Expected the line once, received %d bytes.", len(b)))
+		t.FailNow()
+	}
+
+	// The command never reads: the write fails after the timeout, and the command is killed as it got part of the line.
+	w, err = writer.NewPipeWriter(map[string]string{"command": "exec sleep 10", "timeout": "100ms", "restart_backoff": "10ms"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	err = w.Write(context.Background(), writer.Message{Body: body})
+	if err == nil || time.Since(start) > time.Second {
+		t.Log(fmt.Sprintf("Expected the write to time out, received: %v after %v", err, time.Since(start)))
+		t.FailNow()
+	}
+}
+
+func TestPipeWriter_StopTimeout(t *testing.T) {
+	// The command ignores its input, Close kills it.
+	w, err := writer.NewPipeWriter(map[string]string{"command": "exec sleep 10", "stop_timeout": "50ms"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	w.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Log(fmt.Sprintf("Expected Close to kill the command, it took: %v", elapsed))
+		t.FailNow()
+	}
+}
+
+func TestNewPipeWriter_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"format": "json"},
+		{"command": "cat", "format": "xml"},
+		{"command": "cat", "restart_backoff": "0s"},
+		{"command": "cat", "stop_timeout": "soon"},
+		{"command": "cat", "timeout": "-1s"},
+	}
+	for _, params := range tests {
+		_, err := writer.NewPipeWriter(params)
+		if err == nil {
+			t.Log(fmt.Sprintf("Expected an error for params: %v", params))
+			t.Fail()
+		}
+	}
+}
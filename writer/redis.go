@@ -0,0 +1,322 @@
+/*
+This file has the RedisWriter, it adds the messages to Redis streams with XADD.
+*/
+package writer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default values for the RedisWriter parameters.
+const (
+	defaultRedisStream   = "{service}"
+	defaultRedisTimeout  = 5 * time.Second
+	defaultRedisPoolSize = 4
+)
+
+// RedisWriter adds every message to a stream as an entry with the service, request_id, received_at and body fields.
+// Batches are pipelined on a single connection.
+type RedisWriter struct {
+	address     string
+	username    string
+	password    string
+	db          int
+	stream      *pathTemplate
+	maxLen      int
+	approximate bool
+	format      string
+	timeout     time.Duration
+
+	idle     chan *redisConn
+	closedMu sync.RWMutex
+	closed   bool
+}
+
+// redisConn is a connection speaking RESP.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error answered by Redis, the connection is still usable after it.
+type redisError string
+
+func (e redisError) Error() string {
+	return "Redis error: " + string(e)
+}
+
+// NewRedisWriter creates the writer from its parameters: address, username, password, db, stream, maxlen,
+// maxlen_exact, format, timeout and pool_size.
+// The stream is a template that can use the time placeholders, the service and the extracted values.
+func NewRedisWriter(params map[string]string) (*RedisWriter, error) {
+	if params["address"] == "" {
+		return nil, errors.New("address not received for RedisWriter.")
+	}
+	format, err := parseFormat(params)
+	if err != nil {
+		return nil, err
+	}
+	w := &RedisWriter{
+		address:     params["address"],
+		username:    params["username"],
+		password:    params["password"],
+		format:      format,
+		approximate: params["maxlen_exact"] != "true",
+		timeout:     defaultRedisTimeout,
+	}
+
+	stream := params["stream"]
+	if stream == "" {
+		stream = defaultRedisStream
+	}
+	w.stream, err = parseTemplate(stream)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := params["db"]; ok {
+		w.db, err = strconv.Atoi(v)
+		if err != nil || w.db < 0 {
+			return nil, fmt.Errorf("Invalid db %q.", v)
+		}
+	}
+	w.maxLen, err = intParam(params, "maxlen", 0)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := params["timeout"]; ok {
+		w.timeout, err = time.ParseDuration(v)
+		if err != nil || w.timeout <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %q.", v)
+		}
+	}
+	poolSize, err := intParam(params, "pool_size", defaultRedisPoolSize)
+	if err != nil {
+		return nil, err
+	}
+	w.idle = make(chan *redisConn, poolSize)
+
+	log.Info(fmt.Sprintf("Starting RedisWriter for %s.", w.address))
+	return w, nil
+}
+
+// Write adds the message to its stream.
+func (w *RedisWriter) Write(ctx context.Context, msg Message) error {
+	return w.WriteBatch(ctx, []Message{msg})
+}
+
+// WriteBatch sends one XADD per message and then reads all the answers. It returns the first error.
+func (w *RedisWriter) WriteBatch(ctx context.Context, msgs []Message) error {
+	cmds := make([][]string, 0, len(msgs))
+	for _, msg := range msgs {
+		cmd, err := w.xadd(msg)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	w.closedMu.RLock()
+	defer w.closedMu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	c, err := w.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.setDeadline(ctx, w.timeout)
+	if err == nil {
+		err = c.pipeline(cmds)
+	}
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		return err
+	}
+	w.putConn(c)
+	return err
+}
+
+// Close waits for the writes in progress and closes the connections.
+func (w *RedisWriter) Close() {
+	log.Info("Closing RedisWriter.")
+	w.closedMu.Lock()
+	defer w.closedMu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	for {
+		select {
+		case c := <-w.idle:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// xadd builds the XADD command for the message.
+func (w *RedisWriter) xadd(msg Message) ([]string, error) {
+	body, err := msg.Format(w.format)
+	if err != nil {
+		return nil, err
+	}
+	cmd := []string{"XADD", w.stream.Execute(msg.ReceivedAt.UTC(), msg.Fields())}
+	if w.maxLen > 0 {
+		cmd = append(cmd, "MAXLEN")
+		if w.approximate {
+			cmd = append(cmd, "~")
+		}
+		cmd = append(cmd, strconv.Itoa(w.maxLen))
+	}
+	cmd = append(cmd, "*",
+		"service", msg.Service,
+		"request_id", msg.RequestID,
+		"received_at", msg.ReceivedAt.UTC().Format(time.RFC3339Nano),
+	)
+	if msg.Principal != nil && msg.Principal.ID != "" {
+		cmd = append(cmd, "principal", msg.Principal.ID)
+	}
+	return append(cmd, "body", body), nil
+}
+
+// getConn returns an idle connection, or opens a new one.
+func (w *RedisWriter) getConn(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-w.idle:
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: w.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", w.address)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	var setup [][]string
+	if w.password != "" {
+		if w.username != "" {
+			setup = append(setup, []string{"AUTH", w.username, w.password})
+		} else {
+			setup = append(setup, []string{"AUTH", w.password})
+		}
+	}
+	if w.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(w.db)})
+	}
+	if len(setup) > 0 {
+		err = c.setDeadline(ctx, w.timeout)
+		if err == nil {
+			err = c.pipeline(setup)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// putConn returns the connection to the pool, or closes it when the pool is full.
+func (w *RedisWriter) putConn(c *redisConn) {
+	select {
+	case w.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// setDeadline sets the earliest of the context deadline and now plus timeout.
+func (c *redisConn) setDeadline(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return c.conn.SetDeadline(deadline)
+}
+
+// pipeline sends all the commands and then reads their answers. It returns the first error answered by Redis,
+// after reading all the answers so the connection can be reused.
+func (c *redisConn) pipeline(cmds [][]string) error {
+	for _, cmd := range cmds {
+		fmt.Fprintf(c.w, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	err := c.w.Flush()
+	if err != nil {
+		return err
+	}
+
+	var first error
+	for range cmds {
+		err = c.readReply()
+		if _, ok := err.(redisError); err != nil && !ok {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// readReply reads and discards an answer, returning the error when it's one.
+func (c *redisConn) readReply() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return fmt.Errorf("Invalid Redis reply %q.", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("Invalid Redis reply %q.", line)
+		}
+		if n < 0 {
+			return nil
+		}
+		_, err = io.CopyN(ioutil.Discard, c.r, int64(n)+2)
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("Invalid Redis reply %q.", line)
+		}
+		var first error
+		for i := 0; i < n; i++ {
+			err = c.readReply()
+			if _, ok := err.(redisError); err != nil && !ok {
+				return err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	default:
+		return fmt.Errorf("Invalid Redis reply %q.", line)
+	}
+}
@@ -0,0 +1,259 @@
+package writer_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/efark/data-receiver/authenticator"
+	"github.com/efark/data-receiver/writer"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis understands enough RESP to answer AUTH, SELECT and XADD. It keeps the entries of every stream,
+// and answers XADD to the "fail" stream with an error.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	streams  map[string][][]string
+	commands [][]string
+	conns    int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	r := &fakeRedis{listener: l, password: password, streams: make(map[string][][]string)}
+	go r.serve()
+	return r
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.conns++
+		r.mu.Unlock()
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		cmd, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.commands = append(r.commands, cmd)
+		var reply string
+		switch {
+		case cmd[0] == "AUTH" && cmd[len(cmd)-1] == r.password:
+			authenticated = true
+			reply = "+OK\r\n"
+		case cmd[0] == "AUTH":
+			reply = "-WRONGPASS invalid password\r\n"
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd[0] == "SELECT":
+			reply = "+OK\r\n"
+		case cmd[0] == "XADD" && cmd[1] == "fail":
+			reply = "-ERR stream failed\r\n"
+		case cmd[0] == "XADD":
+			r.streams[cmd[1]] = append(r.streams[cmd[1]], cmd)
+			id := fmt.Sprintf("%d-0", len(r.streams[cmd[1]]))
+			reply = fmt.Sprintf("$%d\r\n%s\r\n", len(id), id)
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		r.mu.Unlock()
+		conn.Write([]byte(reply))
+	}
+}
+
+// readCommand reads an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		cmd[i] = string(b[:size])
+	}
+	return cmd, nil
+}
+
+func (r *fakeRedis) Stream(key string) [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.streams[key]
+}
+
+func (r *fakeRedis) Commands() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commands
+}
+
+func (r *fakeRedis) Conns() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns
+}
+
+func TestRedisWriter_Write(t *testing.T) {
+	r := newFakeRedis(t, "secret")
+	defer r.listener.Close()
+
+	w, err := writer.NewRedisWriter(map[string]string{
+		"address": r.listener.Addr().String(), "password": "secret", "db": "2",
+		"stream": "events:{service}:{source}", "maxlen": "1000",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	msg := writer.Message{Service: "test", ReceivedAt: ts, RequestID: "abc", Extracted: map[string]string{"source": "a"}, Body: "test message"}
+	err = w.Write(context.Background(), msg)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := "XADD events:test:a MAXLEN ~ 1000 * service test request_id abc received_at 2021-03-04T05:06:07Z body test message"
+	entries := r.Stream("events:test:a")
+	if len(entries) != 1 || strings.Join(entries[0], " ") != expected {
+		t.Log(fmt.Sprintf("Expected entry: %q, received: %q", expected, entries))
+		t.FailNow()
+	}
+	if commands := r.Commands(); strings.Join(commands[1], " ") != "SELECT 2" {
+		t.Log(fmt.Sprintf("Expected command: %q, received: %q", "SELECT 2", commands[1]))
+		t.FailNow()
+	}
+
+	// The principal of authenticated messages is added to the entry.
+	msg.Principal = &authenticator.Principal{ID: "partner-a"}
+	err = w.Write(context.Background(), msg)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	expected = "XADD events:test:a MAXLEN ~ 1000 * service test request_id abc received_at 2021-03-04T05:06:07Z principal partner-a body test message"
+	entries = r.Stream("events:test:a")
+	if len(entries) != 2 || strings.Join(entries[1], " ") != expected {
+		t.Log(fmt.Sprintf("Expected entry: %q, received: %q", expected, entries))
+		t.FailNow()
+	}
+}
+
+func TestRedisWriter_WriteBatch(t *testing.T) {
+	r := newFakeRedis(t, "")
+	defer r.listener.Close()
+
+	w, err := writer.NewRedisWriter(map[string]string{"address": r.listener.Addr().String(), "stream": "{service}"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	msgs := []writer.Message{{Service: "test", Body: "message 0"}, {Service: "fail", Body: "message 1"}, {Service: "test", Body: "message 2"}}
+	err = w.WriteBatch(context.Background(), msgs)
+	if err == nil || !strings.Contains(err.Error(), "stream failed") {
+		t.Log(fmt.Sprintf("Expected error: %q, received: %v", "stream failed", err))
+		t.FailNow()
+	}
+	// The other messages are written, the error doesn't break the pipeline.
+	if entries := r.Stream("test"); len(entries) != 2 {
+		t.Log(fmt.Sprintf("Expected entries: %v, received: %v", 2, len(entries)))
+		t.FailNow()
+	}
+
+	// The connection is reused after the error.
+	err = w.WriteBatch(context.Background(), msgs[:1])
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if conns := r.Conns(); conns != 1 {
+		t.Log(fmt.Sprintf("Expected connections: %v, received: %v", 1, conns))
+		t.FailNow()
+	}
+}
+
+func TestRedisWriter_Auth(t *testing.T) {
+	r := newFakeRedis(t, "secret")
+	defer r.listener.Close()
+
+	w, err := writer.NewRedisWriter(map[string]string{"address": r.listener.Addr().String(), "password": "wrong"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = w.Write(context.Background(), writer.Message{Service: "test", Body: "message"})
+	if err == nil {
+		t.Log("Expected an error.")
+		t.FailNow()
+	}
+
+	w.Close()
+	err = w.Write(context.Background(), writer.Message{Service: "test", Body: "message"})
+	if err != writer.ErrClosed {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", writer.ErrClosed, err))
+		t.FailNow()
+	}
+}
+
+func TestNewRedisWriter_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"stream": "events"},
+		{"address": "localhost:6379", "stream": "{service"},
+		{"address": "localhost:6379", "db": "-1"},
+		{"address": "localhost:6379", "maxlen": "many"},
+		{"address": "localhost:6379", "format": "xml"},
+	}
+	for _, params := range tests {
+		_, err := writer.NewRedisWriter(params)
+		if err == nil {
+			t.Log(fmt.Sprintf("Expected an error for params: %v", params))
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,341 @@
+/*
+This file has the RetryWriter, a wrapper that retries failed writes and sends the messages that still fail to a dead-letter writer.
+*/
+package writer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Default values for the retry parameters, used when at least one of them is set.
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 5 * time.Second
+)
+
+// maxReplayLine is the longest line ReplayFile can read.
+const maxReplayLine = 16 * 1024 * 1024
+
+// RetryOptions defines how many times a write is attempted and how long it waits between attempts.
+type RetryOptions struct {
+	// Attempts is the total number of attempts, including the first one.
+	Attempts int
+	// Backoff is the wait after the first failure, it's doubled after every attempt.
+	Backoff time.Duration
+	// MaxBackoff is the longest wait between two attempts.
+	MaxBackoff time.Duration
+}
+
+// hasRetryParams returns true when any of the retry or dead-letter parameters was received.
+func hasRetryParams(params map[string]string) bool {
+	for _, k := range []string{"retry_attempts", "retry_backoff", "retry_max_backoff", "dlq_path"} {
+		if _, ok := params[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryOptions reads retry_attempts, retry_backoff and retry_max_backoff from the parameters.
+func parseRetryOptions(params map[string]string) (RetryOptions, error) {
+	opts := RetryOptions{Attempts: defaultRetryAttempts, Backoff: defaultRetryBackoff, MaxBackoff: defaultRetryMaxBackoff}
+	var err error
+	if v, ok := params["retry_attempts"]; ok {
+		opts.Attempts, err = strconv.Atoi(v)
+		if err != nil || opts.Attempts < 1 {
+			return opts, fmt.Errorf("Invalid retry_attempts %q.", v)
+		}
+	}
+	if v, ok := params["retry_backoff"]; ok {
+		opts.Backoff, err = time.ParseDuration(v)
+		if err != nil || opts.Backoff < 0 {
+			return opts, fmt.Errorf("Invalid retry_backoff %q.", v)
+		}
+	}
+	if v, ok := params["retry_max_backoff"]; ok {
+		opts.MaxBackoff, err = time.ParseDuration(v)
+		if err != nil || opts.MaxBackoff < 0 {
+			return opts, fmt.Errorf("Invalid retry_max_backoff %q.", v)
+		}
+	}
+	return opts, nil
+}
+
+// newRetryWriter wraps the writer with the retry options and, if dlq_path is set, a FileWriter as dead-letter writer.
+// Dead letters are written as Json envelopes, so ReplayFile can read them back.
+// The writer holds the lock of the dead-letter file while it's open, so it can't be replayed at the same time.
+func newRetryWriter(w Writer, params map[string]string) (*RetryWriter, error) {
+	opts, err := parseRetryOptions(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var dlq Writer
+	var lock *os.File
+	if path := params["dlq_path"]; path != "" {
+		lock, err = lockDeadLetters(path)
+		if err != nil {
+			return nil, err
+		}
+		dlq, err = NewFileWriterWithOptions(path, FileWriterOptions{Format: FormatJSON, AckMode: AckFsynced})
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+	}
+	r := NewRetryWriter(w, dlq, opts)
+	r.lock = lock
+	return r, nil
+}
+
+// lockDeadLetters takes the lock of the dead-letter file, the file path with the ".lock" suffix.
+func lockDeadLetters(path string) (*os.File, error) {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("Dead-letter file %q is in use by another process: %v", path, err)
+	}
+	return lock, nil
+}
+
+// RetryWriter retries the failed writes with exponential backoff and jitter.
+// When all the attempts fail, the message is written to the dead-letter writer and the write succeeds if that one does.
+// When the context is done first, the write fails with the context error and nothing goes to the dead-letter writer:
+// the last attempt may still finish, so the message could be written twice.
+type RetryWriter struct {
+	w    Writer
+	dlq  Writer
+	opts RetryOptions
+	lock *os.File
+}
+
+// NewRetryWriter wraps the writer, dlq can be nil to only retry.
+func NewRetryWriter(w Writer, dlq Writer, opts RetryOptions) *RetryWriter {
+	if opts.Attempts < 1 {
+		opts.Attempts = 1
+	}
+	return &RetryWriter{w: w, dlq: dlq, opts: opts}
+}
+
+// Write tries to write the message until it succeeds, the attempts run out or the context is done.
+func (r *RetryWriter) Write(ctx context.Context, msg Message) error {
+	err := r.retry(ctx, func() error { return r.w.Write(ctx, msg) })
+	if err == nil || r.dlq == nil || ctx.Err() != nil {
+		return err
+	}
+
+	// The attempts ran out, the dead letter is written even if the request's context is done meanwhile.
+	slog.Error(fmt.Sprintf("Sending message to the dead-letter writer: %v", err))
+	dlqErr := r.dlq.Write(context.Background(), msg)
+	if dlqErr != nil {
+		slog.Error(dlqErr.Error())
+		return err
+	}
+	return nil
+}
+
+// WriteBatch retries the whole batch when the writer implements BatchWriter, otherwise it writes the messages one by one
+// with Write and stops at the first error. When all the attempts fail, the batch is written to the dead-letter writer.
+func (r *RetryWriter) WriteBatch(ctx context.Context, msgs []Message) error {
+	bw, ok := r.w.(BatchWriter)
+	if !ok {
+		for _, msg := range msgs {
+			err := r.Write(ctx, msg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := r.retry(ctx, func() error { return bw.WriteBatch(ctx, msgs) })
+	if err == nil || r.dlq == nil || ctx.Err() != nil {
+		return err
+	}
+	slog.Error(fmt.Sprintf("Sending %d messages to the dead-letter writer: %v", len(msgs), err))
+	for _, msg := range msgs {
+		dlqErr := r.dlq.Write(context.Background(), msg)
+		if dlqErr != nil {
+			slog.Error(dlqErr.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// retry calls write until it succeeds, the attempts run out or the context is done. It returns the last error of write,
+// or the context error when the context is done.
+func (r *RetryWriter) retry(ctx context.Context, write func() error) error {
+	var err error
+	backoff := r.opts.Backoff
+	for attempt := 1; attempt <= r.opts.Attempts; attempt++ {
+		err = write()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt == r.opts.Attempts {
+			break
+		}
+		slog.Error(fmt.Sprintf("Write attempt %d of %d failed: %v", attempt, r.opts.Attempts, err))
+
+		timer := time.NewTimer(jitter(backoff))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+		if r.opts.MaxBackoff > 0 && backoff > r.opts.MaxBackoff {
+			backoff = r.opts.MaxBackoff
+		}
+	}
+	return err
+}
+
+// Close closes the writer and the dead-letter writer.
+func (r *RetryWriter) Close() {
+	r.w.Close()
+	if r.dlq != nil {
+		r.dlq.Close()
+	}
+	if r.lock != nil {
+		r.lock.Close()
+	}
+}
+
+// jitter returns a random duration between half and all of d, so clients retrying at once don't stay in sync.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// ReplayFile writes all the messages of a dead-letter file, one Json envelope per line, to the writer.
+// It stops at the first error and returns the number of messages written until then.
+func ReplayFile(ctx context.Context, path string, w Writer) (int, error) {
+	n, _, err := replayFile(ctx, path, w)
+	return n, err
+}
+
+/*
+ReplayDeadLetters writes the messages of the dead-letter file in params["dlq_path"] back to the writer of the class, and
+removes them from the file. It returns the number of messages written.
+The writer is created without the wrappers: the messages already went through the encryption before getting to the file,
+and they're written one by one without batches, retries or spool. It stops at the first error, and the messages that weren't
+written stay in the file to be replayed again.
+It fails if the dead-letter file is locked by the writer of a running server, the server has to be stopped first.
+*/
+func ReplayDeadLetters(ctx context.Context, class string, params map[string]string) (int, error) {
+	path := params["dlq_path"]
+	if path == "" {
+		return 0, errors.New("dlq_path not received.")
+	}
+	lock, err := lockDeadLetters(path)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+
+	w, err := createWriter(class, params)
+	if err != nil {
+		return 0, err
+	}
+	n, offset, err := replayFile(ctx, path, w)
+	w.Close()
+	if offset > 0 {
+		trimErr := trimFile(path, offset)
+		if trimErr != nil {
+			return n, fmt.Errorf("%d messages were replayed but couldn't be removed from %q: %v", n, path, trimErr)
+		}
+	}
+	return n, err
+}
+
+// replayFile writes the messages of the file to the writer until the first error.
+// It returns the number of messages written and the offset in the file of the first message that wasn't.
+func replayFile(ctx context.Context, path string, w Writer) (int, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var n, line int
+	var offset int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxReplayLine)
+	for scanner.Scan() {
+		line++
+		next := offset + int64(len(scanner.Bytes())) + 1
+		if len(scanner.Bytes()) == 0 {
+			offset = next
+			continue
+		}
+		var msg Message
+		err = json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			return n, offset, fmt.Errorf("Line %d of %q isn't a message: %v", line, path, err)
+		}
+		err = w.Write(ctx, msg)
+		if err != nil {
+			return n, offset, err
+		}
+		n++
+		offset = next
+	}
+	return n, offset, scanner.Err()
+}
+
+// trimFile removes the first offset bytes of the file, or the whole file when there's nothing after them.
+// The rest is copied to a temporary file that replaces the original, so an interruption doesn't lose it.
+func trimFile(path string, offset int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if offset >= info.Size() {
+		return os.Remove(path)
+	}
+
+	_, err = src.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
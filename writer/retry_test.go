@@ -0,0 +1,285 @@
+package writer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// flakyWriter fails the first failures writes and stores the messages after that.
+type flakyWriter struct {
+	failures int
+	attempts int
+	writer.MemoryWriter
+}
+
+func (w *flakyWriter) Write(ctx context.Context, msg writer.Message) error {
+	w.attempts++
+	if w.attempts <= w.failures {
+		return errors.New("Write failed.")
+	}
+	return w.MemoryWriter.Write(ctx, msg)
+}
+
+func TestRetryWriter_Write(t *testing.T) {
+	flaky := &flakyWriter{failures: 2}
+	w := writer.NewRetryWriter(flaky, nil, writer.RetryOptions{Attempts: 3, Backoff: time.Millisecond})
+	defer w.Close()
+
+	err := w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if flaky.attempts != 3 || len(flaky.GetMessages()) != 1 {
+		t.Log(fmt.Sprintf("Expected %d attempts and %d message, received: %d and %d", 3, 1, flaky.attempts, len(flaky.GetMessages())))
+		t.FailNow()
+	}
+}
+
+func TestRetryWriter_DeadLetter(t *testing.T) {
+	dlq, _ := writer.NewMemoryWriter()
+	flaky := &flakyWriter{failures: 5}
+	w := writer.NewRetryWriter(flaky, dlq, writer.RetryOptions{Attempts: 2, Backoff: time.Millisecond})
+
+	err := w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != nil {
+		t.Log(fmt.Sprintf("Expected the dead-letter writer to take the message, received: %v", err))
+		t.FailNow()
+	}
+	ms := dlq.GetMessages()
+	if flaky.attempts != 2 || len(ms) != 1 || ms[0].Body != "Test message." {
+		t.Log(fmt.Sprintf("Expected %d attempts and the message in the dead-letter writer, received: %d and %v", 2, flaky.attempts, ms))
+		t.FailNow()
+	}
+}
+
+func TestRetryWriter_NoDeadLetter(t *testing.T) {
+	flaky := &flakyWriter{failures: 5}
+	w := writer.NewRetryWriter(flaky, nil, writer.RetryOptions{Attempts: 2, Backoff: time.Millisecond})
+
+	err := w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err == nil {
+		t.Error("Expected error when all the attempts fail.")
+		t.FailNow()
+	}
+}
+
+// slowFailingWriter fails after the context is done.
+type slowFailingWriter struct {
+	writer.MemoryWriter
+}
+
+func (w *slowFailingWriter) Write(ctx context.Context, _ writer.Message) error {
+	<-ctx.Done()
+	return errors.New("Write failed.")
+}
+
+func TestRetryWriter_ContextDone(t *testing.T) {
+	dlq, _ := writer.NewMemoryWriter()
+	w := writer.NewRetryWriter(&slowFailingWriter{}, dlq, writer.RetryOptions{Attempts: 3, Backoff: time.Millisecond})
+
+	// The request timed out, so it fails and the message doesn't go to the dead-letter writer.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := w.Write(ctx, writer.Message{Body: "Test message."})
+	if err != context.DeadlineExceeded {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", context.DeadlineExceeded, err))
+		t.FailNow()
+	}
+	if ms := dlq.GetMessages(); len(ms) != 0 {
+		t.Log(fmt.Sprintf("Expected no dead letters, received: %v", ms))
+		t.FailNow()
+	}
+}
+
+// flakyBatchWriter fails the first failures batches and keeps the size of the others.
+type flakyBatchWriter struct {
+	flakyWriter
+	batches []int
+}
+
+func (w *flakyBatchWriter) WriteBatch(_ context.Context, msgs []writer.Message) error {
+	w.attempts++
+	if w.attempts <= w.failures {
+		return errors.New("Write failed.")
+	}
+	w.batches = append(w.batches, len(msgs))
+	return nil
+}
+
+func TestRetryWriter_WriteBatch(t *testing.T) {
+	msgs := []writer.Message{{Body: "Test message 1."}, {Body: "Test message 2."}, {Body: "Test message 3."}}
+
+	// The whole batch is retried.
+	flaky := &flakyBatchWriter{flakyWriter: flakyWriter{failures: 1}}
+	w := writer.NewRetryWriter(flaky, nil, writer.RetryOptions{Attempts: 3, Backoff: time.Millisecond})
+	err := w.WriteBatch(context.Background(), msgs)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if flaky.attempts != 2 || fmt.Sprint(flaky.batches) != "[3]" {
+		t.Log(fmt.Sprintf("Expected %d attempts and a batch of %d, received: %d and %v", 2, 3, flaky.attempts, flaky.batches))
+		t.FailNow()
+	}
+
+	// All the messages go to the dead-letter writer when the attempts run out.
+	dlq, _ := writer.NewMemoryWriter()
+	flaky = &flakyBatchWriter{flakyWriter: flakyWriter{failures: 5}}
+	w = writer.NewRetryWriter(flaky, dlq, writer.RetryOptions{Attempts: 2, Backoff: time.Millisecond})
+	err = w.WriteBatch(context.Background(), msgs)
+	if err != nil {
+		t.Log(fmt.Sprintf("Expected the dead-letter writer to take the messages, received: %v", err))
+		t.FailNow()
+	}
+	if ms := dlq.GetMessages(); len(ms) != 3 {
+		t.Log(fmt.Sprintf("Expected messages in the dead-letter writer: %d, received: %v", 3, ms))
+		t.FailNow()
+	}
+}
+
+func TestReplayFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlq")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	// Writes the dead letters the same way the writers created with dlq_path do.
+	path := filepath.Join(dir, "dlq.jsonl")
+	failing := &failingWriter{err: errors.New("Write failed.")}
+	dlq, err := writer.NewFileWriterWithOptions(path, writer.FileWriterOptions{Format: writer.FormatJSON})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w := writer.NewRetryWriter(failing, dlq, writer.RetryOptions{Attempts: 1})
+	for i := 1; i <= 2; i++ {
+		msg := writer.Message{Service: "test", Extracted: map[string]string{"user_id": "test_id"}, Body: fmt.Sprintf("Test message %d.", i)}
+		err = w.Write(context.Background(), msg)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	w.Close()
+
+	m, _ := writer.NewMemoryWriter()
+	n, err := writer.ReplayFile(context.Background(), path, m)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ms := m.GetMessages()
+	if n != 2 || len(ms) != 2 {
+		t.Log(fmt.Sprintf("Expected %d messages replayed, received: %d", 2, n))
+		t.FailNow()
+	}
+	if ms[1].Body != "Test message 2." || ms[1].Service != "test" || ms[1].Extracted["user_id"] != "test_id" {
+		t.Log(fmt.Sprintf("Unexpected message replayed: %+v", ms[1]))
+		t.FailNow()
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlq")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	dlqPath := filepath.Join(dir, "dlq.jsonl")
+	var lines string
+	for i := 1; i <= 3; i++ {
+		lines += fmt.Sprintf(`{"service":"test","received_at":"2021-03-04T05:06:07Z","body":"message %d"}`+"\n", i)
+	}
+	err = ioutil.WriteFile(dlqPath, []byte(lines), 0644)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// The upstream fails the second message the first time.
+	var bodies []string
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if string(b) == "message 2" && !failed {
+			failed = true
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		bodies = append(bodies, string(b))
+	}))
+	defer server.Close()
+	params := map[string]string{
+		"url": server.URL, "dlq_path": dlqPath, "retry_attempts": "5", "spool_dir": filepath.Join(dir, "spool"), "batch_size": "10",
+	}
+
+	// The running server holds the lock of the dead-letter file.
+	running, err := writer.CreateWriter("HTTPWriter", params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = writer.ReplayDeadLetters(context.Background(), "HTTPWriter", params)
+	if err == nil {
+		t.Error("Expected error while the dead-letter file is in use.")
+		t.FailNow()
+	}
+	running.Close()
+	os.RemoveAll(filepath.Join(dir, "spool"))
+
+	// Without retries the replay stops at the second message, which stays in the file with the third one.
+	n, err := writer.ReplayDeadLetters(context.Background(), "HTTPWriter", params)
+	if err == nil || n != 1 {
+		t.Log(fmt.Sprintf("Expected an error after %d messages, received: %d, %v", 1, n, err))
+		t.FailNow()
+	}
+	b, err := ioutil.ReadFile(dlqPath)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(b) != lines[len(lines)/3:] {
+		t.Log(fmt.Sprintf("Expected file: %q, received: %q", lines[len(lines)/3:], b))
+		t.FailNow()
+	}
+
+	n, err = writer.ReplayDeadLetters(context.Background(), "HTTPWriter", params)
+	if err != nil || n != 2 {
+		t.Log(fmt.Sprintf("Expected %d messages replayed, received: %d, %v", 2, n, err))
+		t.FailNow()
+	}
+	if fmt.Sprint(bodies) != "[message 1 message 2 message 3]" {
+		t.Log(fmt.Sprintf("Unexpected messages replayed: %q", bodies))
+		t.FailNow()
+	}
+	if _, err = os.Stat(dlqPath); !os.IsNotExist(err) {
+		t.Log(fmt.Sprintf("Expected the dead-letter file to be removed: %v", err))
+		t.FailNow()
+	}
+	if _, err = os.Stat(filepath.Join(dir, "spool")); !os.IsNotExist(err) {
+		t.Log("Expected the replay to run without the spool.")
+		t.FailNow()
+	}
+}
+
+func TestCreateWriter_Retry(t *testing.T) {
+	_, err := writer.CreateWriter("ConsoleWriter", map[string]string{"retry_attempts": "0"})
+	if err == nil {
+		t.Error("Expected error for invalid retry_attempts.")
+		t.FailNow()
+	}
+}
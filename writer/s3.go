@@ -0,0 +1,418 @@
+/*
+This file has the S3Writer, it uploads the messages as objects to an S3 compatible storage.
+*/
+package writer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default values for the S3Writer parameters.
+const (
+	defaultS3Region        = "us-east-1"
+	defaultS3KeyTemplate   = "{service}/dt={yyyy-MM-dd}/{HH}{mm}{ss}-{object_id}.ndjson"
+	defaultS3MaxObjectSize = 8 * 1024 * 1024
+	defaultS3MaxObjectAge  = 10 * time.Second
+	defaultS3Timeout       = 30 * time.Second
+	s3UploadAttempts       = 5
+	s3TimeFormat           = "20060102T150405Z"
+	s3DateFormat           = "20060102"
+)
+
+// S3Writer buffers the messages, one per line, and uploads each buffer as an object when it reaches
+// max_object_size bytes or max_object_age. Messages with different keys, apart from the time, go to different objects.
+// Write waits until the object with its message is uploaded and returns the result of the upload, like the BatchingWriter,
+// so a request only gets its answer once the message is stored. Close uploads all the buffers and waits for all the
+// uploads, with all their attempts.
+type S3Writer struct {
+	endpoint    *url.URL
+	bucket      string
+	region      string
+	accessKey   string
+	secretKey   string
+	template    *pathTemplate
+	format      string
+	compression string
+	maxSize     int
+	maxAge      time.Duration
+	client      *http.Client
+
+	mu      sync.Mutex
+	buffers map[string]*s3Buffer
+	closed  bool
+	uploads sync.WaitGroup
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// s3Buffer holds the messages of a future object, done is closed after the upload and err has its result.
+type s3Buffer struct {
+	data       bytes.Buffer
+	receivedAt time.Time
+	fields     map[string]string
+	created    time.Time
+	count      int
+	done       chan struct{}
+	err        error
+}
+
+// NewS3Writer creates the writer from its parameters: endpoint, bucket, region, access_key, secret_key,
+// key_template, format, compression (gzip or empty), max_object_size, max_object_age and timeout.
+// The key template can use the time placeholders, the service, the extracted values and object_id, a random id.
+func NewS3Writer(params map[string]string) (*S3Writer, error) {
+	endpoint, err := url.Parse(params["endpoint"])
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid endpoint %q for S3Writer.", params["endpoint"])
+	}
+	if params["bucket"] == "" {
+		return nil, errors.New("bucket not received for S3Writer.")
+	}
+	format, err := parseFormat(params)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &S3Writer{
+		endpoint:  endpoint,
+		bucket:    params["bucket"],
+		region:    params["region"],
+		accessKey: params["access_key"],
+		secretKey: params["secret_key"],
+		format:    format,
+		maxSize:   defaultS3MaxObjectSize,
+		maxAge:    defaultS3MaxObjectAge,
+		buffers:   make(map[string]*s3Buffer),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if w.region == "" {
+		w.region = defaultS3Region
+	}
+
+	keyTemplate := params["key_template"]
+	switch params["compression"] {
+	case "":
+		if keyTemplate == "" {
+			keyTemplate = defaultS3KeyTemplate
+		}
+	case "gzip":
+		w.compression = "gzip"
+		if keyTemplate == "" {
+			keyTemplate = defaultS3KeyTemplate + ".gz"
+		}
+	default:
+		return nil, fmt.Errorf("Compression %q not supported.", params["compression"])
+	}
+	w.template, err = parseTemplate(keyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := params["max_object_size"]; ok {
+		w.maxSize, err = strconv.Atoi(v)
+		if err != nil || w.maxSize <= 0 {
+			return nil, fmt.Errorf("Invalid max_object_size %q.", v)
+		}
+	}
+	if v, ok := params["max_object_age"]; ok {
+		w.maxAge, err = time.ParseDuration(v)
+		if err != nil || w.maxAge <= 0 {
+			return nil, fmt.Errorf("Invalid max_object_age %q.", v)
+		}
+	}
+	timeout := defaultS3Timeout
+	if v, ok := params["timeout"]; ok {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %q.", v)
+		}
+	}
+	w.client = &http.Client{Timeout: timeout}
+
+	go w.flushOld()
+	log.Info(fmt.Sprintf("Starting S3Writer for bucket %q.", w.bucket))
+	return w, nil
+}
+
+// Write adds the message to the buffer of its object and waits until the object is uploaded or the context is done.
+// When the context is done first the message stays in the buffer, and may still be uploaded.
+func (w *S3Writer) Write(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	content, err := msg.Format(w.format)
+	if err != nil {
+		return err
+	}
+
+	fields := msg.Fields()
+	// Messages whose key only differs in the time go to the same object, named after the first message.
+	partition := w.template.Execute(time.Time{}, fields)
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	buf, ok := w.buffers[partition]
+	if !ok {
+		buf = &s3Buffer{receivedAt: msg.ReceivedAt, fields: fields, created: time.Now(), done: make(chan struct{})}
+		w.buffers[partition] = buf
+	}
+	buf.data.WriteString(content)
+	if !strings.HasSuffix(content, "\n") {
+		buf.data.WriteString("\n")
+	}
+	buf.count++
+
+	if buf.data.Len() >= w.maxSize {
+		w.startUpload(partition)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-buf.done:
+		return buf.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close uploads all the buffers and waits until all the uploads succeed or run out of attempts.
+func (w *S3Writer) Close() {
+	log.Info("Closing S3Writer.")
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.quit)
+	<-w.done
+
+	w.mu.Lock()
+	for partition := range w.buffers {
+		w.startUpload(partition)
+	}
+	w.mu.Unlock()
+	w.uploads.Wait()
+}
+
+// flushOld uploads the buffers older than maxAge, until Close.
+func (w *S3Writer) flushOld() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.maxAge / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			limit := time.Now().Add(-w.maxAge)
+			w.mu.Lock()
+			for partition, buf := range w.buffers {
+				if buf.created.Before(limit) {
+					w.startUpload(partition)
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// startUpload removes the buffer from the map and uploads it in its own goroutine. It must be called holding mu.
+func (w *S3Writer) startUpload(partition string) {
+	buf := w.buffers[partition]
+	delete(w.buffers, partition)
+	w.uploads.Add(1)
+	go func() {
+		defer w.uploads.Done()
+		w.upload(buf)
+	}()
+}
+
+// upload puts the buffer in the bucket, retrying with backoff, and wakes up the writes waiting for it.
+// If all the attempts fail, the writes get the error.
+func (w *S3Writer) upload(buf *s3Buffer) {
+	defer close(buf.done)
+	fields := make(map[string]string, len(buf.fields)+1)
+	for k, v := range buf.fields {
+		fields[k] = v
+	}
+	fields["object_id"] = randomID()
+	key := w.template.Execute(buf.receivedAt.UTC(), fields)
+
+	body := buf.data.Bytes()
+	contentType := "application/x-ndjson"
+	if w.compression == "gzip" {
+		var b bytes.Buffer
+		err := compressTo(&b, bytes.NewReader(body), "gzip")
+		if err != nil {
+			slog.Error(fmt.Sprintf("Compression of %d messages for %q failed: %v", buf.count, key, err))
+			buf.err = err
+			return
+		}
+		body = b.Bytes()
+		contentType = "application/gzip"
+	}
+
+	backoff := defaultRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := w.putObject(key, body, contentType)
+		if err == nil {
+			log.Info(fmt.Sprintf("Uploaded %d messages to %q.", buf.count, key))
+			return
+		}
+		if attempt == s3UploadAttempts {
+			slog.Error(fmt.Sprintf("Upload of %d messages to %q failed: %v", buf.count, key, err))
+			buf.err = err
+			return
+		}
+		slog.Error(fmt.Sprintf("Upload attempt %d to %q failed: %v", attempt, key, err))
+		time.Sleep(jitter(backoff))
+		backoff *= 2
+	}
+}
+
+// putObject sends a PUT request signed with AWS Signature Version 4, using path style urls.
+func (w *S3Writer) putObject(key string, body []byte, contentType string) error {
+	u := *w.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + w.bucket + "/" + key
+	u.RawPath = ""
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	payloadHash := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(payloadHash[:]), w.accessKey, w.secretKey, w.region, "s3", time.Now())
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPErrorBody))
+		return fmt.Errorf("S3 answered %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// signV4 adds the x-amz-date, x-amz-content-sha256 and Authorization headers to the request.
+// All the headers already in the request are signed, along with the host.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := strings.Join([]string{now.Format(s3DateFormat), region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data with the key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query parameters sorted and encoded the way SigV4 expects.
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := values[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode encodes every byte except the unreserved characters, and the slashes when encodeSlash is false.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// randomID returns 8 random bytes in hex, to make object keys unique.
+func randomID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
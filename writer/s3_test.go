@@ -0,0 +1,329 @@
+package writer_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 stores the objects it receives, after checking that the requests are signed. It fails the first failures requests.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	failures int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+func (s *fakeS3) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	hash := sha256.Sum256(body)
+	if r.Method != http.MethodPut || r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) ||
+		!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	s.objects[r.URL.Path] = body
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (s *fakeS3) Objects() map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects := make(map[string][]byte, len(s.objects))
+	for k, v := range s.objects {
+		objects[k] = v
+	}
+	return objects
+}
+
+// startWrites writes each message in its own goroutine, as the requests do, because Write waits for the upload.
+// The returned function waits for the writes and returns their errors.
+func startWrites(w writer.Writer, msgs []writer.Message) func() []error {
+	errs := make([]error, len(msgs))
+	var wg sync.WaitGroup
+	for i := range msgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = w.Write(context.Background(), msgs[i])
+		}(i)
+	}
+	return func() []error {
+		wg.Wait()
+		return errs
+	}
+}
+
+func s3Params(url string) map[string]string {
+	return map[string]string{
+		"endpoint": url, "bucket": "logs", "access_key": "access", "secret_key": "secret",
+		"key_template": "{service}/{yyyy-MM-dd}/{source}.ndjson",
+	}
+}
+
+func TestS3Writer_Close(t *testing.T) {
+	s := newFakeS3()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	w, err := writer.NewS3Writer(s3Params(server.URL))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	var msgs []writer.Message
+	for i, source := range []string{"a", "b", "a"} {
+		msgs = append(msgs, writer.Message{Service: "test", ReceivedAt: ts, Extracted: map[string]string{"source": source}, Body: fmt.Sprintf("message %d", i)})
+	}
+	wait := startWrites(w, msgs)
+	time.Sleep(100 * time.Millisecond)
+	if len(s.Objects()) != 0 {
+		t.Log("Expected no objects before Close.")
+		t.FailNow()
+	}
+	w.Close()
+	for _, err := range wait() {
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	expected := map[string][]string{
+		"/logs/test/2021-03-04/a.ndjson": {"message 0", "message 2"},
+		"/logs/test/2021-03-04/b.ndjson": {"message 1"},
+	}
+	objects := s.Objects()
+	if len(objects) != len(expected) {
+		t.Log(fmt.Sprintf("Expected objects: %v, received: %v", expected, objects))
+		t.FailNow()
+	}
+	for k, lines := range expected {
+		object := string(objects[k])
+		if strings.Count(object, "\n") != len(lines) {
+			t.Log(fmt.Sprintf("Expected object %s: %q, received: %q", k, lines, object))
+			t.Fail()
+		}
+		for _, line := range lines {
+			if !strings.Contains(object, line+"\n") {
+				t.Log(fmt.Sprintf("Expected object %s: %q, received: %q", k, lines, object))
+				t.Fail()
+			}
+		}
+	}
+
+	err = w.Write(context.Background(), writer.Message{Body: "late"})
+	if err != writer.ErrClosed {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", writer.ErrClosed, err))
+		t.FailNow()
+	}
+}
+
+func TestS3Writer_MaxObjectSize(t *testing.T) {
+	s := newFakeS3()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	params := s3Params(server.URL)
+	params["key_template"] = "{service}/{object_id}.ndjson"
+	params["max_object_size"] = "20"
+	w, err := writer.NewS3Writer(params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	var msgs []writer.Message
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, writer.Message{Service: "test", Body: fmt.Sprintf("message %d", i)})
+	}
+	for _, err := range startWrites(w, msgs)() {
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	// Each object is uploaded once it reaches 20 bytes, that is every two messages, and the writes return after it.
+	objects := s.Objects()
+	if len(objects) != 2 {
+		t.Log(fmt.Sprintf("Expected objects: %v, received: %v", 2, len(objects)))
+		t.FailNow()
+	}
+	for k, v := range objects {
+		if !strings.HasPrefix(k, "/logs/test/") || strings.Count(string(v), "\n") != 2 {
+			t.Log(fmt.Sprintf("Unexpected object %s: %q", k, v))
+			t.Fail()
+		}
+	}
+}
+
+func TestS3Writer_MaxObjectAge(t *testing.T) {
+	s := newFakeS3()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	params := s3Params(server.URL)
+	params["max_object_age"] = "100ms"
+	w, err := writer.NewS3Writer(params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	start := time.Now()
+	err = w.Write(context.Background(), writer.Message{Service: "test", Body: "message"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// Write returns once the object is uploaded, after max_object_age.
+	objects := s.Objects()
+	if time.Since(start) < 100*time.Millisecond || len(objects) != 1 {
+		t.Log(fmt.Sprintf("Expected objects: %v, received: %v", 1, len(objects)))
+		t.FailNow()
+	}
+}
+
+func TestS3Writer_Gzip(t *testing.T) {
+	s := newFakeS3()
+	// The first upload fails, the writer retries.
+	s.failures = 1
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	params := s3Params(server.URL)
+	params["compression"] = "gzip"
+	params["key_template"] = "{service}.ndjson.gz"
+	params["format"] = "json"
+	params["max_object_age"] = "50ms"
+	w, err := writer.NewS3Writer(params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = w.Write(context.Background(), writer.Message{Service: "test", Body: "message"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+
+	object, ok := s.Objects()["/logs/test.ndjson.gz"]
+	if !ok {
+		t.Log(fmt.Sprintf("Object not found: %v", s.Objects()))
+		t.FailNow()
+	}
+	r, err := gzip.NewReader(bytes.NewReader(object))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if !strings.Contains(string(content), `"body":"message"`) {
+		t.Log(fmt.Sprintf("Unexpected content: %q", content))
+		t.FailNow()
+	}
+}
+
+func TestS3Writer_UploadFails(t *testing.T) {
+	s := newFakeS3()
+	// All the attempts fail.
+	s.failures = 100
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	params := s3Params(server.URL)
+	params["max_object_age"] = "50ms"
+	w, err := writer.NewS3Writer(params)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	// The write gets the error, so the message isn't acknowledged.
+	err = w.Write(context.Background(), writer.Message{Service: "test", Body: "message"})
+	if err == nil {
+		t.Log("Expected error for a failed upload.")
+		t.FailNow()
+	}
+}
+
+func TestS3Writer_CloseWaitsForRetries(t *testing.T) {
+	s := newFakeS3()
+	// The first attempts fail, the writer retries with backoff.
+	s.failures = 2
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	w, err := writer.NewS3Writer(s3Params(server.URL))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	wait := startWrites(w, []writer.Message{{Service: "test", Body: "message"}})
+	time.Sleep(50 * time.Millisecond)
+
+	// Close uploads the buffer and doesn't return until the retries succeed.
+	w.Close()
+	if len(s.Objects()) != 1 {
+		t.Log(fmt.Sprintf("Expected objects: %v, received: %v", 1, s.Objects()))
+		t.FailNow()
+	}
+	for _, err := range wait() {
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestNewS3Writer_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"bucket": "logs"},
+		{"endpoint": "http://localhost:9000"},
+		{"endpoint": "http://localhost:9000", "bucket": "logs", "compression": "lz4"},
+		{"endpoint": "http://localhost:9000", "bucket": "logs", "max_object_size": "0"},
+		{"endpoint": "http://localhost:9000", "bucket": "logs", "max_object_age": "soon"},
+		{"endpoint": "http://localhost:9000", "bucket": "logs", "key_template": "{service"},
+	}
+	for _, params := range tests {
+		_, err := writer.NewS3Writer(params)
+		if err == nil {
+			t.Log(fmt.Sprintf("Expected an error for params: %v", params))
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,341 @@
+/*
+This file has the SocketWriter, it sends the messages as syslog or raw lines over TCP, UDP or Unix sockets.
+*/
+package writer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default values for the SocketWriter parameters.
+const (
+	defaultSocketQueueSize = 1000
+	defaultSocketTimeout   = 5 * time.Second
+	defaultSyslogAppName   = "data-receiver"
+	// syslogTimeFormat is RFC 3339 with the microseconds RFC 5424 allows.
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// ErrQueueFull is returned when the writer can't hold any more messages until it reconnects.
+var ErrQueueFull = errors.New("Writer queue is full.")
+
+// dialSocket opens the connections of the SocketWriters.
+var dialSocket = net.DialTimeout
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18,
+	"local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// SocketWriter queues the messages and sends them from a goroutine over a connection, reconnecting with backoff
+// when it fails. Write returns once the message is queued, and fails with ErrQueueFull when the queue is full.
+// Delivery is at least once: a message whose write fails is sent again, whole, on the next connection, even if the
+// receiver got it before the connection broke.
+type SocketWriter struct {
+	network    string
+	address    string
+	frame      func(Message) ([]byte, error)
+	queue      chan []byte
+	backoff    time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+
+	closedMu sync.RWMutex
+	closed   bool
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// NewLineWriter creates a SocketWriter that sends every message as a line.
+// Its parameters are network (tcp, udp, unix or unixgram), address, format, queue_size, timeout,
+// reconnect_backoff and reconnect_max_backoff.
+func NewLineWriter(params map[string]string) (*SocketWriter, error) {
+	format, err := parseFormat(params)
+	if err != nil {
+		return nil, err
+	}
+	frame := func(msg Message) ([]byte, error) {
+		content, err := msg.Format(format)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimSuffix(content, "\n") + "\n"), nil
+	}
+	return newSocketWriter(params, frame)
+}
+
+// NewSyslogWriter creates a SocketWriter that sends every message in the RFC 5424 syslog format, with the service
+// as MSGID. Besides the LineWriter parameters, it has facility (local0 by default), severity (info by default),
+// hostname, app_name and framing, octet counting (octet, the default) or newline for stream sockets.
+func NewSyslogWriter(params map[string]string) (*SocketWriter, error) {
+	format, err := parseFormat(params)
+	if err != nil {
+		return nil, err
+	}
+	facility, ok := syslogFacilities[params["facility"]]
+	if params["facility"] == "" {
+		facility, ok = syslogFacilities["local0"], true
+	}
+	if !ok {
+		return nil, fmt.Errorf("Invalid facility %q.", params["facility"])
+	}
+	severity, ok := syslogSeverities[params["severity"]]
+	if params["severity"] == "" {
+		severity, ok = syslogSeverities["info"], true
+	}
+	if !ok {
+		return nil, fmt.Errorf("Invalid severity %q.", params["severity"])
+	}
+	hostname := params["hostname"]
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	appName := params["app_name"]
+	if appName == "" {
+		appName = defaultSyslogAppName
+	}
+	stream := params["network"] != "udp" && params["network"] != "unixgram"
+	octet := stream
+	switch params["framing"] {
+	case "", "octet":
+	case "newline":
+		octet = false
+	default:
+		return nil, fmt.Errorf("Invalid framing %q.", params["framing"])
+	}
+
+	priority := fmt.Sprintf("<%d>1 ", facility*8+severity)
+	origin := fmt.Sprintf(" %s %s %d ", syslogField(hostname, 255), syslogField(appName, 48), os.Getpid())
+	frame := func(msg Message) ([]byte, error) {
+		content, err := msg.Format(format)
+		if err != nil {
+			return nil, err
+		}
+		ts := msg.ReceivedAt
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		line := priority + ts.UTC().Format(syslogTimeFormat) + origin + syslogField(msg.Service, 32) + " - " +
+			strings.TrimSuffix(content, "\n")
+		switch {
+		case octet:
+			line = strconv.Itoa(len(line)) + " " + line
+		case stream:
+			line += "\n"
+		}
+		return []byte(line), nil
+	}
+	return newSocketWriter(params, frame)
+}
+
+// syslogField returns the value as a syslog header field: printable ASCII without spaces, up to max characters,
+// and "-" when empty.
+func syslogField(s string, max int) string {
+	var b strings.Builder
+	for i := 0; i < len(s) && b.Len() < max; i++ {
+		if s[i] > 32 && s[i] < 127 {
+			b.WriteByte(s[i])
+		}
+	}
+	if b.Len() == 0 {
+		return "-"
+	}
+	return b.String()
+}
+
+// newSocketWriter validates the connection parameters and starts the goroutine sending the messages.
+func newSocketWriter(params map[string]string, frame func(Message) ([]byte, error)) (*SocketWriter, error) {
+	w := &SocketWriter{
+		network:    params["network"],
+		address:    params["address"],
+		frame:      frame,
+		backoff:    defaultRetryBackoff,
+		maxBackoff: defaultRetryMaxBackoff,
+		timeout:    defaultSocketTimeout,
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	switch w.network {
+	case "tcp", "udp", "unix", "unixgram":
+	case "":
+		w.network = "tcp"
+	default:
+		return nil, fmt.Errorf("Invalid network %q.", w.network)
+	}
+	if w.address == "" {
+		return nil, errors.New("address not received for socket writer.")
+	}
+
+	queueSize, err := intParam(params, "queue_size", defaultSocketQueueSize)
+	if err != nil {
+		return nil, err
+	}
+	w.queue = make(chan []byte, queueSize)
+	for name, d := range map[string]*time.Duration{
+		"timeout": &w.timeout, "reconnect_backoff": &w.backoff, "reconnect_max_backoff": &w.maxBackoff,
+	} {
+		if v, ok := params[name]; ok {
+			*d, err = time.ParseDuration(v)
+			if err != nil || *d <= 0 {
+				return nil, fmt.Errorf("Invalid %s %q.", name, v)
+			}
+		}
+	}
+
+	go w.run()
+	log.Info(fmt.Sprintf("Starting socket writer to %s %s.", w.network, w.address))
+	return w, nil
+}
+
+// Write queues the message.
+func (w *SocketWriter) Write(ctx context.Context, msg Message) error {
+	b, err := w.frame(msg)
+	if err != nil {
+		return err
+	}
+
+	w.closedMu.RLock()
+	defer w.closedMu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	select {
+	case w.queue <- b:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close sends the queued messages and closes the connection. Messages still queued when it can't connect are lost.
+func (w *SocketWriter) Close() {
+	log.Info("Closing socket writer.")
+	w.closedMu.Lock()
+	if w.closed {
+		w.closedMu.Unlock()
+		return
+	}
+	w.closed = true
+	w.closedMu.Unlock()
+
+	close(w.quit)
+	<-w.done
+}
+
+// run sends the queued messages, reconnecting with backoff, until Close.
+// A message whose send fails is sent again after reconnecting. The broken connection is closed, so the receiver drops
+// the part of the message it got there instead of joining it with the next one.
+func (w *SocketWriter) run() {
+	defer close(w.done)
+	var conn net.Conn
+	var pending []byte
+	backoff := w.backoff
+
+	for {
+		if pending == nil {
+			select {
+			case pending = <-w.queue:
+			case <-w.quit:
+				w.drain(conn, nil)
+				return
+			}
+		}
+
+		if conn == nil {
+			var err error
+			conn, err = dialSocket(w.network, w.address, w.timeout)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Connection to %s %s failed: %v", w.network, w.address, err))
+				select {
+				case <-time.After(jitter(backoff)):
+				case <-w.quit:
+					w.drain(nil, pending)
+					return
+				}
+				backoff *= 2
+				if backoff > w.maxBackoff {
+					backoff = w.maxBackoff
+				}
+				continue
+			}
+			backoff = w.backoff
+		}
+
+		err := w.send(conn, pending)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Write to %s %s failed: %v", w.network, w.address, err))
+			conn.Close()
+			conn = nil
+			continue
+		}
+		pending = nil
+	}
+}
+
+// drain sends pending and the queued messages when closing, connecting once if needed.
+func (w *SocketWriter) drain(conn net.Conn, pending []byte) {
+	msgs := len(w.queue)
+	if pending != nil {
+		msgs++
+	}
+	if msgs == 0 {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+
+	var err error
+	if conn == nil {
+		conn, err = dialSocket(w.network, w.address, w.timeout)
+		if err != nil {
+			slog.Error(fmt.Sprintf("%d queued messages lost, connection to %s %s failed: %v", msgs, w.network, w.address, err))
+			return
+		}
+	}
+	defer conn.Close()
+
+	if pending != nil {
+		err = w.send(conn, pending)
+	}
+	for err == nil {
+		select {
+		case b := <-w.queue:
+			err = w.send(conn, b)
+		default:
+			return
+		}
+	}
+	slog.Error(fmt.Sprintf("%d queued messages lost, write to %s %s failed: %v", len(w.queue)+1, w.network, w.address, err))
+}
+
+// send writes the message with the timeout. When the write times out after sending part of the message, the rest is
+// written on the same connection, with the timeout again, as long as some of it goes through: the receiver has the
+// first part, so sending the whole message there would break the framing.
+func (w *SocketWriter) send(conn net.Conn, b []byte) error {
+	for {
+		err := conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		if err != nil {
+			return err
+		}
+		n, err := conn.Write(b)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && n > 0 && n < len(b) {
+			b = b[n:]
+			continue
+		}
+		return err
+	}
+}
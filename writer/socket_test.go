@@ -0,0 +1,330 @@
+package writer_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptLines reads the lines of every connection to the listener and sends them to the channel.
+func acceptLines(l net.Listener, lines chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}()
+	}
+}
+
+// receiveLines waits for n lines, or a second.
+func receiveLines(lines <-chan string, n int) []string {
+	var received []string
+	timeout := time.After(time.Second)
+	for len(received) < n {
+		select {
+		case line := <-lines:
+			received = append(received, line)
+		case <-timeout:
+			return received
+		}
+	}
+	return received
+}
+
+func TestLineWriter_Unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lines.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer l.Close()
+	lines := make(chan string, 10)
+	go acceptLines(l, lines)
+
+	w, err := writer.NewLineWriter(map[string]string{"network": "unix", "address": path})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		err = w.Write(context.Background(), writer.Message{Body: fmt.Sprintf("message %d", i)})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	expected := []string{"message 0", "message 1", "message 2"}
+	received := receiveLines(lines, 3)
+	if strings.Join(received, ",") != strings.Join(expected, ",") {
+		t.Log(fmt.Sprintf("Expected lines: %v, received: %v", expected, received))
+		t.FailNow()
+	}
+}
+
+func TestSyslogWriter_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	w, err := writer.NewSyslogWriter(map[string]string{
+		"network": "udp", "address": conn.LocalAddr().String(), "hostname": "edge 1", "facility": "local3", "severity": "notice",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 890000000, time.UTC)
+	err = w.Write(context.Background(), writer.Message{Service: "test", ReceivedAt: ts, Body: "test message\n"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	b := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// local3 is 19 and notice is 5: 19 * 8 + 5 = 157.
+	expected := fmt.Sprintf("<157>1 2021-03-04T05:06:07.890000Z edge1 data-receiver %d test - test message", os.Getpid())
+	if string(b[:n]) != expected {
+		t.Log(fmt.Sprintf("Expected datagram: %q, received: %q", expected, b[:n]))
+		t.FailNow()
+	}
+}
+
+func TestSyslogWriter_Reconnect(t *testing.T) {
+	// Take a free port, nothing listens on it until the messages are queued.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	w, err := writer.NewSyslogWriter(map[string]string{
+		"address": address, "app_name": "receiver", "framing": "newline",
+		"reconnect_backoff": "10ms", "reconnect_max_backoff": "50ms",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		err = w.Write(context.Background(), writer.Message{Service: "test", Body: fmt.Sprintf("message %d", i)})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	l, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer l.Close()
+	lines := make(chan string, 10)
+	go acceptLines(l, lines)
+
+	received := receiveLines(lines, 3)
+	if len(received) != 3 {
+		t.Log(fmt.Sprintf("Expected lines: %v, received: %v", 3, received))
+		t.FailNow()
+	}
+	for i, line := range received {
+		if !strings.HasPrefix(line, "<134>1 ") || !strings.HasSuffix(line, fmt.Sprintf(" receiver %d test - message %d", os.Getpid(), i)) {
+			t.Log(fmt.Sprintf("Unexpected line: %q", line))
+			t.Fail()
+		}
+	}
+}
+
+func TestSyslogWriter_OctetCounting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer l.Close()
+	lines := make(chan string, 10)
+	go acceptLines(l, lines)
+
+	w, err := writer.NewSyslogWriter(map[string]string{"address": l.Addr().String(), "hostname": "edge"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = w.Write(context.Background(), writer.Message{Service: "test", Body: "first line\nsecond line"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+
+	// The frame is the length of the message and the message, which can have new lines.
+	received := strings.Join(receiveLines(lines, 2), "\n")
+	parts := strings.SplitN(received, " ", 2)
+	if len(parts) != 2 || parts[0] != fmt.Sprint(len(parts[1])) || !strings.HasSuffix(parts[1], "first line\nsecond line") {
+		t.Log(fmt.Sprintf("Unexpected frame: %q", received))
+		t.FailNow()
+	}
+}
+
+func TestSocketWriter_QueueFull(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	w, err := writer.NewLineWriter(map[string]string{"address": address, "queue_size": "2", "reconnect_backoff": "1s"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	// The writer holds the message it's sending and the queued ones.
+	for i := 0; i < 4; i++ {
+		err = w.Write(context.Background(), writer.Message{Body: "message"})
+		if err != nil {
+			break
+		}
+	}
+	if err != writer.ErrQueueFull {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", writer.ErrQueueFull, err))
+		t.FailNow()
+	}
+}
+
+// timeoutError is the error of a write that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "Write timed out." }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// partialConn is a connection whose first write sends half of the data and fails with err.
+type partialConn struct {
+	net.Conn
+	err     error
+	failed  bool
+	written []byte
+}
+
+func (c *partialConn) Write(b []byte) (int, error) {
+	if !c.failed {
+		c.failed = true
+		c.written = append(c.written, b[:len(b)/2]...)
+		return len(b) / 2, c.err
+	}
+	c.written = append(c.written, b...)
+	return len(b), nil
+}
+
+func (c *partialConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *partialConn) Close() error                     { return nil }
+
+func TestSocketWriter_PartialWrite(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected []string
+	}{
+		// The rest of the line is written after the timeout, on the same connection.
+		{timeoutError{}, []string{"message 1\nmessage 2\n"}},
+		// The connection is broken, the whole line is sent again on a new one.
+		{errors.New("Connection reset."), []string{"messa", "message 1\nmessage 2\n"}},
+	}
+	for _, test := range tests {
+		var conns []*partialConn
+		restore := writer.SetSocketDial(func(string, string, time.Duration) (net.Conn, error) {
+			conn := &partialConn{err: test.err, failed: len(conns) > 0}
+			conns = append(conns, conn)
+			return conn, nil
+		})
+		w, err := writer.NewLineWriter(map[string]string{"address": "localhost:514", "reconnect_backoff": "1ms"})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		for i := 1; i <= 2; i++ {
+			err = w.Write(context.Background(), writer.Message{Body: fmt.Sprintf("message %d", i)})
+			if err != nil {
+				t.Error(err)
+				t.FailNow()
+			}
+		}
+		// Close only sends the queued messages on one try, so they're sent before.
+		time.Sleep(100 * time.Millisecond)
+		w.Close()
+		restore()
+
+		var received []string
+		for _, conn := range conns {
+			received = append(received, string(conn.written))
+		}
+		if fmt.Sprintf("%q", received) != fmt.Sprintf("%q", test.expected) {
+			t.Log(fmt.Sprintf("Expected data by connection: %q, received: %q", test.expected, received))
+			t.FailNow()
+		}
+	}
+}
+
+func TestNewSocketWriter_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"network": "tcp"},
+		{"network": "sctp", "address": "localhost:514"},
+		{"address": "localhost:514", "queue_size": "0"},
+		{"address": "localhost:514", "reconnect_backoff": "soon"},
+		{"address": "localhost:514", "facility": "local9"},
+		{"address": "localhost:514", "severity": "bad"},
+		{"address": "localhost:514", "framing": "cobs"},
+	}
+	for _, params := range tests {
+		_, err := writer.NewSyslogWriter(params)
+		if err == nil {
+			t.Log(fmt.Sprintf("Expected an error for params: %v", params))
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,558 @@
+/*
+This file has the SpoolWriter, a durable local queue that acknowledges messages once they're synced to the disk
+and writes them to another writer in the background.
+*/
+package writer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default values and limits of the spool.
+const (
+	defaultSegmentSize = 64 * 1024 * 1024
+	maxSpoolRecord     = 64 * 1024 * 1024
+	spoolHeaderSize    = 8
+	spoolSegmentExt    = ".seg"
+	spoolCheckpoint    = "checkpoint"
+	spoolLock          = "lock"
+	spoolPollInterval  = time.Second
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+	// errCorruptRecord is returned when a record has an invalid length or checksum.
+	errCorruptRecord = errors.New("Corrupt spool record.")
+	// errInvalidMessage is returned with the size of a valid record whose payload isn't a message.
+	errInvalidMessage = errors.New("Spool record isn't a message.")
+)
+
+// SpoolOptions are the options of a SpoolWriter.
+type SpoolOptions struct {
+	// SegmentSize is the size at which the segments are rotated.
+	SegmentSize int64
+	// BatchMessages and BatchBytes limit the messages written at once with WriteBatch, when the inner writer implements it.
+	// The spool doesn't wait to fill a batch, it takes the messages already synced. Zero disables a limit, and when
+	// both are zero the messages are written one by one.
+	BatchMessages int
+	BatchBytes    int
+}
+
+// SpoolWriter appends every message to a segment file in a directory and syncs it before Write returns.
+// A background goroutine reads the segments in order, writes the messages to the inner writer, in batches if it
+// implements BatchWriter, and saves its position in a checkpoint file after each write, so after a restart it resumes
+// from the last message written.
+// Records have an 8 bytes header, the length and the CRC-32C of the payload, and the payload is the message as Json.
+// The writer holds the lock of the directory while it's open, so two spools can't share it.
+type SpoolWriter struct {
+	w    Writer
+	dir  string
+	opts SpoolOptions
+	lock *os.File
+
+	// mu protects the segment being written and the committed position, the reader only reads up to that position.
+	mu       sync.Mutex
+	file     *os.File
+	writeSeg int64
+	writeOff int64
+	closed   bool
+
+	notify chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// newSpoolWriter wraps the writer with a spool in spool_dir, segments are rotated at spool_segment_size bytes.
+// The batching parameters set the size of the batches the spool writes, the batches aren't formed by a BatchingWriter
+// because it would wait batch_interval for every message the spool sends.
+func newSpoolWriter(w Writer, params map[string]string) (*SpoolWriter, error) {
+	opts := SpoolOptions{SegmentSize: defaultSegmentSize}
+	if v, ok := params["spool_segment_size"]; ok {
+		var err error
+		opts.SegmentSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || opts.SegmentSize <= 0 {
+			return nil, fmt.Errorf("Invalid spool_segment_size %q.", v)
+		}
+	}
+	if hasBatchingParams(params) {
+		batching, err := parseBatchingOptions(params)
+		if err != nil {
+			return nil, err
+		}
+		opts.BatchMessages, opts.BatchBytes = batching.MaxMessages, batching.MaxBytes
+	}
+	return NewSpoolWriterWithOptions(w, params["spool_dir"], opts)
+}
+
+// NewSpoolWriter creates a spool that writes the messages one by one, with segments rotated at segmentSize bytes.
+func NewSpoolWriter(w Writer, dir string, segmentSize int64) (*SpoolWriter, error) {
+	return NewSpoolWriterWithOptions(w, dir, SpoolOptions{SegmentSize: segmentSize})
+}
+
+// NewSpoolWriterWithOptions creates the directory if needed, locks it, starts a new segment and starts draining
+// the pending messages. It fails if the directory is locked by another spool, of this or another process.
+func NewSpoolWriterWithOptions(w Writer, dir string, opts SpoolOptions) (*SpoolWriter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(dir, spoolLock))
+	if err != nil {
+		return nil, fmt.Errorf("Spool directory %q is in use by another writer: %v", dir, err)
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	readSeg, readOff, err := readCheckpoint(dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	// Segments before the checkpoint were already written, a missing checkpoint segment moves it to the next one.
+	var pending []int64
+	for _, seg := range segments {
+		if seg >= readSeg {
+			pending = append(pending, seg)
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, segmentName(seg)))
+		if err != nil {
+			slog.Error(err.Error())
+		}
+	}
+	if len(pending) == 0 || pending[0] != readSeg {
+		readOff = 0
+		if len(pending) > 0 {
+			readSeg = pending[0]
+		}
+	}
+
+	// Segments from previous runs are never written again, so a record cut by a crash can only be at their end.
+	writeSeg := readSeg
+	if len(pending) > 0 {
+		writeSeg = pending[len(pending)-1] + 1
+	}
+
+	s := &SpoolWriter{
+		w:        w,
+		dir:      dir,
+		opts:     opts,
+		lock:     lock,
+		writeSeg: writeSeg,
+		notify:   make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.file, err = os.OpenFile(s.segmentPath(writeSeg), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	err = syncDir(dir)
+	if err != nil {
+		s.file.Close()
+		lock.Close()
+		return nil, err
+	}
+
+	go s.drain(readSeg, readOff)
+	log.Info(fmt.Sprintf("Starting SpoolWriter in %q.", dir))
+	return s, nil
+}
+
+// Write appends the message to the current segment and syncs it, the message is written to the inner writer later.
+func (s *SpoolWriter) Write(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxSpoolRecord {
+		return fmt.Errorf("Message of %d bytes is too big for the spool.", len(payload))
+	}
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, castagnoli))
+	copy(record[spoolHeaderSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.writeOff > 0 && s.writeOff+int64(len(record)) > s.opts.SegmentSize {
+		err = s.rotateSegment()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The offset only moves after the sync, so a failed write is overwritten by the next one.
+	_, err = s.file.WriteAt(record, s.writeOff)
+	if err != nil {
+		return err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.writeOff += int64(len(record))
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close stops accepting messages and waits for the batch being written to the inner writer, then closes it
+// and releases the directory. The messages left in the spool are written after the next start.
+func (s *SpoolWriter) Close() {
+	log.Info("Closing SpoolWriter.")
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	err := s.file.Close()
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	s.mu.Unlock()
+
+	close(s.quit)
+	<-s.done
+	s.w.Close()
+	s.lock.Close()
+}
+
+// rotateSegment closes the current segment and starts the next one. It must be called holding mu.
+func (s *SpoolWriter) rotateSegment() error {
+	file, err := os.OpenFile(s.segmentPath(s.writeSeg+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = syncDir(s.dir)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = s.file.Close()
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	s.file = file
+	s.writeSeg++
+	s.writeOff = 0
+	return nil
+}
+
+// committed returns the segment being written and the end of its synced records.
+func (s *SpoolWriter) committed() (int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeSeg, s.writeOff
+}
+
+// drain reads the records from the position in the checkpoint and writes them to the inner writer, until Close.
+// Close is checked before every batch, so it doesn't wait for the whole backlog.
+func (s *SpoolWriter) drain(seg, off int64) {
+	defer close(s.done)
+
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		default:
+		}
+
+		writeSeg, writeOff := s.committed()
+		if seg == writeSeg && off >= writeOff {
+			select {
+			case <-s.notify:
+			case <-time.After(spoolPollInterval):
+			case <-s.quit:
+				return
+			}
+			continue
+		}
+
+		if file == nil {
+			var err error
+			file, err = os.Open(s.segmentPath(seg))
+			if err != nil && !os.IsNotExist(err) {
+				slog.Error(err.Error())
+				if !s.sleep(spoolPollInterval) {
+					return
+				}
+				continue
+			}
+		}
+
+		// The batch takes the records until a limit, the end of the synced records or an error. The error is handled
+		// once the records before it are written, when it's the first record of the next batch.
+		var msgs []Message
+		var batchBytes int
+		var size int64
+		var err error
+		next := off
+		for {
+			if file == nil {
+				err = io.EOF
+				break
+			}
+			var msg Message
+			msg, size, err = readSpoolRecord(file, next)
+			if err != nil {
+				break
+			}
+			msgs = append(msgs, msg)
+			batchBytes += len(msg.Body)
+			next += size
+			if !s.fits(len(msgs), batchBytes) || seg == writeSeg && next >= writeOff {
+				break
+			}
+		}
+		if len(msgs) > 0 {
+			if !s.deliver(msgs) {
+				return
+			}
+			off = next
+			s.saveCheckpoint(seg, off)
+			continue
+		}
+
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptRecord:
+			if seg == writeSeg {
+				// Synced records can't be incomplete, the rest of the segment is skipped.
+				slog.Error(fmt.Sprintf("Skipping corrupt data in spool segment %d from offset %d.", seg, off))
+				off = writeOff
+				s.saveCheckpoint(seg, off)
+				continue
+			}
+			if err != io.EOF {
+				slog.Error(fmt.Sprintf("Skipping the end of spool segment %d from offset %d: %v", seg, off, err))
+			}
+			// The old segment is done, the checkpoint moves to the next one before deleting it.
+			if file != nil {
+				file.Close()
+				file = nil
+			}
+			old := seg
+			seg, off = seg+1, 0
+			s.saveCheckpoint(seg, off)
+			err = os.Remove(s.segmentPath(old))
+			if err != nil && !os.IsNotExist(err) {
+				slog.Error(err.Error())
+			}
+			continue
+		case err == errInvalidMessage:
+			slog.Error(fmt.Sprintf("Skipping spool record in segment %d at offset %d: %v", seg, off, err))
+			off += size
+			s.saveCheckpoint(seg, off)
+			continue
+		default:
+			slog.Error(err.Error())
+			if !s.sleep(spoolPollInterval) {
+				return
+			}
+		}
+	}
+}
+
+// fits returns true if another message can be added to a batch with n messages and size bytes of bodies.
+// Batches have a single message when the inner writer doesn't implement BatchWriter.
+func (s *SpoolWriter) fits(n, size int) bool {
+	if _, ok := s.w.(BatchWriter); !ok || s.opts.BatchMessages == 0 && s.opts.BatchBytes == 0 {
+		return false
+	}
+	return (s.opts.BatchMessages == 0 || n < s.opts.BatchMessages) && (s.opts.BatchBytes == 0 || size < s.opts.BatchBytes)
+}
+
+// deliver writes the messages to the inner writer, retrying with backoff until it succeeds.
+// It returns false if the writer was closed before the messages could be written.
+func (s *SpoolWriter) deliver(msgs []Message) bool {
+	backoff := defaultRetryBackoff
+	for {
+		var err error
+		if bw, ok := s.w.(BatchWriter); ok && len(msgs) > 1 {
+			err = bw.WriteBatch(context.Background(), msgs)
+		} else {
+			err = s.w.Write(context.Background(), msgs[0])
+		}
+		if err == nil {
+			return true
+		}
+		slog.Error(fmt.Sprintf("%d spooled messages couldn't be written, retrying: %v", len(msgs), err))
+		if !s.sleep(jitter(backoff)) {
+			return false
+		}
+		backoff *= 2
+		if backoff > defaultRetryMaxBackoff {
+			backoff = defaultRetryMaxBackoff
+		}
+	}
+}
+
+// sleep waits for d and returns false if the writer is closed meanwhile.
+func (s *SpoolWriter) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+// saveCheckpoint writes the position to a temporary file and renames it, so the checkpoint is never half written,
+// then it syncs the directory so the rename survives a crash.
+func (s *SpoolWriter) saveCheckpoint(seg, off int64) {
+	path := filepath.Join(s.dir, spoolCheckpoint)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	_, err = fmt.Fprintf(file, "%d %d\n", seg, off)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// segmentPath returns the path of a segment in the spool directory.
+func (s *SpoolWriter) segmentPath(seg int64) string {
+	return filepath.Join(s.dir, segmentName(seg))
+}
+
+// segmentName returns the file name of a segment, names are zero padded so they sort in order.
+func segmentName(seg int64) string {
+	return fmt.Sprintf("%020d%s", seg, spoolSegmentExt)
+}
+
+// readSpoolRecord reads the record at the offset and returns the message and the size of the record.
+func readSpoolRecord(file *os.File, off int64) (Message, int64, error) {
+	var msg Message
+	header := make([]byte, spoolHeaderSize)
+	n, err := file.ReadAt(header, off)
+	if err == io.EOF && n == 0 {
+		return msg, 0, io.EOF
+	}
+	if n < spoolHeaderSize {
+		return msg, 0, io.ErrUnexpectedEOF
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxSpoolRecord {
+		return msg, 0, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	n, err = file.ReadAt(payload, off+spoolHeaderSize)
+	if n < len(payload) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return msg, 0, err
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(header[4:8]) {
+		return msg, 0, errCorruptRecord
+	}
+
+	size := int64(spoolHeaderSize + len(payload))
+	err = json.Unmarshal(payload, &msg)
+	if err != nil {
+		return msg, size, errInvalidMessage
+	}
+	return msg, size, nil
+}
+
+// listSegments returns the numbers of the segments in the directory, sorted.
+func listSegments(dir string) ([]int64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int64
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seg, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// readCheckpoint returns the position saved in the checkpoint file, or the beginning if there's none.
+func readCheckpoint(dir string) (int64, int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, spoolCheckpoint))
+	if os.IsNotExist(err) {
+		return 1, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var seg, off int64
+	_, err = fmt.Sscanf(string(b), "%d %d", &seg, &off)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid spool checkpoint %q: %v", string(b), err)
+	}
+	return seg, off, nil
+}
+
+// syncDir syncs a directory, so the files created in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
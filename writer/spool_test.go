@@ -0,0 +1,372 @@
+package writer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// channelWriter sends every message it writes through a channel.
+type channelWriter struct {
+	messages chan writer.Message
+}
+
+func (w *channelWriter) Write(_ context.Context, msg writer.Message) error {
+	w.messages <- msg
+	return nil
+}
+
+func (w *channelWriter) Close() {}
+
+func receive(t *testing.T, w *channelWriter, bodies ...string) {
+	for _, body := range bodies {
+		select {
+		case msg := <-w.messages:
+			if msg.Body != body {
+				t.Log(fmt.Sprintf("Expected msg.Body: %q, received: %q", body, msg.Body))
+				t.FailNow()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log(fmt.Sprintf("Message %q not received.", body))
+			t.FailNow()
+		}
+	}
+	select {
+	case msg := <-w.messages:
+		t.Log(fmt.Sprintf("Unexpected message: %q", msg.Body))
+		t.FailNow()
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// slowWriter takes delay to write every message and counts them.
+type slowWriter struct {
+	delay   time.Duration
+	mu      sync.Mutex
+	written int
+}
+
+func (w *slowWriter) Write(_ context.Context, _ writer.Message) error {
+	time.Sleep(w.delay)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.written++
+	return nil
+}
+
+func (w *slowWriter) Close() {}
+
+func spoolMessages(t *testing.T, w writer.Writer, bodies ...string) {
+	for _, body := range bodies {
+		err := w.Write(context.Background(), writer.Message{Service: "test", Body: body})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestSpoolWriter_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	inner := &channelWriter{messages: make(chan writer.Message, 10)}
+	// Every record goes to its own segment.
+	w, err := writer.NewSpoolWriter(inner, dir, 1)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	spoolMessages(t, w, "Test message 1.", "Test message 2.", "Test message 3.")
+	receive(t, inner, "Test message 1.", "Test message 2.", "Test message 3.")
+	w.Close()
+
+	// The segments already written were deleted, only the one being written remains.
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segments) != 1 {
+		t.Log(fmt.Sprintf("Expected len(segments): %d, received: %d", 1, len(segments)))
+		t.FailNow()
+	}
+}
+
+func TestSpoolWriter_Resume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	inner := &channelWriter{messages: make(chan writer.Message, 10)}
+	w, err := writer.NewSpoolWriter(inner, dir, 1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	spoolMessages(t, w, "Test message 1.")
+	receive(t, inner, "Test message 1.")
+	w.Close()
+
+	// The downstream writer fails, so the messages stay in the spool.
+	failing := &failingWriter{err: errors.New("Write failed.")}
+	w, err = writer.NewSpoolWriter(failing, dir, 1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	spoolMessages(t, w, "Test message 2.", "Test message 3.")
+	w.Close()
+
+	// After a restart only the pending messages are written, in order.
+	w, err = writer.NewSpoolWriter(inner, dir, 1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	spoolMessages(t, w, "Test message 4.")
+	receive(t, inner, "Test message 2.", "Test message 3.", "Test message 4.")
+	w.Close()
+}
+
+func TestSpoolWriter_CorruptTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	failing := &failingWriter{err: errors.New("Write failed.")}
+	w, err := writer.NewSpoolWriter(failing, dir, 1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	spoolMessages(t, w, "Test message 1.")
+	w.Close()
+
+	// Simulates a record cut by a crash at the end of the segment.
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	file.Write([]byte{0, 0, 0, 42, 1, 2})
+	file.Close()
+
+	inner := &channelWriter{messages: make(chan writer.Message, 10)}
+	w, err = writer.NewSpoolWriter(inner, dir, 1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	spoolMessages(t, w, "Test message 2.")
+	receive(t, inner, "Test message 1.", "Test message 2.")
+	w.Close()
+}
+
+// spoolBacklog leaves n messages in the spool directory, by spooling them with a failing writer.
+func spoolBacklog(t *testing.T, dir string, n int) {
+	w, err := writer.NewSpoolWriter(&failingWriter{err: errors.New("Write failed.")}, dir, 1024*1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for i := 0; i < n; i++ {
+		spoolMessages(t, w, fmt.Sprintf("Test message %d.", i))
+	}
+	w.Close()
+}
+
+func TestSpoolWriter_Batches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	spoolBacklog(t, dir, 50)
+
+	r := &batchRecorder{}
+	w, err := writer.NewSpoolWriterWithOptions(r, dir, writer.SpoolOptions{SegmentSize: 1024 * 1024, BatchMessages: 20})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	var batches []int
+	for i := 0; i < 100; i++ {
+		r.mu.Lock()
+		batches = append([]int(nil), r.batches...)
+		r.mu.Unlock()
+		if len(batches) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fmt.Sprint(batches) != "[20 20 10]" {
+		t.Log(fmt.Sprintf("Expected batches: %v, received: %v", []int{20, 20, 10}, batches))
+		t.FailNow()
+	}
+}
+
+func TestSpoolWriter_BatchParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	lines := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		lines += strings.Count(strings.TrimSuffix(string(b), "\n"), "\n") + 1
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	// The spool doesn't wait batch_interval for every message it sends.
+	w, err := writer.CreateWriter("HTTPWriter", map[string]string{
+		"url": server.URL, "spool_dir": dir, "batch_size": "100", "batch_interval": "1s",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		spoolMessages(t, w, fmt.Sprintf("Test message %d.", i))
+	}
+
+	received := 0
+	for time.Since(start) < 900*time.Millisecond {
+		mu.Lock()
+		received = lines
+		mu.Unlock()
+		if received == 50 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received != 50 {
+		t.Log(fmt.Sprintf("Expected messages: %v, received: %v after %v", 50, received, time.Since(start)))
+		t.FailNow()
+	}
+}
+
+func TestSpoolWriter_CloseWithBacklog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	spoolBacklog(t, dir, 50)
+
+	// Writing the backlog takes 2.5s, Close only waits for the message being written.
+	slow := &slowWriter{delay: 50 * time.Millisecond}
+	w, err := writer.NewSpoolWriter(slow, dir, 1024*1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	w.Close()
+	if time.Since(start) > 500*time.Millisecond {
+		t.Log(fmt.Sprintf("Close took %v.", time.Since(start)))
+		t.FailNow()
+	}
+
+	// The rest of the messages are written after the next start.
+	slow.mu.Lock()
+	written := slow.written
+	slow.mu.Unlock()
+	inner := &channelWriter{messages: make(chan writer.Message, 50)}
+	w, err = writer.NewSpoolWriter(inner, dir, 1024*1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+	var bodies []string
+	for i := written; i < 50; i++ {
+		bodies = append(bodies, fmt.Sprintf("Test message %d.", i))
+	}
+	receive(t, inner, bodies...)
+}
+
+func TestSpoolWriter_WriteAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := writer.CreateWriter("MemoryWriter", map[string]string{"spool_dir": dir})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+
+	err = w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != writer.ErrClosed {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", writer.ErrClosed, err))
+		t.FailNow()
+	}
+}
+
+func TestSpoolWriter_DirLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	inner := &channelWriter{messages: make(chan writer.Message, 10)}
+	w, err := writer.NewSpoolWriter(inner, dir, 1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// A second spool in the same directory would truncate the segments of the first one.
+	_, err = writer.NewSpoolWriter(&channelWriter{messages: make(chan writer.Message, 10)}, dir, 1024)
+	if err == nil {
+		w.Close()
+		t.Error("Expected error opening a spool directory that is in use.")
+		t.FailNow()
+	}
+	w.Close()
+
+	// Once the first one is closed, the directory can be used again.
+	w, err = writer.NewSpoolWriter(inner, dir, 1024)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+}
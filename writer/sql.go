@@ -0,0 +1,278 @@
+/*
+This file has the SQLWriter, it inserts the messages in a database through database/sql.
+*/
+package writer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default values for the SQLWriter parameters.
+const (
+	defaultSQLMaxOpenConns = 4
+	defaultSQLMaxIdleConns = 2
+	// defaultSQLMaxParams keeps the multi-row inserts under the lowest limit of the common databases, SQLite's 999.
+	defaultSQLMaxParams = 999
+)
+
+// SQLWriter inserts every message as a row, using an insert statement with placeholders for the envelope fields.
+// Batches are inserted with multi-row inserts inside a transaction.
+type SQLWriter struct {
+	db        *sql.DB
+	prefix    string
+	row       []string
+	suffix    string
+	values    []string
+	dollar    bool
+	maxParams int
+}
+
+// NewSQLWriter creates the writer from its parameters: driver, dsn, statement, placeholder (question or dollar),
+// max_open_conns, max_idle_conns, conn_max_lifetime and max_params.
+// The statement is an insert like "INSERT INTO events (service, body) VALUES ({service}, {body})", the placeholders can be
+// body, service, received_at, remote_ip, request_id, headers, message (the Json envelope), principal (the sender's ID)
+// and extracted.<name>.
+// The driver must be registered in the binary, postgres is.
+func NewSQLWriter(params map[string]string) (*SQLWriter, error) {
+	driver := params["driver"]
+	if driver == "" {
+		return nil, errors.New("driver not received for SQLWriter.")
+	}
+	w := &SQLWriter{maxParams: defaultSQLMaxParams}
+	err := w.parseStatement(params["statement"])
+	if err != nil {
+		return nil, err
+	}
+
+	switch params["placeholder"] {
+	case "":
+		w.dollar = driver == "postgres" || driver == "pgx"
+	case "dollar":
+		w.dollar = true
+	case "question":
+	default:
+		return nil, fmt.Errorf("Invalid placeholder %q.", params["placeholder"])
+	}
+
+	maxOpen, err := intParam(params, "max_open_conns", defaultSQLMaxOpenConns)
+	if err != nil {
+		return nil, err
+	}
+	maxIdle, err := intParam(params, "max_idle_conns", defaultSQLMaxIdleConns)
+	if err != nil {
+		return nil, err
+	}
+	w.maxParams, err = intParam(params, "max_params", defaultSQLMaxParams)
+	if err != nil {
+		return nil, err
+	}
+	if w.maxParams < len(w.values) {
+		return nil, fmt.Errorf("max_params %d is lower than the placeholders in the statement.", w.maxParams)
+	}
+	var lifetime time.Duration
+	if v, ok := params["conn_max_lifetime"]; ok {
+		lifetime, err = time.ParseDuration(v)
+		if err != nil || lifetime <= 0 {
+			return nil, fmt.Errorf("Invalid conn_max_lifetime %q.", v)
+		}
+	}
+
+	w.db, err = sql.Open(driver, params["dsn"])
+	if err != nil {
+		return nil, err
+	}
+	w.db.SetMaxOpenConns(maxOpen)
+	w.db.SetMaxIdleConns(maxIdle)
+	w.db.SetConnMaxLifetime(lifetime)
+
+	log.Info(fmt.Sprintf("Starting SQLWriter with driver %q.", driver))
+	return w, nil
+}
+
+// parseStatement splits the statement in the part before the row of values, the row and the part after it,
+// so batches can repeat the row.
+func (w *SQLWriter) parseStatement(statement string) error {
+	upper := strings.ToUpper(statement)
+	i := strings.LastIndex(upper, "VALUES")
+	if i == -1 {
+		return fmt.Errorf("Statement %q doesn't have VALUES.", statement)
+	}
+	start := strings.Index(statement[i:], "(")
+	if start == -1 {
+		return fmt.Errorf("Statement %q doesn't have a row of values.", statement)
+	}
+	start += i
+	end, depth := -1, 0
+	for j := start; j < len(statement) && end == -1; j++ {
+		switch statement[j] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				end = j + 1
+			}
+		}
+	}
+	if end == -1 {
+		return fmt.Errorf("Unclosed row of values in statement %q.", statement)
+	}
+	w.prefix, w.suffix = statement[:start], statement[end:]
+
+	row := statement[start:end]
+	for len(row) > 0 {
+		open := strings.Index(row, "{")
+		if open == -1 {
+			w.row = append(w.row, row)
+			break
+		}
+		closing := strings.Index(row[open:], "}")
+		if closing == -1 {
+			return fmt.Errorf("Unclosed placeholder in statement %q.", statement)
+		}
+		closing += open
+		name := row[open+1 : closing]
+		if !validSQLValue(name) {
+			return fmt.Errorf("Unknown placeholder %q in statement.", name)
+		}
+		w.row = append(w.row, row[:open])
+		w.values = append(w.values, name)
+		row = row[closing+1:]
+	}
+	if len(w.values) == 0 {
+		return fmt.Errorf("Statement %q doesn't have placeholders.", statement)
+	}
+	return nil
+}
+
+// validSQLValue returns true for the placeholders the statement can use.
+func validSQLValue(name string) bool {
+	switch name {
+	case "body", "service", "received_at", "remote_ip", "request_id", "headers", "message", "principal":
+		return true
+	}
+	return strings.HasPrefix(name, "extracted.") && len(name) > len("extracted.")
+}
+
+// Write inserts the message.
+func (w *SQLWriter) Write(ctx context.Context, msg Message) error {
+	query, args, err := w.insert([]Message{msg})
+	if err != nil {
+		return err
+	}
+	_, err = w.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// WriteBatch inserts the messages in a transaction, with as many rows per insert as max_params allows.
+func (w *SQLWriter) WriteBatch(ctx context.Context, msgs []Message) error {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	rows := w.maxParams / len(w.values)
+	for len(msgs) > 0 {
+		n := rows
+		if n > len(msgs) {
+			n = len(msgs)
+		}
+		query, args, err := w.insert(msgs[:n])
+		if err == nil {
+			_, err = tx.ExecContext(ctx, query, args...)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return tx.Commit()
+}
+
+// Close closes the connections.
+func (w *SQLWriter) Close() {
+	log.Info("Closing SQLWriter.")
+	err := w.db.Close()
+	if err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// insert builds the statement with one row per message, and its arguments.
+func (w *SQLWriter) insert(msgs []Message) (string, []interface{}, error) {
+	var query strings.Builder
+	args := make([]interface{}, 0, len(msgs)*len(w.values))
+	query.WriteString(w.prefix)
+	for i, msg := range msgs {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		for j, name := range w.values {
+			v, err := sqlValue(msg, name)
+			if err != nil {
+				return "", nil, err
+			}
+			args = append(args, v)
+			query.WriteString(w.row[j])
+			if w.dollar {
+				query.WriteString("$" + strconv.Itoa(len(args)))
+			} else {
+				query.WriteString("?")
+			}
+		}
+		query.WriteString(w.row[len(w.values)])
+	}
+	query.WriteString(w.suffix)
+	return query.String(), args, nil
+}
+
+// sqlValue returns the value of a placeholder for the message. Missing extracted values are NULL.
+func sqlValue(msg Message, name string) (interface{}, error) {
+	switch name {
+	case "body":
+		return msg.Body, nil
+	case "service":
+		return msg.Service, nil
+	case "received_at":
+		return msg.ReceivedAt, nil
+	case "remote_ip":
+		return msg.RemoteIP, nil
+	case "request_id":
+		return msg.RequestID, nil
+	case "headers":
+		b, err := json.Marshal(msg.Headers)
+		return string(b), err
+	case "message":
+		return msg.Format(FormatJSON)
+	case "principal":
+		if msg.Principal == nil || msg.Principal.ID == "" {
+			return nil, nil
+		}
+		return msg.Principal.ID, nil
+	}
+	v, ok := msg.Extracted[strings.TrimPrefix(name, "extracted.")]
+	if !ok {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// intParam returns the positive integer in params[name], or def when it isn't set.
+func intParam(params map[string]string, name string, def int) (int, error) {
+	v, ok := params[name]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid %s %q.", name, v)
+	}
+	return n, nil
+}
@@ -0,0 +1,230 @@
+package writer_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/efark/data-receiver/writer"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDriver is a database/sql driver that records the statements executed on each dsn.
+// Statements on the "fail" dsn fail, so transactions get rolled back.
+type recordingDriver struct {
+	mu    sync.Mutex
+	execs map[string][]execution
+	txs   map[string][]string
+}
+
+type execution struct {
+	query string
+	args  []driver.Value
+}
+
+var sqlRecorder = &recordingDriver{execs: make(map[string][]execution), txs: make(map[string][]string)}
+
+func init() {
+	sql.Register("recording", sqlRecorder)
+}
+
+func (d *recordingDriver) Open(dsn string) (driver.Conn, error) {
+	return &recordingConn{d: d, dsn: dsn}, nil
+}
+
+// Reset forgets what was recorded on the dsn, so tests still pass when they run again with -count.
+func (d *recordingDriver) Reset(dsn string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.execs, dsn)
+	delete(d.txs, dsn)
+}
+
+func (d *recordingDriver) Executions(dsn string) []execution {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]execution(nil), d.execs[dsn]...)
+}
+
+func (d *recordingDriver) Transactions(dsn string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.txs[dsn]...)
+}
+
+type recordingConn struct {
+	d   *recordingDriver
+	dsn string
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c: c, query: query}, nil
+}
+
+func (c *recordingConn) Close() error { return nil }
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	return &recordingTx{c: c}, nil
+}
+
+type recordingStmt struct {
+	c     *recordingConn
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.c.dsn == "fail" {
+		return nil, errors.New("insert failed")
+	}
+	s.c.d.mu.Lock()
+	defer s.c.d.mu.Unlock()
+	s.c.d.execs[s.c.dsn] = append(s.c.d.execs[s.c.dsn], execution{query: s.query, args: args})
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+type recordingTx struct {
+	c *recordingConn
+}
+
+func (t *recordingTx) Commit() error {
+	t.c.d.mu.Lock()
+	defer t.c.d.mu.Unlock()
+	t.c.d.txs[t.c.dsn] = append(t.c.d.txs[t.c.dsn], "commit")
+	return nil
+}
+
+func (t *recordingTx) Rollback() error {
+	t.c.d.mu.Lock()
+	defer t.c.d.mu.Unlock()
+	t.c.d.txs[t.c.dsn] = append(t.c.d.txs[t.c.dsn], "rollback")
+	return nil
+}
+
+func TestSQLWriter_Write(t *testing.T) {
+	sqlRecorder.Reset("write")
+	w, err := writer.NewSQLWriter(map[string]string{
+		"driver": "recording", "dsn": "write",
+		"statement": "INSERT INTO events (service, received_at, source, body) VALUES ({service}, {received_at}, {extracted.source}, {body})",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	msg := writer.Message{Service: "test", ReceivedAt: ts, Extracted: map[string]string{"source": "a"}, Body: "test message"}
+	err = w.Write(context.Background(), msg)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := []execution{{
+		query: "INSERT INTO events (service, received_at, source, body) VALUES (?, ?, ?, ?)",
+		args:  []driver.Value{"test", ts, "a", "test message"},
+	}}
+	received := sqlRecorder.Executions("write")
+	if !reflect.DeepEqual(received, expected) {
+		t.Log(fmt.Sprintf("Expected executions: %v, received: %v", expected, received))
+		t.FailNow()
+	}
+}
+
+func TestSQLWriter_WriteBatch(t *testing.T) {
+	sqlRecorder.Reset("batch")
+	w, err := writer.NewSQLWriter(map[string]string{
+		"driver": "recording", "dsn": "batch", "placeholder": "dollar", "max_params": "4",
+		"statement": "INSERT INTO events (source, body) VALUES ({extracted.source}, {body}) ON CONFLICT DO NOTHING",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	msgs := []writer.Message{
+		{Extracted: map[string]string{"source": "a"}, Body: "message 0"},
+		{Body: "message 1"},
+		{Extracted: map[string]string{"source": "c"}, Body: "message 2"},
+	}
+	err = w.WriteBatch(context.Background(), msgs)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// max_params allows two rows per insert, the missing source is NULL.
+	expected := []execution{
+		{
+			query: "INSERT INTO events (source, body) VALUES ($1, $2), ($3, $4) ON CONFLICT DO NOTHING",
+			args:  []driver.Value{"a", "message 0", nil, "message 1"},
+		},
+		{
+			query: "INSERT INTO events (source, body) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			args:  []driver.Value{"c", "message 2"},
+		},
+	}
+	received := sqlRecorder.Executions("batch")
+	if !reflect.DeepEqual(received, expected) {
+		t.Log(fmt.Sprintf("Expected executions: %v, received: %v", expected, received))
+		t.FailNow()
+	}
+	if txs := sqlRecorder.Transactions("batch"); !reflect.DeepEqual(txs, []string{"commit"}) {
+		t.Log(fmt.Sprintf("Expected transactions: %v, received: %v", []string{"commit"}, txs))
+		t.FailNow()
+	}
+}
+
+func TestSQLWriter_WriteBatchError(t *testing.T) {
+	sqlRecorder.Reset("fail")
+	w, err := writer.NewSQLWriter(map[string]string{
+		"driver": "recording", "dsn": "fail", "statement": "INSERT INTO events (body) VALUES ({body})",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	err = w.WriteBatch(context.Background(), []writer.Message{{Body: "message 0"}, {Body: "message 1"}})
+	if err == nil {
+		t.Log("Expected an error.")
+		t.FailNow()
+	}
+	if txs := sqlRecorder.Transactions("fail"); !reflect.DeepEqual(txs, []string{"rollback"}) {
+		t.Log(fmt.Sprintf("Expected transactions: %v, received: %v", []string{"rollback"}, txs))
+		t.FailNow()
+	}
+}
+
+func TestNewSQLWriter_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"statement": "INSERT INTO events (body) VALUES ({body})"},
+		{"driver": "recording", "statement": "INSERT INTO events (body) SELECT 1"},
+		{"driver": "recording", "statement": "INSERT INTO events (body) VALUES ('fixed')"},
+		{"driver": "recording", "statement": "INSERT INTO events (body) VALUES ({payload})"},
+		{"driver": "recording", "statement": "INSERT INTO events (body) VALUES ({body}"},
+		{"driver": "recording", "statement": "INSERT INTO events (body) VALUES ({body})", "placeholder": "colon"},
+		{"driver": "recording", "statement": "INSERT INTO events (a, b) VALUES ({body}, {service})", "max_params": "1"},
+		{"driver": "unknown", "statement": "INSERT INTO events (body) VALUES ({body})"},
+	}
+	for _, params := range tests {
+		_, err := writer.NewSQLWriter(params)
+		if err == nil {
+			t.Log(fmt.Sprintf("Expected an error for params: %v", params))
+			t.Fail()
+		}
+	}
+}
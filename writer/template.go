@@ -0,0 +1,111 @@
+/*
+This file has the template used to build paths and keys from the time and the fields of a message.
+*/
+package writer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeTokens translates the date tokens accepted in templates into Go's time layout.
+// Longer tokens go first so "yyyy" isn't read as two "yy".
+var timeTokens = []struct{ token, layout string }{
+	{"yyyy", "2006"}, {"MM", "01"}, {"dd", "02"}, {"HH", "15"}, {"mm", "04"}, {"ss", "05"},
+}
+
+// pathTemplate is a parsed template like "/data/{service}/dt={yyyy-MM-dd}/hour={HH}/part.jsonl".
+// Placeholders made only of date tokens and separators are formatted with the time, the other ones are field names.
+type pathTemplate struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal string
+	layout  string
+	field   string
+}
+
+// parseTemplate splits the template in literals, time placeholders and field placeholders.
+func parseTemplate(s string) (*pathTemplate, error) {
+	t := &pathTemplate{}
+	for len(s) > 0 {
+		start := strings.Index(s, "{")
+		if start == -1 {
+			t.parts = append(t.parts, templatePart{literal: s})
+			break
+		}
+		end := strings.Index(s[start:], "}")
+		if end == -1 {
+			return nil, fmt.Errorf("Unclosed placeholder in template %q.", s)
+		}
+		end += start
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{literal: s[:start]})
+		}
+		name := s[start+1 : end]
+		if name == "" {
+			return nil, fmt.Errorf("Empty placeholder in template %q.", s)
+		}
+		if layout, ok := timeLayout(name); ok {
+			t.parts = append(t.parts, templatePart{layout: layout})
+		} else {
+			t.parts = append(t.parts, templatePart{field: name})
+		}
+		s = s[end+1:]
+	}
+	return t, nil
+}
+
+// timeLayout returns the Go layout for a placeholder when it only has date tokens and separators.
+func timeLayout(name string) (string, bool) {
+	var layout strings.Builder
+	var hasToken bool
+	for len(name) > 0 {
+		matched := false
+		for _, tt := range timeTokens {
+			if strings.HasPrefix(name, tt.token) {
+				layout.WriteString(tt.layout)
+				name = name[len(tt.token):]
+				matched, hasToken = true, true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		c := name[0]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			return "", false
+		}
+		layout.WriteByte(c)
+		name = name[1:]
+	}
+	return layout.String(), hasToken
+}
+
+// Execute renders the template with the time and the field values.
+// Field values are sanitized so they can't add directories or move out of the template's path.
+func (t *pathTemplate) Execute(ts time.Time, fields map[string]string) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch {
+		case p.layout != "":
+			b.WriteString(ts.Format(p.layout))
+		case p.field != "":
+			b.WriteString(sanitizePathValue(fields[p.field]))
+		default:
+			b.WriteString(p.literal)
+		}
+	}
+	return b.String()
+}
+
+// sanitizePathValue replaces the separators in a value and the names that have a meaning in a path.
+func sanitizePathValue(v string) string {
+	if v == "" || v == "." || v == ".." {
+		return "unknown"
+	}
+	return strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(v)
+}
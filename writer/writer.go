@@ -5,43 +5,152 @@ To use this application, you should implement a writer that suits your needs.
 package writer
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Writer interface has Write and Close methods.
+// Write must return when the context is done, with the context's error, even if the message couldn't be written.
 type Writer interface {
-	Write(content string) error
+	Write(ctx context.Context, msg Message) error
 	Close()
 }
 
-// CreateWriter generates the right writer based on the received parameters.
+// CreateWriter generates the right writer based on the received parameters,
+// and wraps it with the writers that add behaviour to any other, like batching.
 func CreateWriter(class string, params map[string]string) (Writer, error) {
+	w, err := createWriter(class, params)
+	if err != nil {
+		return nil, err
+	}
+	return wrapWriter(w, params)
+}
+
+// wrapWriter adds the wrappers enabled in the parameters around the writer.
+// Retries go outside the batches, so a failed batch is retried message by message by each of its writers,
+// the spool goes outside them, so requests only wait for the message to be synced to the disk, and the encryption
+// goes outside everything else, so the spool and the dead-letter files only have encrypted messages.
+// With a spool there's no BatchingWriter, the spool writes the batches itself from the messages already synced.
+func wrapWriter(w Writer, params map[string]string) (Writer, error) {
+	if hasBatchingParams(params) && params["spool_dir"] == "" {
+		opts, err := parseBatchingOptions(params)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w = NewBatchingWriter(w, opts)
+	}
+	if hasRetryParams(params) {
+		r, err := newRetryWriter(w, params)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w = r
+	}
+	if params["spool_dir"] != "" {
+		sw, err := newSpoolWriter(w, params)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w = sw
+	}
+	if params["encrypt_key_file"] != "" {
+		ew, err := newEncryptingWriter(w, params)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w = ew
+	}
+	return w, nil
+}
+
+// createWriter has the switch to create the writer for the class.
+func createWriter(class string, params map[string]string) (Writer, error) {
 	var w Writer
 	var err error
 	switch class {
 	case "MemoryWriter":
-		w, err = NewMemoryWriter()
+		capacity := defaultMemoryCapacity
+		if v, ok := params["capacity"]; ok {
+			capacity, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid capacity %q.", v)
+			}
+		}
+		w, err = NewMemoryWriterWithCapacity(capacity)
 	case "FileWriter":
-		w, err = NewFileWriter(params["filepath"])
+		var opts FileWriterOptions
+		opts, err = parseFileWriterOptions(params)
+		if err != nil {
+			return nil, err
+		}
+		w, err = NewFileWriterWithOptions(params["filepath"], opts)
+	case "PartitionedFileWriter":
+		w, err = NewPartitionedFileWriter(params)
+	case "HTTPWriter":
+		w, err = NewHTTPWriter(params)
+	case "S3Writer":
+		w, err = NewS3Writer(params)
+	case "SQLWriter":
+		w, err = NewSQLWriter(params)
+	case "RedisWriter":
+		w, err = NewRedisWriter(params)
+	case "KafkaWriter":
+		w, err = NewKafkaWriter(params)
+	case "SyslogWriter":
+		w, err = NewSyslogWriter(params)
+	case "LineWriter":
+		w, err = NewLineWriter(params)
+	case "PipeWriter":
+		w, err = NewPipeWriter(params)
+	case "ParquetWriter":
+		w, err = NewParquetWriter(params)
 	default:
-		w, err = NewConsoleWriter()
+		var format string
+		format, err = parseFormat(params)
+		if err != nil {
+			return nil, err
+		}
+		w, err = NewConsoleWriterWithFormat(format)
 	}
 	return w, err
 }
 
-// ConsoleWriter is an empty struct, this one just logs messages to the apps output.
+// ConsoleWriter just logs messages to the apps output.
 type ConsoleWriter struct {
+	format string
 }
 
-// NewConsoleWriter creates a ConsoleWriter.
+// NewConsoleWriter creates a ConsoleWriter that logs the body of the messages.
 func NewConsoleWriter() (*ConsoleWriter, error) {
-	return &ConsoleWriter{}, nil
+	return NewConsoleWriterWithFormat(FormatRaw)
+}
+
+// NewConsoleWriterWithFormat creates a ConsoleWriter that logs the messages in the given format.
+func NewConsoleWriterWithFormat(format string) (*ConsoleWriter, error) {
+	return &ConsoleWriter{format: format}, nil
 }
 
 // Write logs the message.
-func (w *ConsoleWriter) Write(content string) error {
+func (w *ConsoleWriter) Write(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	content, err := msg.Format(w.format)
+	if err != nil {
+		return err
+	}
 	log.Info("Message received: " + content)
 	return nil
 }
@@ -51,93 +160,518 @@ func (w *ConsoleWriter) Close() {
 	log.Info("Closing ConsoleWriter.")
 }
 
-// MemoryWriter stores messages in an internal []string.
+// defaultMemoryCapacity is how many messages a MemoryWriter keeps when it's not configured.
+const defaultMemoryCapacity = 1000
+
+// MemoryWriter keeps the last messages in a ring buffer, and can be used from several goroutines.
+// Every message gets a sequence number, starting at 1, so readers can ask for the ones after the last they saw.
+// The zero value keeps defaultMemoryCapacity messages.
 type MemoryWriter struct {
-	Messages []string
+	mu          sync.Mutex
+	capacity    int
+	messages    []Message
+	first       int
+	seq         uint64
+	subscribers map[chan Message]struct{}
 }
 
-// NewMemoryWriter generates an empty struct.
+// NewMemoryWriter creates a MemoryWriter that keeps the last defaultMemoryCapacity messages.
 func NewMemoryWriter() (*MemoryWriter, error) {
+	return NewMemoryWriterWithCapacity(defaultMemoryCapacity)
+}
+
+// NewMemoryWriterWithCapacity creates a MemoryWriter that keeps the last capacity messages.
+func NewMemoryWriterWithCapacity(capacity int) (*MemoryWriter, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("Invalid capacity %d.", capacity)
+	}
 	log.Info("Starting MemoryWriter.")
-	return &MemoryWriter{}, nil
+	return &MemoryWriter{capacity: capacity}, nil
 }
 
-// Write appends the message in the MemoryWriter.
-func (w *MemoryWriter) Write(content string) error {
+// Write stores the message, replacing the oldest one when the buffer is full, and sends it to the subscribers.
+// Subscribers that don't keep up miss the message.
+func (w *MemoryWriter) Write(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	log.Info("Storing message in MemoryWriter.")
-	w.Messages = append(w.Messages, content)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	capacity := w.capacity
+	if capacity == 0 {
+		capacity = defaultMemoryCapacity
+	}
+	if len(w.messages) < capacity {
+		w.messages = append(w.messages, msg)
+	} else {
+		w.messages[w.first] = msg
+		w.first = (w.first + 1) % capacity
+	}
+	w.seq++
+
+	for ch := range w.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			slog.Error(fmt.Sprintf("MemoryWriter subscriber is full, message %d dropped.", w.seq))
+		}
+	}
 	return nil
 }
 
-// GetMessages returns a []string with all the messages.
-func (w *MemoryWriter) GetMessages() []string {
-	return w.Messages
+// GetMessages returns the stored messages, from the oldest to the newest.
+func (w *MemoryWriter) GetMessages() []Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.list()
 }
 
-// Close deletes all the messages from the MemoryWriter.
+// Since returns the stored messages with a sequence number greater than seq, and the sequence number of the
+// last message, to use in the next call. Since(0) returns all the stored messages.
+func (w *MemoryWriter) Since(seq uint64) ([]Message, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq >= w.seq {
+		return nil, w.seq
+	}
+	ms := w.list()
+	oldest := w.seq - uint64(len(ms)) + 1
+	if seq >= oldest {
+		ms = ms[seq-oldest+1:]
+	}
+	return ms, w.seq
+}
+
+// Subscribe returns a channel that receives the messages written from now on, and a function to cancel the
+// subscription. The channel is closed when the subscription is cancelled or the writer is closed.
+func (w *MemoryWriter) Subscribe() (<-chan Message, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	capacity := w.capacity
+	if capacity == 0 {
+		capacity = defaultMemoryCapacity
+	}
+	ch := make(chan Message, capacity)
+	if w.subscribers == nil {
+		w.subscribers = make(map[chan Message]struct{})
+	}
+	w.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.subscribers[ch]; ok {
+			delete(w.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// Close deletes all the messages from the MemoryWriter and closes the subscriptions.
 func (w *MemoryWriter) Close() {
 	log.Info("Closing MemoryWriter.")
-	w.Messages = []string{}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = nil
+	w.first = 0
+	for ch := range w.subscribers {
+		close(ch)
+	}
+	w.subscribers = nil
+}
+
+// list returns a copy of the messages, from the oldest to the newest. It must be called holding mu.
+func (w *MemoryWriter) list() []Message {
+	ms := make([]Message, 0, len(w.messages))
+	ms = append(ms, w.messages[w.first:]...)
+	return append(ms, w.messages[:w.first]...)
+}
+
+// Acknowledgement modes of the FileWriter, they define what Write waits for before returning.
+const (
+	// AckNone returns as soon as the message is queued, errors are only logged.
+	AckNone = "none"
+	// AckWritten waits until the message is written to the file, it's the default.
+	AckWritten = "written"
+	// AckFsynced waits until the file is synced to the disk after writing the message.
+	AckFsynced = "fsynced"
+)
+
+// ErrClosed is returned when a message is written to a writer that was already closed.
+var ErrClosed = errors.New("Writer is closed.")
+
+// backupTimeFormat is the layout of the timestamp suffix added to rotated files, it sorts lexicographically.
+const backupTimeFormat = "20060102T150405.000"
+
+// FileWriterOptions holds the rotation settings of a FileWriter. A zero value disables the corresponding rule.
+type FileWriterOptions struct {
+	// MaxSize is the size in bytes that triggers a rotation before it's exceeded.
+	MaxSize int64
+	// RotateEvery is the maximum time a file is written before it's rotated.
+	RotateEvery time.Duration
+	// MaxBackups is the number of rotated files to keep, the oldest ones are deleted.
+	MaxBackups int
+	// MaxAge is the time a rotated file is kept since its last write.
+	MaxAge time.Duration
+	// MaxTotalSize is the budget in bytes for all the rotated files, the oldest ones are deleted to fit in it.
+	MaxTotalSize int64
+	// Compression is the algorithm used to compress the rotated files in the background: gzip, zstd or empty.
+	Compression string
+	// Format is the way messages are serialized in the file, FormatRaw when it's empty.
+	Format string
+	// AckMode is what Write waits for before returning: AckNone, AckWritten or AckFsynced. AckWritten when it's empty.
+	AckMode string
+}
+
+// parseFileWriterOptions reads the rotation settings from the writer parameters.
+func parseFileWriterOptions(params map[string]string) (FileWriterOptions, error) {
+	var opts FileWriterOptions
+	var err error
+	if v, ok := params["max_size"]; ok {
+		opts.MaxSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid max_size %q: %v", v, err)
+		}
+	}
+	if v, ok := params["rotate_every"]; ok {
+		opts.RotateEvery, err = time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid rotate_every %q: %v", v, err)
+		}
+	}
+	if v, ok := params["max_backups"]; ok {
+		opts.MaxBackups, err = strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid max_backups %q: %v", v, err)
+		}
+	}
+	if v, ok := params["max_age"]; ok {
+		opts.MaxAge, err = time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid max_age %q: %v", v, err)
+		}
+	}
+	if v, ok := params["max_total_size"]; ok {
+		opts.MaxTotalSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid max_total_size %q: %v", v, err)
+		}
+	}
+	opts.Format, err = parseFormat(params)
+	if err != nil {
+		return opts, err
+	}
+	if v, ok := params["compression"]; ok && v != "" {
+		if _, ok := compressedExt[v]; !ok {
+			return opts, fmt.Errorf("Compression %q not supported.", v)
+		}
+		opts.Compression = v
+	}
+	switch v := params["ack_mode"]; v {
+	case "", AckNone, AckWritten, AckFsynced:
+		opts.AckMode = v
+	default:
+		return opts, fmt.Errorf("Invalid ack_mode %q.", v)
+	}
+	return opts, nil
 }
 
 // FileWriter has all the fields necessary to write the messages into a local file.
 type FileWriter struct {
+	path     string
+	options  FileWriterOptions
 	file     *os.File
 	deadline time.Time
 	size     int64
-	mchan    chan string
+	mchan    chan fileRequest
 	done     chan bool
+
+	// closedMu protects closed, Write holds it for reading while it sends into mchan so Close can't close it meanwhile.
+	closedMu sync.RWMutex
+	closed   bool
+
+	housekeeping   sync.WaitGroup
+	housekeepingMu sync.Mutex
+}
+
+// fileRequest is what Write sends to the writing goroutine, the result is sent back through ack when it's not nil.
+type fileRequest struct {
+	content string
+	ack     chan error
 }
 
-// NewFileWriter stores the filepath in an inner field.
+// NewFileWriter creates a FileWriter that appends to a single file without rotation.
 func NewFileWriter(filepath string) (*FileWriter, error) {
-	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0755)
+	return NewFileWriterWithOptions(filepath, FileWriterOptions{})
+}
+
+// NewFileWriterWithOptions opens the file and starts the goroutine that writes and rotates it.
+func NewFileWriterWithOptions(filepath string, opts FileWriterOptions) (*FileWriter, error) {
+	file, size, err := openLogFile(filepath)
 	if err != nil {
 		return &FileWriter{}, err
 	}
 
-	f := &FileWriter{file: file, mchan: make(chan string), done: make(chan bool)}
+	f := &FileWriter{path: filepath, options: opts, file: file, size: size, mchan: make(chan fileRequest), done: make(chan bool)}
+	if opts.RotateEvery > 0 {
+		f.deadline = time.Now().Add(opts.RotateEvery)
+	}
 	go f.fileWrite()
 
+	// Backups left uncompressed by a previous run are processed right away.
+	if opts.Compression != "" {
+		f.housekeeping.Add(1)
+		go f.housekeep()
+	}
+
 	return f, err
 }
 
-// Write sends the message into an inner channel.
-func (w *FileWriter) Write(content string) error {
+// Write formats the message and sends it into an inner channel, then it waits for the acknowledgement of the AckMode.
+// It gives up if the context is done first, but a message that was already queued will still be written.
+func (w *FileWriter) Write(ctx context.Context, msg Message) error {
 	log.Info("Storing message in FileWriter.")
-	w.mchan <- content
-	return nil
+	content, err := msg.Format(w.options.Format)
+	if err != nil {
+		return err
+	}
+	return w.send(ctx, content)
+}
+
+// WriteBatch formats all the messages and writes them to the file at once, with a single acknowledgement.
+func (w *FileWriter) WriteBatch(ctx context.Context, msgs []Message) error {
+	var b strings.Builder
+	for _, msg := range msgs {
+		content, err := msg.Format(w.options.Format)
+		if err != nil {
+			return err
+		}
+		b.WriteString(content)
+		if !strings.HasSuffix(content, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	return w.send(ctx, b.String())
+}
+
+// send queues the content for the writing goroutine and waits for its result, unless AckMode is AckNone.
+func (w *FileWriter) send(ctx context.Context, content string) error {
+	req := fileRequest{content: content}
+	if w.options.AckMode != AckNone {
+		req.ack = make(chan error, 1)
+	}
+
+	w.closedMu.RLock()
+	if w.closed {
+		w.closedMu.RUnlock()
+		return ErrClosed
+	}
+	select {
+	case w.mchan <- req:
+		w.closedMu.RUnlock()
+	case <-ctx.Done():
+		w.closedMu.RUnlock()
+		return ctx.Err()
+	}
+
+	if req.ack == nil {
+		return nil
+	}
+	select {
+	case err := <-req.ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Close closes the inner channel and sends a done message through another channel to finish the writing method.
+// The messages already queued are written before it returns.
 func (w *FileWriter) Close() {
 	log.Info("Closing FileWriter.")
+	w.closedMu.Lock()
+	if w.closed {
+		w.closedMu.Unlock()
+		return
+	}
+	w.closed = true
 	close(w.mchan)
+	w.closedMu.Unlock()
 	<-w.done
-	err := w.file.Close()
-	if err != nil {
-		slog.Error(err)
+	if w.file != nil {
+		err := w.file.Close()
+		if err != nil {
+			slog.Error(err)
+		}
 	}
+	w.housekeeping.Wait()
 }
 
-// fileWrite receives the messages from the channel and waits for the done channel to receive a message.
+// fileWrite receives the messages from the channel until it's closed, then it sends a message through the done channel.
+// It's the only goroutine touching the file, so rotations happen between two messages and nothing in flight is lost.
+// Errors are sent back to the writer of each message, the goroutine keeps running so the next messages can be written.
 func (w *FileWriter) fileWrite() {
 	log.Info("Start writing to file.")
 
-	for m := range w.mchan {
-		var newline string
-		if !strings.HasSuffix(m, "\n") {
-			newline = "\n"
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if w.options.RotateEvery > 0 {
+		timer = time.NewTimer(time.Until(w.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case req, ok := <-w.mchan:
+			if !ok {
+				w.done <- true
+				return
+			}
+			err := w.writeLine(req.content)
+			if err != nil {
+				slog.Error(err.Error())
+			}
+			if req.ack != nil {
+				req.ack <- err
+			}
+		case <-timeout:
+			// Empty files aren't rotated, the period just starts again.
+			if w.size > 0 {
+				w.rotate()
+			} else {
+				w.deadline = time.Now().Add(w.options.RotateEvery)
+			}
+			timer.Reset(time.Until(w.deadline))
 		}
-		n, err := w.file.WriteString(m + newline)
+	}
+}
+
+// writeLine writes the content adding a newline when it's missing, rotating the file first if it would exceed MaxSize.
+func (w *FileWriter) writeLine(content string) error {
+	var newline string
+	if !strings.HasSuffix(content, "\n") {
+		newline = "\n"
+	}
+	line := content + newline
+	if w.file == nil {
+		file, size, err := openActiveFile(w.path)
 		if err != nil {
-			slog.Error(err.Error())
-			return
+			return fmt.Errorf("Couldn't reopen %q after rotation: %v", w.path, err)
 		}
-		w.size += int64(n)
+		w.file, w.size = file, size
+	}
+	if w.options.MaxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.options.MaxSize {
+		w.rotate()
+	}
+	n, err := w.file.WriteString(line)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if w.options.AckMode == AckFsynced {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// rotate renames the current file with a timestamp suffix and opens a new one in the original path.
+// If the new file can't be opened, the renamed one is closed anyway and writes fail until the original path
+// can be opened again, so messages never end up appended to a backup.
+func (w *FileWriter) rotate() {
+	now := time.Now()
+	if w.options.RotateEvery > 0 {
+		w.deadline = now.Add(w.options.RotateEvery)
+	}
+
+	backup := backupName(w.path, now)
+	err := os.Rename(w.path, backup)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	log.Info(fmt.Sprintf("File %q rotated to %q.", w.path, backup))
+
+	err = w.file.Close()
+	if err != nil {
+		slog.Error(err.Error())
 	}
+	w.file, w.size = nil, 0
+
+	file, size, err := openActiveFile(w.path)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Couldn't reopen %q after rotation, writes will fail until it can be opened: %v", w.path, err))
+	} else {
+		w.file, w.size = file, size
+	}
+
+	w.housekeeping.Add(1)
+	go w.housekeep()
+}
 
-	w.done <- true
+// openActiveFile opens the file a FileWriter writes to, tests replace it to simulate failures.
+var openActiveFile = openLogFile
+
+// openLogFile opens the file in append mode and returns its current size.
+func openLogFile(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0755)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// backupName returns the name for a rotated file. If the name is taken, the timestamp is moved forward
+// instead of adding a counter, so the names keep sorting in rotation order.
+func backupName(path string, t time.Time) string {
+	for {
+		name := path + "." + t.Format(backupTimeFormat)
+		taken := fileExists(name)
+		for _, ext := range compressedExt {
+			taken = taken || fileExists(name+ext)
+		}
+		if !taken {
+			return name
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// listBackups returns the rotated files of a path, sorted from oldest to newest.
+func listBackups(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	prefix := len(path) + 1
+	backups := make([]string, 0, len(matches))
+	for _, m := range matches {
+		if strings.HasSuffix(m, ".tmp") {
+			continue
+		}
+		suffix := m[prefix:]
+		if len(suffix) < len(backupTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, suffix[:len(backupTimeFormat)]); err != nil {
+			continue
+		}
+		backups = append(backups, m)
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
 
-	return
+// fileExists returns true when the path exists, whatever its type.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
 }
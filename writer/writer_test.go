@@ -4,10 +4,15 @@ Example testing package for writer interface and MemoryWriter.
 package writer_test
 
 import (
+	"context"
 	"fmt"
 	"github.com/efark/data-receiver/writer"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMemoryWriter_Write(t *testing.T) {
@@ -18,7 +23,7 @@ func TestMemoryWriter_Write(t *testing.T) {
 		t.FailNow()
 	}
 	w = memoryWriter
-	err = w.Write("Test message.")
+	err = w.Write(context.Background(), writer.Message{Body: "Test message."})
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -30,8 +35,120 @@ func TestMemoryWriter_Write(t *testing.T) {
 		t.FailNow()
 	}
 
-	if ms[0] != "Test message." {
-		t.Log(fmt.Sprintf("Expected ms[0]: %q, received: %q", "Test message.", ms[0]))
+	if ms[0].Body != "Test message." {
+		t.Log(fmt.Sprintf("Expected ms[0]: %q, received: %q", "Test message.", ms[0].Body))
+		t.FailNow()
+	}
+}
+
+func TestMemoryWriter_Capacity(t *testing.T) {
+	w, err := writer.NewMemoryWriterWithCapacity(3)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	// Concurrent writes are safe.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Write(context.Background(), writer.Message{Body: "concurrent"})
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		err = w.Write(context.Background(), writer.Message{Body: fmt.Sprintf("message %d", i)})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	// Only the last 3 messages are kept.
+	expected := []string{"message 1", "message 2", "message 3"}
+	ms := w.GetMessages()
+	if len(ms) != len(expected) {
+		t.Log(fmt.Sprintf("Expected len(ms): %d, received: %d", len(expected), len(ms)))
+		t.FailNow()
+	}
+	for i, m := range ms {
+		if m.Body != expected[i] {
+			t.Log(fmt.Sprintf("Expected ms[%d]: %q, received: %q", i, expected[i], m.Body))
+			t.Fail()
+		}
+	}
+}
+
+func TestMemoryWriter_Since(t *testing.T) {
+	w, err := writer.NewMemoryWriterWithCapacity(3)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	for i := 0; i < 2; i++ {
+		w.Write(context.Background(), writer.Message{Body: fmt.Sprintf("message %d", i)})
+	}
+	ms, seq := w.Since(0)
+	if len(ms) != 2 || seq != 2 {
+		t.Log(fmt.Sprintf("Expected %d messages and seq %d, received: %d and %d", 2, 2, len(ms), seq))
+		t.FailNow()
+	}
+
+	ms, seq = w.Since(seq)
+	if len(ms) != 0 || seq != 2 {
+		t.Log(fmt.Sprintf("Expected %d messages and seq %d, received: %d and %d", 0, 2, len(ms), seq))
+		t.FailNow()
+	}
+
+	// Messages 0 and 1 are replaced, Since returns the ones still stored.
+	for i := 2; i < 6; i++ {
+		w.Write(context.Background(), writer.Message{Body: fmt.Sprintf("message %d", i)})
+	}
+	ms, seq = w.Since(1)
+	if len(ms) != 3 || ms[0].Body != "message 3" || seq != 6 {
+		t.Log(fmt.Sprintf("Expected messages from %q and seq %d, received: %v and %d", "message 3", 6, ms, seq))
+		t.FailNow()
+	}
+	ms, _ = w.Since(5)
+	if len(ms) != 1 || ms[0].Body != "message 5" {
+		t.Log(fmt.Sprintf("Expected message: %q, received: %v", "message 5", ms))
+		t.FailNow()
+	}
+}
+
+func TestMemoryWriter_Subscribe(t *testing.T) {
+	w, err := writer.NewMemoryWriter()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Write(context.Background(), writer.Message{Body: "before"})
+
+	ch, cancel := w.Subscribe()
+	defer cancel()
+	go w.Write(context.Background(), writer.Message{Body: "after"})
+
+	select {
+	case m := <-ch:
+		if m.Body != "after" {
+			t.Log(fmt.Sprintf("Expected message: %q, received: %q", "after", m.Body))
+			t.FailNow()
+		}
+	case <-time.After(time.Second):
+		t.Log("Message not received.")
+		t.FailNow()
+	}
+
+	// Close closes the subscriptions.
+	w.Close()
+	if _, ok := <-ch; ok {
+		t.Log("Expected the channel to be closed.")
 		t.FailNow()
 	}
 }
@@ -50,12 +167,12 @@ func TestFileWriter_Write(t *testing.T) {
 	}
 
 	w = fileWriter
-	err = w.Write("Test message 1.")
+	err = w.Write(context.Background(), writer.Message{Body: "Test message 1."})
 	if err != nil {
 		t.Error(err)
 		t.Fail()
 	}
-	err = w.Write("Test message 2.")
+	err = w.Write(context.Background(), writer.Message{Body: "Test message 2."})
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -90,12 +207,12 @@ func TestFileWriter_OpenFileTwice(t *testing.T) {
 	}
 
 	w = fileWriter
-	err = w.Write("Test message 1.")
+	err = w.Write(context.Background(), writer.Message{Body: "Test message 1."})
 	if err != nil {
 		t.Error(err)
 		t.Fail()
 	}
-	err = w.Write("Test message 2.")
+	err = w.Write(context.Background(), writer.Message{Body: "Test message 2."})
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -108,7 +225,7 @@ func TestFileWriter_OpenFileTwice(t *testing.T) {
 	}
 
 	w = fileWriter2
-	err = w.Write("Test message 1-2.")
+	err = w.Write(context.Background(), writer.Message{Body: "Test message 1-2."})
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -120,3 +237,288 @@ func TestFileWriter_OpenFileTwice(t *testing.T) {
 		os.Remove(filepath)
 	}
 }
+
+func TestFileWriter_RotateBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewriter")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.txt")
+	opts := writer.FileWriterOptions{MaxSize: 20, MaxBackups: 2}
+	w, err := writer.NewFileWriterWithOptions(path, opts)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// Each message takes 16 bytes with the newline, so every message after the first one rotates the file.
+	for i := 1; i <= 4; i++ {
+		err = w.Write(context.Background(), writer.Message{Body: fmt.Sprintf("Test message %d.", i)})
+		if err != nil {
+			t.Error(err)
+			t.Fail()
+		}
+	}
+	w.Close()
+
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(backups) != 2 {
+		t.Log(fmt.Sprintf("Expected len(backups): %d, received: %d", 2, len(backups)))
+		t.FailNow()
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(content) != "Test message 4.\n" {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", "Test message 4.\n", string(content)))
+		t.FailNow()
+	}
+
+	content, err = ioutil.ReadFile(backups[len(backups)-1])
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(content) != "Test message 3.\n" {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", "Test message 3.\n", string(content)))
+		t.FailNow()
+	}
+}
+
+func TestFileWriter_RotateByTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewriter")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.txt")
+	w, err := writer.CreateWriter("FileWriter", map[string]string{"filepath": path, "rotate_every": "100ms"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// Empty periods don't generate new files.
+	time.Sleep(250 * time.Millisecond)
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(backups) != 0 {
+		t.Log(fmt.Sprintf("Expected len(backups): %d, received: %d", 0, len(backups)))
+		t.FailNow()
+	}
+
+	err = w.Write(context.Background(), writer.Message{Body: "Test message 1."})
+	if err != nil {
+		t.Error(err)
+		t.Fail()
+	}
+	// Waits for the rotation instead of sleeping, the second message is written right after it, far from the next one.
+	for i := 0; i < 1000 && len(backups) == 0; i++ {
+		time.Sleep(time.Millisecond)
+		backups, err = filepath.Glob(path + ".*")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	err = w.Write(context.Background(), writer.Message{Body: "Test message 2."})
+	if err != nil {
+		t.Error(err)
+		t.Fail()
+	}
+	w.Close()
+
+	backups, err = filepath.Glob(path + ".*")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(backups) != 1 {
+		t.Log(fmt.Sprintf("Expected len(backups): %d, received: %d", 1, len(backups)))
+		t.FailNow()
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(content) != "Test message 2.\n" {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", "Test message 2.\n", string(content)))
+		t.FailNow()
+	}
+}
+
+func TestCreateWriter_InvalidRotation(t *testing.T) {
+	_, err := writer.CreateWriter("FileWriter", map[string]string{"filepath": "./test.txt", "max_size": "ten"})
+	if err == nil {
+		t.Error("Expected error for invalid max_size.")
+		t.FailNow()
+	}
+}
+
+func TestFileWriter_AckModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewriter")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	for _, mode := range []string{writer.AckWritten, writer.AckFsynced} {
+		path := filepath.Join(dir, mode+".txt")
+		w, err := writer.CreateWriter("FileWriter", map[string]string{"filepath": path, "ack_mode": mode})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		err = w.Write(context.Background(), writer.Message{Body: "Test message."})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		// The message is already in the file when Write returns, before closing the writer.
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if string(content) != "Test message.\n" {
+			t.Log(fmt.Sprintf("Expected content with %s: %q, received: %q", mode, "Test message.\n", string(content)))
+			t.FailNow()
+		}
+		w.Close()
+	}
+}
+
+func TestFileWriter_WriteError(t *testing.T) {
+	// Every write to /dev/full fails with ENOSPC.
+	if !fileExists("/dev/full") {
+		t.Skip("/dev/full not available.")
+	}
+	w, err := writer.NewFileWriter("/dev/full")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+
+	// The writer must keep answering after a failed write.
+	for i := 0; i < 2; i++ {
+		err = w.Write(context.Background(), writer.Message{Body: "Test message."})
+		if err == nil {
+			t.Error("Expected error writing to /dev/full.")
+			t.FailNow()
+		}
+	}
+	w.Close()
+}
+
+func TestFileWriter_WriteAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewriter")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := writer.NewFileWriter(filepath.Join(dir, "test.txt"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	w.Close()
+
+	err = w.Write(context.Background(), writer.Message{Body: "Test message."})
+	if err != writer.ErrClosed {
+		t.Log(fmt.Sprintf("Expected error: %v, received: %v", writer.ErrClosed, err))
+		t.FailNow()
+	}
+	// Closing twice doesn't block.
+	w.Close()
+}
+
+func TestFileWriter_RotateReopenError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewriter")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.txt")
+	w, err := writer.NewFileWriterWithOptions(path, writer.FileWriterOptions{MaxSize: 10})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer w.Close()
+
+	err = w.Write(context.Background(), writer.Message{Body: "message 1"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// The rotation renames the file but the new one can't be opened, writes fail instead of going to the backup.
+	restore := writer.FailOpenActiveFile(fmt.Errorf("open failed"))
+	for i := 0; i < 2; i++ {
+		err = w.Write(context.Background(), writer.Message{Body: "lost"})
+		if err == nil {
+			restore()
+			t.Error("Expected error writing while the active file can't be opened.")
+			t.FailNow()
+		}
+	}
+	restore()
+
+	// Once the file can be opened again, writes go to the original path.
+	err = w.Write(context.Background(), writer.Message{Body: "message 2"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(content) != "message 2\n" {
+		t.Log(fmt.Sprintf("Expected content: %q, received: %q", "message 2\n", string(content)))
+		t.FailNow()
+	}
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(backups) != 1 {
+		t.Log(fmt.Sprintf("Expected backups: %d, received: %v", 1, backups))
+		t.FailNow()
+	}
+	content, err = ioutil.ReadFile(backups[0])
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(content) != "message 1\n" {
+		t.Log(fmt.Sprintf("Expected backup content: %q, received: %q", "message 1\n", string(content)))
+		t.FailNow()
+	}
+}